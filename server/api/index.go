@@ -18,6 +18,7 @@ func RegisterRoutes(app *fiber.App) {
     routes.RegisterServerRoutes(app)
     app.Post("/api/local/validate-path", routes.ValidateLocalPath)
     routes.RegisterBackupRoutes(app)
+    routes.RegisterRunRoutes(app)
     routes.MonitorRoutes(app)
     routes.RegisterDashboardRoutes(app)
 }
@@ -2,9 +2,11 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
 	"snaptrack/auth"
 	"snaptrack/db"
 	"snaptrack/services/backups"
+	"snaptrack/services/scheduler"
 	"strconv"
 	"time"
 
@@ -16,6 +18,8 @@ import (
 type BackupProgressResponse struct {
 	ID             uint        `json:"id"`
 	BackupID       uint        `json:"backup_id"`
+	RunID          *uint       `json:"run_id"`
+	Operation      string      `json:"operation"`
 	Backup         db.Backup   `json:"backup"`
 	Servers        []db.Server `json:"servers"`
 	Status         string      `json:"status"`
@@ -31,27 +35,99 @@ type BackupProgressResponse struct {
 }
 
 type BackupResponse struct {
-	ID           uint        `json:"id"`
-	Name         string      `json:"name"`
-	ServerIDs    []uint      `json:"server_ids"`
-	Servers      []db.Server `json:"servers"` 
-	Source       string      `json:"source"`
-	Destination  string      `json:"destination"`
-	FileType     string      `json:"file_type"`
-	Type         string      `json:"type"`
-	ScheduleType string      `json:"schedule_type"`
-	Status       string      `json:"status"`
-	SizeBytes    int64       `json:"size_bytes"`
-	Checksum     *string     `json:"checksum"`
-	StartedAt    *time.Time  `json:"started_at"`
-	CompletedAt  *time.Time  `json:"completed_at"`
-	DurationSec  int64       `json:"duration_sec"`
-	ExecutedBy   string      `json:"executed_by"`
-	CreatedAt    time.Time   `json:"created_at"`
-	UpdatedAt    time.Time   `json:"updated_at"`
+	ID               uint               `json:"id"`
+	Name             string             `json:"name"`
+	ServerIDs        []uint             `json:"server_ids"`
+	Servers          []db.Server        `json:"servers"`
+	Source           string             `json:"source"`
+	SourceServerID   *uint              `json:"source_server_id"`
+	SourceType       string             `json:"source_type"`
+	Database         db.DatabaseSource  `json:"database"`
+	Docker           db.DockerSource    `json:"docker"`
+	Destination      string             `json:"destination"`
+	FileType         string             `json:"file_type"`
+	ArchiveName      *string            `json:"archive_name"`
+	Type             string             `json:"type"`
+	ScheduleType     string             `json:"schedule_type"`
+	CronExpr         *string            `json:"cron_expr"`
+	Timezone         *string            `json:"timezone"`
+	NextRunAt        *time.Time         `json:"next_run_at"`
+	LastRunAt        *time.Time         `json:"last_run_at"`
+	Retention        db.RetentionPolicy `json:"retention"`
+	VerifySchedule   *string            `json:"verify_schedule"`
+	NextVerifyAt     *time.Time         `json:"next_verify_at"`
+	Drill            db.RestoreDrill    `json:"drill"`
+	NextDrillAt      *time.Time         `json:"next_drill_at"`
+	Detection        db.ChangeDetection `json:"detection"`
+	Includes         []string           `json:"includes"`
+	Excludes         []string           `json:"excludes"`
+	MinFileSize      int64              `json:"min_file_size"`
+	MaxFileSize      int64              `json:"max_file_size"`
+	SkipRecentSec    int                `json:"skip_recent_sec"`
+	Compression      string             `json:"compression"`
+	CompressionLevel int                `json:"compression_level"`
+	SkipRecompress   bool               `json:"skip_recompress"`
+	Encryption       string             `json:"encryption"`
+	Recipients       *string            `json:"recipients"`
+	Priority         int                `json:"priority"`
+	MaxAttempts      int                `json:"max_attempts"`
+	RetryBackoffSec  int                `json:"retry_backoff_sec"`
+	RetryOn          []string           `json:"retry_on"`
+	Status           string             `json:"status"`
+	SizeBytes        int64              `json:"size_bytes"`
+	Checksum         *string            `json:"checksum"`
+	StartedAt        *time.Time         `json:"started_at"`
+	CompletedAt      *time.Time         `json:"completed_at"`
+	DurationSec      int64              `json:"duration_sec"`
+	ExecutedBy       string             `json:"executed_by"`
+	CreatedAt        time.Time          `json:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at"`
+}
+
+// backupOptions carries request fields that cannot be read from db.Backup:
+// the write-only passphrase or age identity and database password of a
+// backup, which are sealed before they are stored and never returned, and
+// settings whose zero value is meaningful on update.
+type backupOptions struct {
+	Secret           *string `json:"encryption_secret"`
+	DatabasePassword *string `json:"database_password"`
+	Source           *string `json:"source"`
+	CompressionLevel *int    `json:"compression_level"`
+	SkipRecompress   *bool   `json:"skip_recompress"`
+	MinFileSize      *int64  `json:"min_file_size"`
+	MaxFileSize      *int64  `json:"max_file_size"`
+	SkipRecentSec    *int    `json:"skip_recent_sec"`
+	Priority         *int    `json:"priority"`
+	MaxAttempts      *int    `json:"max_attempts"`
+	RetryBackoffSec  *int    `json:"retry_backoff_sec"`
+
+	Retention *retentionUpdate `json:"retention"`
+	Detection *detectionUpdate `json:"detection"`
+}
+
+// retentionUpdate holds the retention rules of an update; an explicit 0
+// disables a rule.
+type retentionUpdate struct {
+	KeepLast    *int `json:"keep_last"`
+	KeepDaily   *int `json:"keep_daily"`
+	KeepWeekly  *int `json:"keep_weekly"`
+	KeepMonthly *int `json:"keep_monthly"`
+	KeepYearly  *int `json:"keep_yearly"`
+	MaxAgeDays  *int `json:"max_age_days"`
+}
+
+// detectionUpdate holds the detection settings of an update; unlike
+// db.ChangeDetection it tells an explicit false or 0 from a missing field.
+type detectionUpdate struct {
+	Disabled      *bool `json:"disabled"`
+	MinFiles      *int  `json:"min_files"`
+	MaxChangedPct *int  `json:"max_changed_pct"`
+	MaxEntropyPct *int  `json:"max_entropy_pct"`
+	MaxRenamePct  *int  `json:"max_rename_pct"`
 }
 
 var backupService *backups.BackupService
+var backupScheduler *scheduler.Scheduler
 
 func RegisterBackupRoutes(app *fiber.App) {
 	backupService = backups.NewBackupService()
@@ -59,43 +135,85 @@ func RegisterBackupRoutes(app *fiber.App) {
     // On service start, clean up any stale running states from previous instance
     cleanupStaleRunning()
 
+	backupScheduler = scheduler.New(backupService)
+	backupScheduler.Start()
+	backupService.StartPruner()
+	backupService.StartQueue()
+
 	api := app.Group("/api/backups", auth.RequireJWT())
 
 	api.Get("/", listBackups)
 	api.Post("/", createBackup)
+	api.Get("/queue", listQueue)
+	api.Delete("/queue/:id", cancelQueuedJob)
 	api.Get("/processes/running", getRunningBackups)
 	api.Delete("/processes", deleteAllProcesses)
 	api.Delete("/processes/:id", deleteProcess)
+	api.Post("/processes/:id/cancel", cancelProcess)
+	api.Post("/processes/:id/pause", pauseProcess)
+	api.Post("/processes/:id/resume", resumeProcess)
 	api.Get("/:id", getBackup)
 	api.Put("/:id", updateBackup)
 	api.Delete("/:id", deleteBackup)
 	api.Post("/:id/execute", executeBackup)
+	api.Post("/:id/restore", restoreBackup)
+	api.Post("/:id/verify", verifyBackup)
+	api.Put("/:id/drill", updateDrill)
+	api.Post("/:id/drill", runDrill)
+	api.Get("/:id/drills", listDrills)
+	api.Put("/:id/retention", updateRetention)
+	api.Put("/:id/detection", updateDetection)
+	api.Get("/:id/retention/preview", previewRetention)
+	api.Post("/:id/prune", pruneBackup)
+	api.Post("/:id/gc", collectGarbage)
+	api.Get("/:id/diff", diffBackupRuns)
 	api.Get("/:id/progress", getBackupProgress)
+	api.Get("/:id/runs", listBackupRuns)
+	api.Get("/:id/runs/:runId", getBackupRun)
+	api.Delete("/:id/runs/:runId/suspicious", dismissSuspiciousRun)
+	api.Post("/:id/runs/:runId/lock", lockRun)
+	api.Delete("/:id/runs/:runId/lock", unlockRun)
 }
 
-// cleanupStaleRunning marks any "running" progress/backup records as interrupted
+// cleanupStaleRunning marks any "running" progress/backup/run/drill records as interrupted
 // so the system can be re-executed after a service restart or crash.
 func cleanupStaleRunning() {
     // Mark running progresses as failed with a restart message
     var progresses []db.BackupProgress
-    if err := db.DB.Where("status = ?", "running").Find(&progresses).Error; err == nil {
+    if err := db.DB.Where("status IN ?", []string{"running", "paused"}).Find(&progresses).Error; err == nil {
         for _, p := range progresses {
             p.Status = "failed"
             p.Message = "Interrupted due to service restart"
             p.UpdatedAt = time.Now()
             db.DB.Save(&p)
 
-            // Reset corresponding backup to pending so it can be started again
-            var b db.Backup
-            if err := db.DB.First(&b, p.BackupID).Error; err == nil {
-                b.Status = "pending"
-                b.UpdatedAt = time.Now()
-                db.DB.Save(&b)
-            }
         }
     }
 
-    // Also reset any backups stuck in running without a progress row
+    // Runs that were being written when the service stopped are failed, so
+    // they leave the run history and no longer hold repository chunks
+    db.DB.Model(&db.BackupRun{}).Where("status = ?", "running").Updates(map[string]any{
+        "status":       "failed",
+        "error":        "Interrupted by restart",
+        "error_class":  backups.ErrorClassOther,
+        "completed_at": time.Now(),
+    })
+    // Likewise for restore drills; verifications only record their outcome
+    // once done, their progress is failed above
+    db.DB.Model(&db.DrillResult{}).Where("status = ?", "running").Updates(map[string]any{
+        "status":      "failed",
+        "error":       "Interrupted by restart",
+        "finished_at": time.Now(),
+    })
+
+    // Backups whose job is requeued by the worker pool keep their place in
+    // the queue; the rest can be started again
+    db.DB.Model(&db.Backup{}).
+        Where("status = ? AND id IN (?)", "running", db.DB.Model(&db.BackupJob{}).Select("backup_id").Where("status IN ?", []string{"queued", "running"})).
+        Updates(map[string]any{
+            "status":     "queued",
+            "updated_at": time.Now(),
+        })
     db.DB.Model(&db.Backup{}).Where("status = ?", "running").Updates(map[string]any{
         "status":     "pending",
         "updated_at": time.Now(),
@@ -147,24 +265,53 @@ func listBackups(c *fiber.Ctx) error {
 		}
 
 		resp = append(resp, BackupResponse{
-			ID:           b.ID,
-			Name:         b.Name,
-			ServerIDs:    serverIDs,
-			Servers:      servers,
-			Source:       b.Source,
-			Destination:  b.Destination,
-			FileType:     b.FileType,
-			Type:         b.Type,
-			ScheduleType: b.ScheduleType,
-			Status:       b.Status,
-			SizeBytes:    b.SizeBytes,
-			Checksum:     b.Checksum,
-			StartedAt:    b.StartedAt,
-			CompletedAt:  b.CompletedAt,
-			DurationSec:  b.DurationSec,
-			ExecutedBy:   b.ExecutedBy,
-			CreatedAt:    b.CreatedAt,
-			UpdatedAt:    b.UpdatedAt,
+			ID:               b.ID,
+			Name:             b.Name,
+			ServerIDs:        serverIDs,
+			Servers:          servers,
+			Source:           b.Source,
+			SourceServerID:   b.SourceServerID,
+			SourceType:       b.SourceType,
+			Database:         b.Database,
+			Docker:           b.Docker,
+			Destination:      b.Destination,
+			FileType:         b.FileType,
+			ArchiveName:      b.ArchiveName,
+			Type:             b.Type,
+			ScheduleType:     b.ScheduleType,
+			CronExpr:         b.CronExpr,
+			Timezone:         b.Timezone,
+			NextRunAt:        b.NextRunAt,
+			LastRunAt:        b.LastRunAt,
+			Retention:        b.Retention,
+			VerifySchedule:   b.VerifySchedule,
+			NextVerifyAt:     b.NextVerifyAt,
+			Drill:            b.Drill,
+			NextDrillAt:      b.NextDrillAt,
+			Detection:        b.Detection,
+			Includes:         b.Includes,
+			Excludes:         b.Excludes,
+			MinFileSize:      b.MinFileSize,
+			MaxFileSize:      b.MaxFileSize,
+			SkipRecentSec:    b.SkipRecentSec,
+			Compression:      b.Compression,
+			CompressionLevel: b.CompressionLevel,
+			SkipRecompress:   b.SkipRecompress,
+			Encryption:       b.Encryption,
+			Recipients:       b.Recipients,
+			Priority:         b.Priority,
+			MaxAttempts:      b.MaxAttempts,
+			RetryBackoffSec:  b.RetryBackoffSec,
+			RetryOn:          b.RetryOn,
+			Status:           b.Status,
+			SizeBytes:        b.SizeBytes,
+			Checksum:         b.Checksum,
+			StartedAt:        b.StartedAt,
+			CompletedAt:      b.CompletedAt,
+			DurationSec:      b.DurationSec,
+			ExecutedBy:       b.ExecutedBy,
+			CreatedAt:        b.CreatedAt,
+			UpdatedAt:        b.UpdatedAt,
 		})
 	}
 
@@ -194,24 +341,53 @@ func getBackup(c *fiber.Ctx) error {
 	}
 
 	resp := BackupResponse{
-		ID:           b.ID,
-		Name:         b.Name,
-		ServerIDs:    serverIDs,
-		Servers:      servers,
-		Source:       b.Source,
-		Destination:  b.Destination,
-		FileType:     b.FileType,
-		Type:         b.Type,
-		ScheduleType: b.ScheduleType,
-		Status:       b.Status,
-		SizeBytes:    b.SizeBytes,
-		Checksum:     b.Checksum,
-		StartedAt:    b.StartedAt,
-		CompletedAt:  b.CompletedAt,
-		DurationSec:  b.DurationSec,
-		ExecutedBy:   b.ExecutedBy,
-		CreatedAt:    b.CreatedAt,
-		UpdatedAt:    b.UpdatedAt,
+		ID:               b.ID,
+		Name:             b.Name,
+		ServerIDs:        serverIDs,
+		Servers:          servers,
+		Source:           b.Source,
+		SourceServerID:   b.SourceServerID,
+		SourceType:       b.SourceType,
+		Database:         b.Database,
+		Docker:           b.Docker,
+		Destination:      b.Destination,
+		FileType:         b.FileType,
+		ArchiveName:      b.ArchiveName,
+		Type:             b.Type,
+		ScheduleType:     b.ScheduleType,
+		CronExpr:         b.CronExpr,
+		Timezone:         b.Timezone,
+		NextRunAt:        b.NextRunAt,
+		LastRunAt:        b.LastRunAt,
+		Retention:        b.Retention,
+		VerifySchedule:   b.VerifySchedule,
+		NextVerifyAt:     b.NextVerifyAt,
+		Drill:            b.Drill,
+		NextDrillAt:      b.NextDrillAt,
+		Detection:        b.Detection,
+		Includes:         b.Includes,
+		Excludes:         b.Excludes,
+		MinFileSize:      b.MinFileSize,
+		MaxFileSize:      b.MaxFileSize,
+		SkipRecentSec:    b.SkipRecentSec,
+		Compression:      b.Compression,
+		CompressionLevel: b.CompressionLevel,
+		SkipRecompress:   b.SkipRecompress,
+		Encryption:       b.Encryption,
+		Recipients:       b.Recipients,
+		Priority:         b.Priority,
+		MaxAttempts:      b.MaxAttempts,
+		RetryBackoffSec:  b.RetryBackoffSec,
+		RetryOn:          b.RetryOn,
+		Status:           b.Status,
+		SizeBytes:        b.SizeBytes,
+		Checksum:         b.Checksum,
+		StartedAt:        b.StartedAt,
+		CompletedAt:      b.CompletedAt,
+		DurationSec:      b.DurationSec,
+		ExecutedBy:       b.ExecutedBy,
+		CreatedAt:        b.CreatedAt,
+		UpdatedAt:        b.UpdatedAt,
 	}
 
 	return c.JSON(resp)
@@ -226,11 +402,67 @@ func createBackup(c *fiber.Ctx) error {
 	if username := c.Locals("username"); username != nil {
 		backup.ExecutedBy = username.(string)
 	}
+	var opts backupOptions
+	if err := c.BodyParser(&opts); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Omitted retry settings get the defaults; an explicit 0 is kept
+	if opts.MaxAttempts == nil {
+		backup.MaxAttempts = backups.DefaultMaxAttempts
+	}
+	if opts.RetryBackoffSec == nil {
+		backup.RetryBackoffSec = backups.DefaultRetryBackoffSec
+	}
+
+	if err := scheduler.Validate(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if backup.ArchiveName != nil {
+		if err := backups.ValidateArchiveName(*backup.ArchiveName); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if err := backups.ValidateRetention(backup.Retention); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDrill(backup.Drill); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDetection(backup.Detection); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateCompression(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateFilters(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateRetry(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if backup.SourceServerID != nil && *backup.SourceServerID == 0 {
+		backup.SourceServerID = nil
+	}
+	if err := backups.ValidateSource(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateTargets(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ConfigureEncryption(&backup, "", opts.Secret); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ConfigureSource(&backup, opts.DatabasePassword); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	backup.Status = "pending"
 	if err := db.DB.Create(&backup).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	if err := backupScheduler.Reschedule(&backup); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 	return c.Status(201).JSON(backup)
 }
 
@@ -245,16 +477,269 @@ func updateBackup(c *fiber.Ctx) error {
 	if err := c.BodyParser(&updateData); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
+	var opts backupOptions
+	if err := c.BodyParser(&opts); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	merged := backup
+	if updateData.ScheduleType != "" {
+		merged.ScheduleType = updateData.ScheduleType
+	}
+	if updateData.CronExpr != nil {
+		merged.CronExpr = updateData.CronExpr
+	}
+	if updateData.Timezone != nil {
+		merged.Timezone = updateData.Timezone
+	}
+	if updateData.VerifySchedule != nil {
+		merged.VerifySchedule = updateData.VerifySchedule
+	}
+	// Retention, drill and detection settings sent here are merged field by
+	// field, like the other settings
+	mergeRetention(&merged.Retention, opts.Retention)
+	mergeDrill(&merged.Drill, updateData.Drill)
+	mergeDetection(&merged.Detection, opts.Detection)
+	updateData.Retention = db.RetentionPolicy{}
+	updateData.Drill = db.RestoreDrill{}
+	updateData.Detection = db.ChangeDetection{}
+	if err := scheduler.Validate(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if updateData.ArchiveName != nil {
+		if err := backups.ValidateArchiveName(*updateData.ArchiveName); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if err := backups.ValidateRetention(merged.Retention); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDrill(merged.Drill); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDetection(merged.Detection); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	// The file type is merged first, the checks below depend on it
+	if updateData.FileType != "" {
+		merged.FileType = updateData.FileType
+	}
+	if updateData.Compression != "" {
+		merged.Compression = updateData.Compression
+	}
+	if opts.CompressionLevel != nil {
+		merged.CompressionLevel = *opts.CompressionLevel
+	}
+	if opts.SkipRecompress != nil {
+		merged.SkipRecompress = *opts.SkipRecompress
+	}
+	if err := backups.ValidateCompression(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if updateData.Includes != nil {
+		merged.Includes = updateData.Includes
+	}
+	if updateData.Excludes != nil {
+		merged.Excludes = updateData.Excludes
+	}
+	if opts.MinFileSize != nil {
+		merged.MinFileSize = *opts.MinFileSize
+	}
+	if opts.MaxFileSize != nil {
+		merged.MaxFileSize = *opts.MaxFileSize
+	}
+	if opts.SkipRecentSec != nil {
+		merged.SkipRecentSec = *opts.SkipRecentSec
+	}
+	if err := backups.ValidateFilters(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if opts.MaxAttempts != nil {
+		merged.MaxAttempts = *opts.MaxAttempts
+	}
+	if opts.RetryBackoffSec != nil {
+		merged.RetryBackoffSec = *opts.RetryBackoffSec
+	}
+	if updateData.RetryOn != nil {
+		merged.RetryOn = updateData.RetryOn
+	}
+	if err := backups.ValidateRetry(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if updateData.SourceType != "" {
+		merged.SourceType = updateData.SourceType
+	}
+	// An empty source dumps all databases of a database server, or only the
+	// listed volumes of a docker source
+	if updateData.Source != "" {
+		merged.Source = updateData.Source
+	} else if opts.Source != nil && (merged.SourceType == backups.SourcePostgres || merged.SourceType == backups.SourceMySQL || merged.SourceType == backups.SourceRedis || merged.SourceType == backups.SourceDocker) {
+		merged.Source = ""
+	}
+	// A source server ID of 0 moves the source back to this host
+	if updateData.SourceServerID != nil {
+		merged.SourceServerID = updateData.SourceServerID
+		if *updateData.SourceServerID == 0 {
+			merged.SourceServerID = nil
+		}
+		updateData.SourceServerID = nil
+	}
+	if updateData.Database.Host != nil {
+		merged.Database.Host = updateData.Database.Host
+	}
+	if updateData.Database.Port != nil {
+		merged.Database.Port = updateData.Database.Port
+	}
+	if updateData.Database.User != nil {
+		merged.Database.User = updateData.Database.User
+	}
+	updateData.Database = db.DatabaseSource{}
+	if updateData.Docker.Volumes != nil {
+		merged.Docker.Volumes = updateData.Docker.Volumes
+	}
+	if updateData.Docker.Quiesce != "" {
+		merged.Docker.Quiesce = updateData.Docker.Quiesce
+	}
+	updateData.Docker = db.DockerSource{}
+	if err := backups.ValidateSource(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(updateData.ServerIDs) > 0 {
+		merged.ServerIDs = updateData.ServerIDs
+	}
+	if err := backups.ValidateTargets(merged); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if updateData.Encryption != "" {
+		merged.Encryption = updateData.Encryption
+	}
+	if updateData.Recipients != nil {
+		merged.Recipients = updateData.Recipients
+	}
+	if err := backups.ConfigureEncryption(&merged, backup.Encryption, opts.Secret); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if updateData.Type != "" {
+		merged.Type = updateData.Type
+	}
+	if err := backups.ConfigureSource(&merged, opts.DatabasePassword); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	db.DB.Model(&backup).Updates(updateData)
+	backup.MinFileSize = merged.MinFileSize
+	backup.MaxFileSize = merged.MaxFileSize
+	backup.SkipRecentSec = merged.SkipRecentSec
+	backup.CompressionLevel = merged.CompressionLevel
+	backup.SkipRecompress = merged.SkipRecompress
+	backup.Encryption = merged.Encryption
+	backup.Recipients = merged.Recipients
+	backup.SealedKey = merged.SealedKey
+	backup.MaxAttempts = merged.MaxAttempts
+	backup.RetryBackoffSec = merged.RetryBackoffSec
+	backup.SourceServerID = merged.SourceServerID
+	backup.Source = merged.Source
+	backup.SourceType = merged.SourceType
+	backup.Database = merged.Database
+	backup.Docker = merged.Docker
+	backup.Retention = merged.Retention
+	backup.Drill = merged.Drill
+	backup.Detection = merged.Detection
+	if opts.Priority != nil {
+		backup.Priority = *opts.Priority
+	}
+	db.DB.Model(&backup).
+		Select("MinFileSize", "MaxFileSize", "SkipRecentSec", "CompressionLevel", "SkipRecompress", "Encryption", "Recipients", "SealedKey", "Priority", "MaxAttempts", "RetryBackoffSec", "SourceServerID", "Source", "SourceType", "Database", "Docker", "Retention", "Drill", "Detection").
+		Updates(&backup)
+	if err := backupScheduler.Reschedule(&backup); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 	return c.JSON(backup)
 }
 
+// mergeRetention applies the rules of an update that are set.
+func mergeRetention(p *db.RetentionPolicy, update *retentionUpdate) {
+	if update == nil {
+		return
+	}
+	if update.KeepLast != nil {
+		p.KeepLast = *update.KeepLast
+	}
+	if update.KeepDaily != nil {
+		p.KeepDaily = *update.KeepDaily
+	}
+	if update.KeepWeekly != nil {
+		p.KeepWeekly = *update.KeepWeekly
+	}
+	if update.KeepMonthly != nil {
+		p.KeepMonthly = *update.KeepMonthly
+	}
+	if update.KeepYearly != nil {
+		p.KeepYearly = *update.KeepYearly
+	}
+	if update.MaxAgeDays != nil {
+		p.MaxAgeDays = *update.MaxAgeDays
+	}
+}
+
+// mergeDrill applies the drill settings of an update that are set.
+func mergeDrill(d *db.RestoreDrill, update db.RestoreDrill) {
+	if update.Schedule != nil {
+		d.Schedule = update.Schedule
+	}
+	if update.ServerID != nil {
+		d.ServerID = update.ServerID
+	}
+	if update.ScratchPath != nil {
+		d.ScratchPath = update.ScratchPath
+	}
+	if update.RunID != nil {
+		d.RunID = update.RunID
+	}
+	if update.Command != nil {
+		d.Command = update.Command
+	}
+}
+
+// mergeDetection applies the detection settings of an update that are set.
+func mergeDetection(d *db.ChangeDetection, update *detectionUpdate) {
+	if update == nil {
+		return
+	}
+	if update.Disabled != nil {
+		d.Disabled = *update.Disabled
+	}
+	if update.MinFiles != nil {
+		d.MinFiles = *update.MinFiles
+	}
+	if update.MaxChangedPct != nil {
+		d.MaxChangedPct = *update.MaxChangedPct
+	}
+	if update.MaxEntropyPct != nil {
+		d.MaxEntropyPct = *update.MaxEntropyPct
+	}
+	if update.MaxRenamePct != nil {
+		d.MaxRenamePct = *update.MaxRenamePct
+	}
+}
+
 func deleteBackup(c *fiber.Ctx) error {
 	id := c.Params("id")
+	if backupID, err := strconv.Atoi(id); err == nil {
+		if err := backups.CheckBackupUnlocked(uint(backupID)); err != nil {
+			if errors.Is(err, backups.ErrRunLocked) {
+				return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		backupService.CancelBackup(uint(backupID))
+	}
 	if err := db.DB.Delete(&db.Backup{}, id).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	if backupID, err := strconv.Atoi(id); err == nil {
+		backups.RemoveStaging(uint(backupID))
+	}
 	return c.SendStatus(204)
 }
 
@@ -265,49 +750,304 @@ func executeBackup(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
 	}
 
-    // Check if backup is already running
-    if backup.Status == "running" {
-        // Check if there's an active progress record
-        var progress db.BackupProgress
-        if err := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "running").First(&progress).Error; err == nil {
-            // If the progress hasn't updated recently, treat it as stale and allow restart
-            if time.Since(progress.UpdatedAt) > 60*time.Second {
-                // Mark existing as failed and reset backup
-                progress.Status = "failed"
-                progress.Message = "Previous run considered stale; restarting"
-                progress.UpdatedAt = time.Now()
-                db.DB.Save(&progress)
-            } else {
-                return c.Status(409).JSON(fiber.Map{"error": "Backup is already running"})
-            }
-        }
-        // No active progress record or stale -> clean old progresses for this backup
-        db.DB.Where("backup_id = ?", backup.ID).Delete(&db.BackupProgress{})
-        backup.Status = "pending"
-        db.DB.Save(&backup)
-    }
+	executedBy := backup.ExecutedBy
+	if username, ok := c.Locals("username").(string); ok {
+		executedBy = username
+	}
+
+	job, err := backupService.Enqueue(backup, executedBy)
+	if err != nil {
+		if errors.Is(err, backups.ErrAlreadyRunning) {
+			return c.Status(409).JSON(fiber.Map{"error": "Backup is already queued or running"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to queue backup"})
+	}
+
+	return c.Status(202).JSON(fiber.Map{"message": "Backup queued", "job": job})
+}
+
+func listQueue(c *fiber.Ctx) error {
+	jobs, err := backupService.ListQueue()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get backup queue"})
+	}
+	return c.JSON(jobs)
+}
+
+func cancelQueuedJob(c *fiber.Ctx) error {
+	jobID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid job ID"})
+	}
+	if err := backupService.CancelJob(uint(jobID)); err != nil {
+		if errors.Is(err, backups.ErrNotQueued) {
+			return c.Status(409).JSON(fiber.Map{"error": "Job is not queued or running"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(204)
+}
+
+// updateRetention replaces the whole retention policy, so rules can also be
+// switched off by sending zero values.
+func updateRetention(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	var policy db.RetentionPolicy
+	if err := c.BodyParser(&policy); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateRetention(policy); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	backup.Retention = policy
+	if err := db.DB.Model(&backup).Select("Retention").Updates(&backup).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(backup.Retention)
+}
+
+func updateDetection(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	var detection db.ChangeDetection
+	if err := c.BodyParser(&detection); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDetection(detection); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	backup.Detection = detection
+	if err := db.DB.Model(&backup).Select("Detection").Updates(&backup).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(backup.Detection)
+}
+
+func previewRetention(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	plan, err := backupService.Prune(backup, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(plan)
+}
+
+func pruneBackup(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+	if backup.Status == "running" || backup.Status == "queued" {
+		return c.Status(409).JSON(fiber.Map{"error": "Backup is " + backup.Status})
+	}
 
-	// Update status to running and set start time
-	now := time.Now()
-	backup.Status = "running"
-	backup.StartedAt = &now
-	if err := db.DB.Save(&backup).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update backup status"})
-	}
-
-	// Execute backup using the service
-	go func() {
-		defer func() {
-			// Reset backup status if execution fails catastrophically
-			if r := recover(); r != nil {
-				backup.Status = "pending"
-				db.DB.Save(&backup)
+	plan, err := backupService.Prune(backup, c.QueryBool("dry_run"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(plan)
+}
+
+// collectGarbage removes the chunks no run uses any more from the
+// repositories of a repo backup.
+func collectGarbage(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+	if backup.FileType != "repo" {
+		return c.Status(400).JSON(fiber.Map{"error": "Garbage collection only applies to repo backups"})
+	}
+
+	results, err := backupService.CollectGarbage(backup, c.QueryBool("dry_run"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(results)
+}
+
+// diffBackupRuns compares the file indexes of two runs of a backup. Without
+// "to" the latest completed run is compared with the run before it.
+func diffBackupRuns(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	var ids [2]uint
+	for i, key := range []string{"from", "to"} {
+		if v := c.Query(key); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid " + key + " run ID"})
 			}
-		}()
-		backupService.ExecuteBackupAsync(backup)
-	}()
+			ids[i] = uint(n)
+		}
+	}
+
+	diff, err := backupService.DiffRuns(backup, ids[0], ids[1])
+	if err != nil {
+		if errors.Is(err, backups.ErrRunNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to compare runs"})
+	}
+	return c.JSON(diff)
+}
+
+func restoreBackup(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	var opts backups.RestoreOptions
+	if err := c.BodyParser(&opts); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	executedBy := ""
+	if username, ok := c.Locals("username").(string); ok {
+		executedBy = username
+	}
+
+	progress, err := backupService.StartRestore(backup, opts, executedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNoRun):
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrInvalidOption):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(202).JSON(fiber.Map{"message": "Restore started", "progress": progress})
+}
+
+func verifyBackup(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	// Without a run ID every stored run is verified
+	var body struct {
+		RunID uint `json:"run_id"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	executedBy := ""
+	if username, ok := c.Locals("username").(string); ok {
+		executedBy = username
+	}
+
+	progress, err := backupService.StartVerify(backup, body.RunID, executedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNoVerifiableRun):
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrBackupRunning):
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(202).JSON(fiber.Map{"message": "Verification started", "progress": progress})
+}
+
+func updateDrill(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	var drill db.RestoreDrill
+	if err := c.BodyParser(&drill); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backups.ValidateDrill(drill); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	backup.Drill = drill
+	if err := scheduler.Validate(backup); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := db.DB.Model(&backup).Select("Drill").Updates(&backup).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := backupScheduler.Reschedule(&backup); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(backup.Drill)
+}
+
+func runDrill(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var backup db.Backup
+	if err := db.DB.First(&backup, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+
+	executedBy := ""
+	if username, ok := c.Locals("username").(string); ok {
+		executedBy = username
+	}
+
+	result, err := backupService.StartDrill(backup, executedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNoRun):
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrDrillNotConfigured), errors.Is(err, backups.ErrInvalidOption):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrBackupRunning):
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 
-	return c.JSON(fiber.Map{"message": "Backup execution started"})
+	return c.Status(202).JSON(fiber.Map{"message": "Restore drill started", "drill": result})
+}
+
+func listDrills(c *fiber.Ctx) error {
+	backupID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid backup ID"})
+	}
+
+	var results []db.DrillResult
+	if err := db.DB.Where("backup_id = ?", backupID).Order("started_at DESC").Limit(50).Find(&results).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get restore drills"})
+	}
+	return c.JSON(results)
 }
 
 func getBackupProgress(c *fiber.Ctx) error {
@@ -325,6 +1065,133 @@ func getBackupProgress(c *fiber.Ctx) error {
 	return c.JSON(progress)
 }
 
+func listBackupRuns(c *fiber.Ctx) error {
+	backupID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid backup ID"})
+	}
+
+	runs, err := backupService.ListRuns(uint(backupID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get backup runs"})
+	}
+	if runs == nil {
+		runs = []db.BackupRun{}
+	}
+	return c.JSON(runs)
+}
+
+func getBackupRun(c *fiber.Ctx) error {
+	backupID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid backup ID"})
+	}
+	runID, err := strconv.Atoi(c.Params("runId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid run ID"})
+	}
+
+	run, err := backupService.GetRun(uint(backupID), uint(runID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Run not found"})
+	}
+	return c.JSON(run)
+}
+
+// dismissSuspiciousRun clears the suspicious flag of a run once it has been
+// checked, so retention may prune the runs before it again.
+func dismissSuspiciousRun(c *fiber.Ctx) error {
+	var backup db.Backup
+	if err := db.DB.First(&backup, c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+	runID, err := strconv.Atoi(c.Params("runId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid run ID"})
+	}
+
+	username := ""
+	if u, ok := c.Locals("username").(string); ok {
+		username = u
+	}
+	run, err := backupService.DismissSuspicious(backup, uint(runID), username)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNotSuspicious):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrRunNotFound):
+			return c.Status(404).JSON(fiber.Map{"error": "Run not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(run)
+}
+
+// lockRun puts a legal hold or a time lock on a run, keeping it from being
+// pruned or deleted.
+func lockRun(c *fiber.Ctx) error {
+	var backup db.Backup
+	if err := db.DB.First(&backup, c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+	runID, err := strconv.Atoi(c.Params("runId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid run ID"})
+	}
+	var lock backups.RunLock
+	if err := c.BodyParser(&lock); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	username := ""
+	if u, ok := c.Locals("username").(string); ok {
+		username = u
+	}
+	run, err := backupService.LockRun(backup, uint(runID), lock, username)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrInvalidLock):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrRunNotFound):
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrRunLocked):
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(run)
+}
+
+// unlockRun releases the legal hold of a run. Time locks run out on their own.
+func unlockRun(c *fiber.Ctx) error {
+	var backup db.Backup
+	if err := db.DB.First(&backup, c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Backup not found"})
+	}
+	runID, err := strconv.Atoi(c.Params("runId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid run ID"})
+	}
+
+	username := ""
+	if u, ok := c.Locals("username").(string); ok {
+		username = u
+	}
+	run, err := backupService.UnlockRun(backup, uint(runID), username)
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNotLocked):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrRunNotFound):
+			return c.Status(404).JSON(fiber.Map{"error": "Run not found"})
+		case errors.Is(err, backups.ErrRunLocked):
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(run)
+}
+
 func getRunningBackups(c *fiber.Ctx) error {
 	progresses, err := backupService.GetAllRunningBackups()
 	if err != nil {
@@ -355,6 +1222,8 @@ func getRunningBackups(c *fiber.Ctx) error {
 		responses = append(responses, BackupProgressResponse{
 			ID:             progress.ID,
 			BackupID:       progress.BackupID,
+			RunID:          progress.RunID,
+			Operation:      progress.Operation,
 			Backup:         backup,
 			Servers:        servers,
 			Status:         progress.Status,
@@ -373,9 +1242,45 @@ func getRunningBackups(c *fiber.Ctx) error {
 	return c.JSON(responses)
 }
 
+// checkProcessesUnlocked returns an ErrRunLocked error naming the lock when
+// one of the progress records belongs to a locked run; the records of locked
+// runs are kept with them.
+func checkProcessesUnlocked(progresses []db.BackupProgress) error {
+	var runIDs []uint
+	for _, p := range progresses {
+		if p.RunID != nil {
+			runIDs = append(runIDs, *p.RunID)
+		}
+	}
+	return backups.CheckRunsUnlocked(runIDs)
+}
+
 func deleteAllProcesses(c *fiber.Ctx) error {
-	// Delete all backup progress records that are running, failed, or completed
-	if err := db.DB.Where("status IN ?", []string{"running", "failed", "completed"}).Delete(&db.BackupProgress{}).Error; err != nil {
+	var progresses []db.BackupProgress
+	if err := db.DB.Where("status IN ?", []string{"running", "paused", "cancelled", "failed", "completed"}).Find(&progresses).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := checkProcessesUnlocked(progresses); err != nil {
+		if errors.Is(err, backups.ErrRunLocked) {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(progresses) == 0 {
+		return c.SendStatus(204)
+	}
+
+	// Stop live processes first so no worker keeps running without its row
+	var ids []uint
+	for _, p := range progresses {
+		if p.Status == "running" || p.Status == "paused" {
+			backupService.CancelProcess(p.ID)
+		}
+		ids = append(ids, p.ID)
+	}
+
+	// Delete all backup progress records
+	if err := db.DB.Delete(&db.BackupProgress{}, ids).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	return c.SendStatus(204)
@@ -383,9 +1288,48 @@ func deleteAllProcesses(c *fiber.Ctx) error {
 
 func deleteProcess(c *fiber.Ctx) error {
 	id := c.Params("id")
+
+	var progresses []db.BackupProgress
+	db.DB.Where("id = ?", id).Find(&progresses)
+	if err := checkProcessesUnlocked(progresses); err != nil {
+		if errors.Is(err, backups.ErrRunLocked) {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if progressID, err := strconv.Atoi(id); err == nil {
+		backupService.CancelProcess(uint(progressID))
+	}
 	if err := db.DB.Delete(&db.BackupProgress{}, id).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	return c.SendStatus(204)
 }
 
+// controlProcess applies a cancel, pause or resume action to a live process.
+func controlProcess(c *fiber.Ctx, action func(uint) error, message string) error {
+	progressID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid process ID"})
+	}
+	if err := action(uint(progressID)); err != nil {
+		if errors.Is(err, backups.ErrNotRunning) {
+			return c.Status(409).JSON(fiber.Map{"error": "Process is not running"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": message})
+}
+
+func cancelProcess(c *fiber.Ctx) error {
+	return controlProcess(c, backupService.CancelProcess, "Cancellation requested")
+}
+
+func pauseProcess(c *fiber.Ctx) error {
+	return controlProcess(c, backupService.PauseProcess, "Process paused")
+}
+
+func resumeProcess(c *fiber.Ctx) error {
+	return controlProcess(c, backupService.ResumeProcess, "Process resumed")
+}
+
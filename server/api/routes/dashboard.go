@@ -33,8 +33,8 @@ func getDashboardStats(c *fiber.Ctx) error {
         return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to count backups"})
     }
 
-    // Sum storage used
-    if err := db.DB.Model(&db.Backup{}).Select("COALESCE(SUM(size_bytes), 0)").Scan(&storageUsed).Error; err != nil {
+    // Sum storage used by the archives of all completed runs
+    if err := db.DB.Model(&db.BackupRun{}).Where("status = ?", "completed").Select("COALESCE(SUM(size_bytes), 0)").Scan(&storageUsed).Error; err != nil {
         return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to calculate storage"})
     }
 
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"snaptrack/auth"
+	"snaptrack/db"
+	"snaptrack/services/backups"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RegisterRunRoutes registers the routes browsing the files of a run. They
+// use the backup service, so they are registered after the backup routes.
+func RegisterRunRoutes(app *fiber.App) {
+	api := app.Group("/api/runs", auth.RequireJWT())
+	api.Get("/:id/files", listRunFiles)
+	api.Get("/:id/files/download", downloadRunFile)
+}
+
+// loadRun loads a run and its backup.
+func loadRun(id string) (db.BackupRun, db.Backup, error) {
+	var run db.BackupRun
+	var backup db.Backup
+	if err := db.DB.First(&run, id).Error; err != nil {
+		return run, backup, errors.New("Run not found")
+	}
+	if err := db.DB.First(&backup, run.BackupID).Error; err != nil {
+		return run, backup, errors.New("Backup not found")
+	}
+	return run, backup, nil
+}
+
+func listRunFiles(c *fiber.Ctx) error {
+	run, _, err := loadRun(c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	entries, err := backupService.ListRunFiles(run, c.Query("path"))
+	if err != nil {
+		if errors.Is(err, backups.ErrNoFile) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list run files"})
+	}
+	return c.JSON(entries)
+}
+
+func downloadRunFile(c *fiber.Ctx) error {
+	run, backup, err := loadRun(c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	if c.Query("path") == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "path is required"})
+	}
+
+	r, file, err := backupService.OpenRunFile(backup, run, c.Query("path"))
+	if err != nil {
+		switch {
+		case errors.Is(err, backups.ErrNoFile):
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		case errors.Is(err, backups.ErrKeyRequired):
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The stream is closed once the response has been sent
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", path.Base(file.Path)))
+	c.Set("X-Checksum-Sha256", file.SHA256)
+	return c.SendStream(r, int(file.Size))
+}
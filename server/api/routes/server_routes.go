@@ -6,6 +6,7 @@ import (
 	"os"
 	"snaptrack/auth"
 	"snaptrack/db"
+	"snaptrack/services/backups"
 	"strings"
 	"time"
 
@@ -23,16 +24,17 @@ func RegisterServerRoutes(app *fiber.App) {
 	api.Delete("/:id", deleteServer)
 	api.Post("/:id/test", testServerConnection)
 	api.Post("/:id/validate-path", validatePath)
+	api.Get("/:id/docker", listDocker)
 }
 
 // -------------------- Helper Functions --------------------
 
-func createSSHClient(host string, user, keyPath *string, port *int) (*ssh.Client, error) {
-	if user == nil || keyPath == nil || port == nil {
+func createSSHClient(server db.Server) (*ssh.Client, error) {
+	if server.SSHUser == nil || server.SSHKeyPath == nil || server.SSHPort == nil {
 		return nil, fmt.Errorf("SSH configuration incomplete")
 	}
 
-	key, err := os.ReadFile(*keyPath)
+	key, err := os.ReadFile(*server.SSHKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read SSH key: %v", err)
 	}
@@ -42,14 +44,18 @@ func createSSHClient(host string, user, keyPath *string, port *int) (*ssh.Client
 		return nil, fmt.Errorf("failed to parse SSH key: %v", err)
 	}
 
+	hostKey, err := backups.HostKeyCallback(server)
+	if err != nil {
+		return nil, err
+	}
 	config := &ssh.ClientConfig{
-		User:            *user,
+		User:            *server.SSHUser,
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKey,
 		Timeout:         10 * time.Second,
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, *port)
+	addr := fmt.Sprintf("%s:%d", server.Host, *server.SSHPort)
 	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		return nil, fmt.Errorf("SSH connection failed: %v", err)
@@ -58,7 +64,11 @@ func createSSHClient(host string, user, keyPath *string, port *int) (*ssh.Client
 	return client, nil
 }
 
-func validateRemoteServer(host string, sshUser, sshKeyPath *string, sshPort *int, transferType *string) error {
+// validateRemoteServer checks that a remote server can be logged into. A
+// server without a pinned host key gets the one it presents pinned, unless
+// known_hosts lists it.
+func validateRemoteServer(server *db.Server) error {
+	host := server.Host
 	// TCP reachability check
 	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "80"), 5*time.Second)
 	if err != nil {
@@ -71,19 +81,42 @@ func validateRemoteServer(host string, sshUser, sshKeyPath *string, sshPort *int
 		conn.Close()
 	}
 
-	client, err := createSSHClient(host, sshUser, sshKeyPath, sshPort)
+	if err := backups.PinHostKey(server); err != nil {
+		return err
+	}
+	client, err := createSSHClient(*server)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	if transferType != nil && *transferType != "rsync" && *transferType != "scp" {
-		return fmt.Errorf("unsupported transfer type: %s", *transferType)
+	if server.TransferType != nil && *server.TransferType != "rsync" && *server.TransferType != "scp" {
+		return fmt.Errorf("unsupported transfer type: %s", *server.TransferType)
 	}
 
 	return nil
 }
 
+// serverCredentials holds write-only credentials sent with a server.
+type serverCredentials struct {
+	SecretAccessKey *string `json:"secret_access_key"` // s3
+	Password        *string `json:"password"`          // webdav / ftp
+}
+
+// secret returns the credential sealed into servers of the given type.
+func (creds serverCredentials) secret(serverType string) *string {
+	if serverType == "s3" {
+		return creds.SecretAccessKey
+	}
+	return creds.Password
+}
+
+// isStorageServer reports whether servers of the given type only store
+// backups, reached through the credentials sealed into them.
+func isStorageServer(serverType string) bool {
+	return serverType == "s3" || serverType == "webdav" || serverType == "ftp"
+}
+
 // -------------------- Route Handlers --------------------
 
 func listServers(c *fiber.Ctx) error {
@@ -113,7 +146,19 @@ func createServer(c *fiber.Ctx) error {
 	}
 
 	if server.Type == "remote" {
-		if err := validateRemoteServer(server.Host, server.SSHUser, server.SSHKeyPath, server.SSHPort, server.TransferType); err != nil {
+		if err := validateRemoteServer(&server); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Server validation failed: %v", err)})
+		}
+	}
+	if isStorageServer(server.Type) {
+		var creds serverCredentials
+		if err := c.BodyParser(&creds); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := backups.ConfigureDestination(&server, creds.secret(server.Type)); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := backups.CheckDestination(server); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Server validation failed: %v", err)})
 		}
 	}
@@ -175,9 +220,54 @@ func updateServer(c *fiber.Ctx) error {
 	}
 
 	if finalType == "remote" {
-		if err := validateRemoteServer(finalHost, finalSSHUser, finalSSHKeyPath, finalSSHPort, finalTransferType); err != nil {
+		// A pinned host key belongs to the address it was read from
+		finalHostKey := server.HostKey
+		if updateData.HostKey != nil {
+			finalHostKey = updateData.HostKey
+		} else if finalHost != server.Host || (finalSSHPort != nil && (server.SSHPort == nil || *finalSSHPort != *server.SSHPort)) {
+			finalHostKey = nil
+		}
+		final := db.Server{Name: server.Name, Host: finalHost, SSHUser: finalSSHUser, SSHPort: finalSSHPort,
+			SSHKeyPath: finalSSHKeyPath, TransferType: finalTransferType, HostKey: finalHostKey}
+		if err := validateRemoteServer(&final); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Server validation failed: %v", err)})
 		}
+		if final.HostKey == nil {
+			unpinned := ""
+			final.HostKey = &unpinned
+		}
+		updateData.HostKey = final.HostKey
+	} else if isStorageServer(finalType) {
+		var creds serverCredentials
+		if err := c.BodyParser(&creds); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		merged := server
+		merged.Type = finalType
+		merged.Host = finalHost
+		if updateData.Bucket != nil {
+			merged.Bucket = updateData.Bucket
+		}
+		if updateData.Region != nil {
+			merged.Region = updateData.Region
+		}
+		if updateData.AccessKeyID != nil {
+			merged.AccessKeyID = updateData.AccessKeyID
+		}
+		if updateData.StorageClass != nil {
+			merged.StorageClass = updateData.StorageClass
+		}
+		if updateData.Username != nil {
+			merged.Username = updateData.Username
+		}
+		if err := backups.ConfigureDestination(&merged, creds.secret(finalType)); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := backups.CheckDestination(merged); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Server validation failed: %v", err)})
+		}
+		updateData.SealedSecretKey = merged.SealedSecretKey
+		updateData.SealedPassword = merged.SealedPassword
 	} else {
 		localType := "local"
 		finalTransferType = &localType
@@ -213,8 +303,17 @@ func testServerConnection(c *fiber.Ctx) error {
 	if server.Type == "local" {
 		return c.JSON(fiber.Map{"success": true, "message": "Local server connection is always available"})
 	}
+	if isStorageServer(server.Type) {
+		if err := backups.CheckDestination(server); err != nil {
+			return c.JSON(fiber.Map{"success": false, "message": err.Error()})
+		}
+		if server.Type == "s3" {
+			return c.JSON(fiber.Map{"success": true, "message": "Bucket is reachable"})
+		}
+		return c.JSON(fiber.Map{"success": true, "message": "Storage is reachable"})
+	}
 
-	client, err := createSSHClient(server.Host, server.SSHUser, server.SSHKeyPath, server.SSHPort)
+	client, err := createSSHClient(server)
 	if err != nil {
 		return c.JSON(fiber.Map{"success": false, "message": err.Error()})
 	}
@@ -223,6 +322,25 @@ func testServerConnection(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"success": true, "message": "SSH connection successful"})
 }
 
+// listDocker returns the containers and volumes of the docker engine on a
+// server, to pick a docker backup source from.
+func listDocker(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var server db.Server
+	if err := db.DB.First(&server, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Server not found"})
+	}
+	if server.Type != "local" && server.Type != "remote" {
+		return c.Status(400).JSON(fiber.Map{"error": "Docker sources need a local or remote server"})
+	}
+
+	inventory, err := backups.ListDocker(server)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(inventory)
+}
+
 func validatePath(c *fiber.Ctx) error {
     id := c.Params("id")
     var server db.Server
@@ -244,7 +362,22 @@ func validatePath(c *fiber.Ctx) error {
         return c.JSON(fiber.Map{"valid": true, "message": "Path exists"})
     }
 
-    client, err := createSSHClient(server.Host, server.SSHUser, server.SSHKeyPath, server.SSHPort)
+    // Destinations on S3 servers are key prefixes, created with the first archive
+    if server.Type == "s3" {
+        if err := backups.CheckDestination(server); err != nil {
+            return c.JSON(fiber.Map{"valid": false, "message": err.Error()})
+        }
+        return c.JSON(fiber.Map{"valid": true, "message": "Archives are stored under this prefix"})
+    }
+    // WebDAV and FTP directories are created with the first archive as well
+    if isStorageServer(server.Type) {
+        if err := backups.CheckDestination(server); err != nil {
+            return c.JSON(fiber.Map{"valid": false, "message": err.Error()})
+        }
+        return c.JSON(fiber.Map{"valid": true, "message": "Archives are stored in this directory"})
+    }
+
+    client, err := createSSHClient(server)
     if err != nil {
         return c.JSON(fiber.Map{"valid": false, "message": err.Error()})
     }
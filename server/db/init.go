@@ -1,7 +1,7 @@
 package db
 
 func Init() {
-	err := DB.AutoMigrate(&Server{}, &Backup{}, &Log{}, &BackupProgress{})
+	err := DB.AutoMigrate(&Server{}, &Backup{}, &Log{}, &BackupRun{}, &RunFile{}, &BackupJob{}, &BackupProgress{}, &DrillResult{}, &RepoPack{}, &RepoChunk{})
 	if err != nil {
 		panic("failed to migrate database schema: " + err.Error())
 	}
@@ -14,8 +14,17 @@ type Server struct {
 	SSHUser     *string        `json:"ssh_user"`
 	SSHPort     *int           `json:"ssh_port"`
 	SSHKeyPath  *string        `json:"ssh_key_path"`
-	Type        string         `gorm:"not null" json:"type"` // local / remote
+	Type        string         `gorm:"not null" json:"type"` // local / remote / s3 / webdav / ftp
 	TransferType *string `json:"transferType"`
+	HostKey      *string `json:"host_key"` // remote: pinned SSH host key in authorized_keys format; empty checks known_hosts
+	Bucket          *string `json:"bucket"`        // s3: bucket the archives are stored in; host is the endpoint
+	Region          *string `json:"region"`        // s3: defaults to the region the endpoint reports
+	AccessKeyID     *string `json:"access_key_id"` // s3
+	SealedSecretKey *string `json:"-"`             // s3: secret access key, sealed with the master key
+	StorageClass    *string `json:"storage_class"` // s3: e.g. STANDARD_IA, empty uses the bucket default
+	Username        *string `json:"username"`      // webdav / ftp
+	SealedPassword  *string `json:"-"`             // webdav / ftp: password, sealed with the master key
+	MaxConcurrent int        `gorm:"default:0" json:"max_concurrent"` // concurrent backup jobs, 0 uses the queue default
 	Enabled     bool           `gorm:"default:true" json:"enabled"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
@@ -23,25 +32,108 @@ type Server struct {
 }
 
 type Backup struct {
-	ID           uint           `gorm:"primaryKey" json:"id"`
-	Name         string         `gorm:"not null;uniqueIndex" json:"name"`
-	Source       string         `gorm:"not null" json:"source"`
-	Destination  string         `gorm:"not null" json:"destination"`
-	FileType     string         `gorm:"not null" json:"file_type"` // tar / zip / raw
-	Type         string         `gorm:"not null" json:"type"`      // full / incremental
-	ScheduleType string         `gorm:"not null;default:one_time" json:"schedule_type"`
-	Status       string         `gorm:"not null" json:"status"`    // scheduled / running / success / failed
-	ServerIDs    datatypes.JSON `gorm:"type:jsonb;not null" json:"server_ids"`
-	
-	SizeBytes    int64          `json:"size_bytes"`
-	Checksum     *string        `json:"checksum"`
-	StartedAt    *time.Time     `json:"started_at"`
-	CompletedAt  *time.Time     `json:"completed_at"`
-	DurationSec  int64          `json:"duration_sec"`
-	ExecutedBy   string         `gorm:"not null" json:"executed_by"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID               uint                        `gorm:"primaryKey" json:"id"`
+	Name             string                      `gorm:"not null;uniqueIndex" json:"name"`
+	Source           string                      `gorm:"not null" json:"source"`
+	SourceServerID   *uint                       `json:"source_server_id"`                         // remote server the source is read from; nil reads it on this host
+	SourceType       string                      `gorm:"not null;default:files" json:"source_type"` // files / postgres / mysql / sqlite / redis / docker
+	Database         DatabaseSource              `gorm:"embedded;embeddedPrefix:db_" json:"database"`
+	Docker           DockerSource                `gorm:"embedded;embeddedPrefix:docker_" json:"docker"`
+	Destination      string                      `gorm:"not null" json:"destination"`
+	FileType         string                      `gorm:"not null" json:"file_type"`                      // tar / zip / raw / repo
+	ArchiveName      *string                     `json:"archive_name"`                                   // naming template, e.g. {job}-{server}-{timestamp}
+	Type             string                      `gorm:"not null" json:"type"`                           // full / incremental
+	ScheduleType     string                      `gorm:"not null;default:one_time" json:"schedule_type"` // one_time / daily / weekly / monthly / cron
+	CronExpr         *string                     `json:"cron_expr"`                                      // used when schedule_type is cron
+	Timezone         *string                     `json:"timezone"`                                       // IANA name, defaults to server local time
+	NextRunAt        *time.Time                  `gorm:"index" json:"next_run_at"`
+	LastRunAt        *time.Time                  `json:"last_run_at"`
+	Retention        RetentionPolicy             `gorm:"embedded;embeddedPrefix:retention_" json:"retention"`
+	VerifySchedule   *string                     `json:"verify_schedule"`                          // cron expression or descriptor (@daily, @weekly); empty disables scheduled verification
+	NextVerifyAt     *time.Time                  `gorm:"index" json:"next_verify_at"`
+	Drill            RestoreDrill                `gorm:"embedded;embeddedPrefix:drill_" json:"drill"`
+	NextDrillAt      *time.Time                  `gorm:"index" json:"next_drill_at"`
+	Detection        ChangeDetection             `gorm:"embedded;embeddedPrefix:detect_" json:"detection"`
+	Includes         datatypes.JSONSlice[string] `json:"includes"`                                 // globs; when set only matching files are backed up
+	Excludes         datatypes.JSONSlice[string] `json:"excludes"`                                 // globs of files and directories to skip
+	MinFileSize      int64                       `gorm:"default:0" json:"min_file_size"`           // bytes, 0 disables
+	MaxFileSize      int64                       `gorm:"default:0" json:"max_file_size"`           // bytes, 0 disables
+	SkipRecentSec    int                         `gorm:"default:0" json:"skip_recent_sec"`         // skip files modified within the last N seconds
+	Compression      string                      `gorm:"not null;default:gzip" json:"compression"` // none / gzip / zstd / xz
+	CompressionLevel int                         `gorm:"default:0" json:"compression_level"`       // 0 uses the codec default
+	SkipRecompress   bool                        `gorm:"default:false" json:"skip_recompress"`     // store already-compressed files as-is (zip)
+	Encryption       string                      `gorm:"not null;default:none" json:"encryption"`  // none / age / passphrase
+	Recipients       *string                     `json:"recipients"`                               // age public keys, one per line
+	SealedKey        *string                     `json:"-"`                                        // passphrase or age identity, sealed with the master key
+	Priority         int                         `gorm:"default:0" json:"priority"`                // queued jobs with higher priority start first
+	MaxAttempts      int                         `json:"max_attempts"`                             // 0 or 1 disables retries
+	RetryBackoffSec  int                         `json:"retry_backoff_sec"`                        // delay before the first retry, doubled for each further one
+	RetryOn          datatypes.JSONSlice[string] `json:"retry_on"`                                 // retried error classes; empty retries connection and transfer errors
+	Status           string                      `gorm:"not null" json:"status"`                   // scheduled / queued / running / success / failed / cancelled
+	ServerIDs        datatypes.JSON              `gorm:"type:jsonb;not null" json:"server_ids"`
+
+	SizeBytes   int64          `json:"size_bytes"`
+	Checksum    *string        `json:"checksum"`
+	StartedAt   *time.Time     `json:"started_at"`
+	CompletedAt *time.Time     `json:"completed_at"`
+	DurationSec int64          `json:"duration_sec"`
+	ExecutedBy  string         `gorm:"not null" json:"executed_by"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// RetentionPolicy decides which completed runs of a backup are kept. Zero
+// values disable a rule; a policy with every rule disabled keeps all runs.
+type RetentionPolicy struct {
+	KeepLast    int `gorm:"default:0" json:"keep_last"`
+	KeepDaily   int `gorm:"default:0" json:"keep_daily"`
+	KeepWeekly  int `gorm:"default:0" json:"keep_weekly"`
+	KeepMonthly int `gorm:"default:0" json:"keep_monthly"`
+	KeepYearly  int `gorm:"default:0" json:"keep_yearly"`
+	MaxAgeDays  int `gorm:"default:0" json:"max_age_days"`
+}
+
+// RestoreDrill configures test restores of a backup: a run is restored into a
+// scratch directory, compared with its file index, checked by an optional
+// command and removed again.
+type RestoreDrill struct {
+	Schedule    *string `json:"schedule"`     // cron expression or descriptor; empty runs drills on demand only
+	ServerID    *uint   `json:"server_id"`    // local or remote server restored onto
+	ScratchPath *string `json:"scratch_path"` // each drill restores into a new directory below it
+	RunID       *uint   `json:"run_id"`       // run to restore; empty takes the latest completed run
+	Command     *string `json:"command"`      // run in the restored directory, must exit with status 0
+}
+
+// ChangeDetection configures the checks that flag a run as suspicious when
+// its source looks mass-modified or encrypted, e.g. by ransomware. The
+// percentages are of the files of the previous run; zero values use the
+// defaults.
+type ChangeDetection struct {
+	Disabled      bool `gorm:"default:false" json:"disabled"`
+	MinFiles      int  `gorm:"default:0" json:"min_files"`       // previous runs with fewer files are not checked; default 20
+	MaxChangedPct int  `gorm:"default:0" json:"max_changed_pct"` // files modified or removed; default 50
+	MaxEntropyPct int  `gorm:"default:0" json:"max_entropy_pct"` // files rewritten with random-looking content; default 20
+	MaxRenamePct  int  `gorm:"default:0" json:"max_rename_pct"`  // files renamed to an extension the source did not have; default 20
+}
+
+// DatabaseSource holds the connection of a database dump source. The dump
+// tool runs on the source server, or on this host when there is none. Source
+// names the database for postgres and mysql (empty dumps all of them) and
+// the database file for sqlite; redis dumps the whole instance.
+type DatabaseSource struct {
+	Host           *string `json:"host"` // empty connects through the default local socket
+	Port           *int    `json:"port"`
+	User           *string `json:"user"`
+	SealedPassword *string `json:"-"` // sealed with the master key
+}
+
+// DockerSource selects the volumes a docker source backs up. Source names the
+// container whose named volumes are read; it may be empty when volumes lists
+// the volumes to back up on their own.
+type DockerSource struct {
+	Volumes datatypes.JSONSlice[string] `json:"volumes"`                          // volumes to back up; empty takes every named volume of the container
+	Quiesce string                      `gorm:"not null;default:none" json:"quiesce"` // none / pause / stop: how the container is held while its volumes are read
 }
 
 type Log struct {
@@ -57,10 +149,138 @@ type Log struct {
 }
 
 
+// BackupRun is a single execution of a backup job against one target server.
+type BackupRun struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	BackupID    uint       `gorm:"not null;index" json:"backup_id"`
+	Backup      Backup     `gorm:"foreignKey:BackupID" json:"-"`
+	ServerID    uint       `gorm:"not null;index" json:"server_id"`
+	Type        string     `gorm:"not null;default:full" json:"type"`        // full / incremental
+	ParentRunID *uint      `json:"parent_run_id"`                            // previous run an incremental is based on
+	Attempt     int        `gorm:"not null;default:1" json:"attempt"`        // 1 for the first try of a job, counting up on retries
+	Compression string     `gorm:"not null;default:gzip" json:"compression"` // none / gzip / zstd / xz
+	Encryption  string     `gorm:"not null;default:none" json:"encryption"`  // none / age / passphrase
+	Status      string     `gorm:"not null" json:"status"`                   // running / completed / failed / pruned
+	ArchivePath *string    `json:"archive_path"`                             // archive file, or directory for raw backups
+	SizeBytes   int64      `json:"size_bytes"`
+	Checksum    *string    `json:"checksum"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	DurationSec int64      `json:"duration_sec"`
+	ExecutedBy  string     `gorm:"not null" json:"executed_by"`
+	Error       *string    `json:"error"`
+	ErrorClass  *string    `json:"error_class"` // failed runs: class of the error, see ClassifyError
+	PrunedAt    *time.Time `json:"pruned_at"`
+	VerifiedAt   *time.Time `json:"verified_at"`   // last integrity check of the stored data
+	VerifyStatus *string    `json:"verify_status"` // ok / corrupted / missing / failed
+	VerifyError  *string    `json:"verify_error"`
+	Manifest     datatypes.JSON `json:"manifest"` // what the source was made of, e.g. the inspected container and volumes of a docker source
+	Suspicious        bool                        `gorm:"default:false" json:"suspicious"` // flagged by change detection; keeps older runs from being pruned until dismissed
+	SuspiciousReasons datatypes.JSONSlice[string] `json:"suspicious_reasons"`
+	LegalHold   bool       `gorm:"default:false" json:"legal_hold"` // kept until the hold is released
+	LockedUntil *time.Time `json:"locked_until"`                    // kept until then; the date can only be moved later
+	LockReason  *string    `json:"lock_reason"`
+	LockedBy    *string    `json:"locked_by"`
+	LockedAt    *time.Time `json:"locked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// DrillResult is the outcome of one restore drill.
+type DrillResult struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	BackupID      uint           `gorm:"not null;index" json:"backup_id"`
+	Backup        Backup         `gorm:"foreignKey:BackupID" json:"-"`
+	RunID         uint           `gorm:"not null" json:"run_id"`
+	ServerID      uint           `gorm:"not null" json:"server_id"`
+	ProgressID    uint           `json:"progress_id"`
+	Status        string         `gorm:"not null" json:"status"` // running / passed / failed / cancelled
+	Path          string         `json:"path"`                   // scratch directory, removed after the drill
+	Files         int            `json:"files"`                  // files of the index compared with the restore
+	Missing       int            `json:"missing"`
+	Mismatched    int            `json:"mismatched"`
+	Extra         int            `json:"extra"`
+	Diff          datatypes.JSON `json:"diff"` // paths of missing, mismatched and extra files
+	CommandOutput *string        `json:"command_output"`
+	Error         *string        `json:"error"`
+	StartedAt     time.Time      `json:"started_at"`
+	FinishedAt    *time.Time     `json:"finished_at"`
+	DurationSec   int64          `json:"duration_sec"`
+	ExecutedBy    string         `gorm:"not null" json:"executed_by"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
+
+// RunFile is one entry in the file index of a run. The index of every run
+// lists the complete source tree; StoredRunID names the run whose archive
+// holds the file's content, so unchanged files of an incremental run point
+// back into earlier runs. Deleted entries are tombstones for files that
+// disappeared since the parent run.
+type RunFile struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	RunID       uint      `gorm:"not null;index" json:"run_id"`
+	Path        string    `gorm:"not null" json:"path"`
+	Size        int64     `json:"size"`
+	Mode        uint32    `json:"mode"`  // permission bits
+	ModTime     time.Time `json:"mtime"`
+	Owner       string    `json:"owner"` // user:group, numeric IDs where no name is known
+	SHA256      string    `json:"sha256"`
+	StoredRunID uint      `gorm:"not null;index" json:"stored_run_id"`
+	Deleted     bool      `gorm:"default:false" json:"deleted"`
+	Chunks      datatypes.JSONSlice[string] `json:"chunks,omitempty"` // repo backups: IDs of the chunks the content is made of, in order
+}
+
+// RepoPack is a pack file of a deduplicating repository, the directory a
+// repo backup stores its chunks in. Repositories are identified by the
+// server and the path of the directory.
+type RepoPack struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ServerID  uint      `gorm:"not null;index:idx_repo_pack_repo" json:"server_id"`
+	Repo      string    `gorm:"not null;index:idx_repo_pack_repo" json:"repo"`
+	Name      string    `gorm:"not null" json:"name"` // SHA-256 of the pack file
+	Key       string    `json:"key"`                  // repository key the blobs are encrypted with; empty when unencrypted
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RepoChunk locates a chunk in a pack. The hash is the SHA-256 of the chunk's
+// content; Offset and Length select its compressed and possibly encrypted
+// blob in the pack.
+type RepoChunk struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	PackID    uint   `gorm:"not null;index" json:"pack_id"`
+	Hash      string `gorm:"not null;index" json:"hash"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	RawLength int64  `json:"raw_length"` // size of the chunk's content
+}
+
+// BackupJob is one queued execution of a backup. Jobs are claimed by the
+// worker pool in priority order, oldest first, and outlive restarts.
+type BackupJob struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	BackupID   uint           `gorm:"not null;index" json:"backup_id"`
+	Backup     Backup         `gorm:"foreignKey:BackupID" json:"-"`
+	ServerIDs  datatypes.JSON `gorm:"type:jsonb" json:"server_ids"`             // servers the job counts against
+	Priority   int            `gorm:"not null;default:0;index" json:"priority"` // higher runs first
+	Status     string         `gorm:"not null;index" json:"status"`             // queued / running / completed / failed / cancelled
+	Attempt    int            `gorm:"not null;default:1" json:"attempt"`
+	NotBefore  *time.Time     `json:"not_before"` // a retry waits for its backoff to pass
+	ExecutedBy string         `gorm:"not null" json:"executed_by"`
+	Error      *string        `json:"error"`
+	ErrorClass *string        `json:"error_class"` // class of the last error, see ClassifyError
+	QueuedAt   time.Time      `gorm:"not null" json:"queued_at"`
+	StartedAt  *time.Time     `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
 type BackupProgress struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
 	BackupID    uint      `gorm:"not null;index" json:"backup_id"`
 	Backup      Backup    `gorm:"foreignKey:BackupID" json:"-"`
+	RunID       *uint     `gorm:"index" json:"run_id"`
+	Operation   string    `gorm:"not null;default:backup" json:"operation"` // backup / restore / verify / drill
 	Status      string    `gorm:"not null" json:"status"` // pending / running / completed / failed
 	Progress    int       `gorm:"default:0" json:"progress"` // 0-100
 	Message     string    `gorm:"not null" json:"message"`
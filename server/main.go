@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"snaptrack/api"
@@ -28,8 +29,14 @@ type Config struct {
 		Origins string `yaml:"origins"`
 	} `yaml:"cors"`
 	Security struct {
-		JWTSecret string `yaml:"jwt_secret"`
+		JWTSecret     string `yaml:"jwt_secret"`
+		MasterKeyFile string `yaml:"master_key_file"`
 	} `yaml:"security"`
+	Backups struct {
+		MaxConcurrent     int    `yaml:"max_concurrent"`
+		ServerConcurrency int    `yaml:"server_concurrency"`
+		StagingDir        string `yaml:"staging_dir"`
+	} `yaml:"backups"`
 	Database struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
@@ -51,6 +58,9 @@ func LoadConfig() *Config {
 		if err := yaml.Unmarshal(data, config); err != nil {
 			log.Fatalf("Failed to parse config.yaml: %v", err)
 		}
+		if config.Security.MasterKeyFile == "" {
+			config.Security.MasterKeyFile = "/etc/snaptrack/master.key"
+		}
 		log.Println("Loaded config from /etc/snaptrack/config.yaml")
 		return config
 	}
@@ -88,6 +98,15 @@ func LoadConfig() *Config {
 		config.Security.JWTSecret = "snaptrack"
 	}
 
+	config.Security.MasterKeyFile = os.Getenv("MASTER_KEY_FILE")
+	if config.Security.MasterKeyFile == "" {
+		config.Security.MasterKeyFile = "master.key"
+	}
+
+	config.Backups.MaxConcurrent, _ = strconv.Atoi(os.Getenv("BACKUP_MAX_CONCURRENT"))
+	config.Backups.ServerConcurrency, _ = strconv.Atoi(os.Getenv("BACKUP_SERVER_CONCURRENCY"))
+	config.Backups.StagingDir = os.Getenv("BACKUP_STAGING_DIR")
+
 	config.Database.Host = os.Getenv("PG_HOST")
 	if config.Database.Host == "" {
 		config.Database.Host = "localhost"
@@ -120,6 +139,21 @@ func main() {
 	os.Setenv("PG_PASSWORD", config.Database.Password)
 	os.Setenv("PG_DBNAME", config.Database.DBName)
 
+	// Key used to seal secrets stored in the database
+	os.Setenv("MASTER_KEY_FILE", config.Security.MasterKeyFile)
+
+	// Worker pool limits; zero keeps the defaults
+	if config.Backups.MaxConcurrent > 0 {
+		os.Setenv("BACKUP_MAX_CONCURRENT", strconv.Itoa(config.Backups.MaxConcurrent))
+	}
+	if config.Backups.ServerConcurrency > 0 {
+		os.Setenv("BACKUP_SERVER_CONCURRENCY", strconv.Itoa(config.Backups.ServerConcurrency))
+	}
+	// Where sources pulled from remote servers are mirrored
+	if config.Backups.StagingDir != "" {
+		os.Setenv("BACKUP_STAGING_DIR", config.Backups.StagingDir)
+	}
+
 	// Connect to DB
 	db.Connect()
 
@@ -0,0 +1,336 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"snaptrack/db"
+	"time"
+)
+
+// countingReader wraps an io.Reader and calls onRead callback on every read
+type countingReader struct {
+	r      io.Reader
+	onRead func(int64)
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.onRead(int64(n))
+	}
+	return n, err
+}
+
+// progressTracker accumulates processed bytes and persists/broadcasts the
+// progress at most once per MiB or second.
+type progressTracker struct {
+	bs         *BackupService
+	progress   *db.BackupProgress
+	job        *jobControl
+	start      time.Time
+	lastUpdate time.Time
+	delta      int64
+}
+
+func (bs *BackupService) newProgressTracker(progress *db.BackupProgress) *progressTracker {
+	now := time.Now()
+	return &progressTracker{bs: bs, progress: progress, job: bs.jobFor(progress), start: now, lastUpdate: now}
+}
+
+// reader counts what is read from r and holds the copy while the job is
+// paused or stops it once the job is cancelled.
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	return countingReader{r: jobReader{r: r, job: t.job}, onRead: t.add}
+}
+
+func (t *progressTracker) add(n int64) {
+	progress := t.progress
+	progress.BytesProcessed += n
+	t.delta += n
+	now := time.Now()
+	if t.delta >= 1<<20 || now.Sub(t.lastUpdate) >= time.Second {
+		elapsed := now.Sub(t.start).Seconds()
+		var speed int64
+		if elapsed > 0 {
+			speed = int64(float64(progress.BytesProcessed) / elapsed)
+		}
+		var eta int64
+		if speed > 0 && progress.TotalBytes != nil {
+			eta = (*progress.TotalBytes - progress.BytesProcessed) / speed
+		}
+		progress.SpeedBPS = &speed
+		progress.ETASeconds = &eta
+		if progress.TotalBytes != nil && *progress.TotalBytes > 0 {
+			progress.Progress = int(progress.BytesProcessed * 100 / *progress.TotalBytes)
+		}
+		progress.UpdatedAt = now
+		t.bs.saveProgress(progress)
+		t.bs.BroadcastProgress(progress)
+		t.lastUpdate = now
+		t.delta = 0
+	}
+}
+
+// archiveHash hashes and counts an archive while it is streamed to its
+// destination.
+type archiveHash struct {
+	w    io.Writer
+	sha  hash.Hash
+	size int64
+}
+
+func newArchiveHash(w io.Writer) *archiveHash {
+	return &archiveHash{w: w, sha: sha256.New()}
+}
+
+func (h *archiveHash) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.sha.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *archiveHash) checksum() string {
+	return hex.EncodeToString(h.sha.Sum(nil))
+}
+
+// runBackup writes a run of the backup to the destination of a server and
+// returns the size and checksum of what was stored. Archives are streamed to
+// the destination and verified once committed; raw backups are mirrored and
+// repo backups add the chunks they lack to their repository.
+func (bs *BackupService) runBackup(backup db.Backup, server db.Server, dest Destination, run *db.BackupRun, progress *db.BackupProgress) (int64, string, error) {
+	if isDumpSource(backup) {
+		return bs.runDump(backup, server, dest, run, progress)
+	}
+
+	// Step 1: Calculate total bytes
+	progress.Message = "Scanning files..."
+	bs.BroadcastProgress(progress)
+
+	filter, err := newFileFilter(backup)
+	if err != nil {
+		bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Invalid file filter: %v", err))
+		return 0, "", err
+	}
+	filter.job = bs.jobFor(progress)
+	totalBytes, err := filter.totalSize(backup.Source)
+	if err != nil {
+		bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Failed to calculate total bytes: %v", err))
+		return 0, "", err
+	}
+	progress.TotalBytes = &totalBytes
+	progress.Progress = 0
+	progress.BytesProcessed = 0
+	bs.BroadcastProgress(progress)
+
+	ix := bs.newFileIndex(run)
+
+	// Step 2: Write the run
+	var size int64
+	var checksum string
+	switch backup.FileType {
+	case "tar", "zip":
+		size, checksum, err = bs.writeArchive(backup, server, dest, *run.ArchivePath, filter, ix, progress)
+	case "raw":
+		mirror, ok := dest.(mirrorDestination)
+		if !ok {
+			return 0, "", fmt.Errorf("raw backups cannot be stored on %s server %s", server.Type, server.Name)
+		}
+		bs.updateProgress(progress, 0, "running", fmt.Sprintf("Transferring to %s...", server.Name))
+		if err = mirror.Mirror(backup.Source, *run.ArchivePath, filter, ix); err == nil {
+			size = totalBytes
+			checksum = treeChecksum(ix.entries)
+		}
+	case "repo":
+		// Held until the index is saved: garbage collection keeps the chunks
+		// of the runs it finds indexed
+		lock := repoLock(server.ID, repoRoot(backup, server))
+		lock.RLock()
+		defer lock.RUnlock()
+		size, checksum, err = bs.writeRepo(backup, server, dest, run, filter, ix, progress)
+	default:
+		return 0, "", fmt.Errorf("unsupported file type: %s", backup.FileType)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := ix.save(); err != nil {
+		return 0, "", fmt.Errorf("failed to save file index: %v", err)
+	}
+	bs.detectChanges(backup, run, ix, size)
+
+	progress.Progress = 100
+	progress.Message = "Backup completed successfully"
+	bs.BroadcastProgress(progress)
+	return size, checksum, nil
+}
+
+// writeArchive streams the tar or zip archive of a backup to name on the
+// destination and verifies the stored copy. Database and docker sources have
+// no filter.
+func (bs *BackupService) writeArchive(backup db.Backup, server db.Server, dest Destination, name string, filter *fileFilter, ix *fileIndex, progress *db.BackupProgress) (int64, string, error) {
+	format, err := archiveFormatFor(backup)
+	if err != nil {
+		return 0, "", err
+	}
+	w, err := dest.Create(name)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create %s on %s: %w", name, server.Name, err)
+	}
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Writing archive to %s...", server.Name))
+	archive := newArchiveHash(w)
+	switch {
+	case backup.SourceType == SourceDocker:
+		err = bs.writeDockerArchive(archive, backup, format, ix, progress)
+	case isDatabaseSource(backup):
+		err = bs.writeDumpArchive(archive, backup, format, ix, progress)
+	case backup.FileType == "tar":
+		err = bs.writeTarArchive(archive, backup.Source, format, filter, ix, progress)
+	default:
+		err = bs.writeZipArchive(archive, backup.Source, format, filter, ix, progress)
+	}
+	if err != nil {
+		w.Abort()
+		return 0, "", err
+	}
+	if err := w.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	bs.updateProgress(progress, 100, "running", fmt.Sprintf("Verifying archive on %s...", server.Name))
+	if err := verifyObject(dest, name, archive.size, archive.checksum()); err != nil {
+		return 0, "", err
+	}
+	return archive.size, archive.checksum(), nil
+}
+
+// ------------------- TAR BACKUP -------------------
+// writeTarArchive writes the source as a tar archive to w. The stream is
+// written w -> age (when encrypted) -> compressor -> tar.
+func (bs *BackupService) writeTarArchive(w io.Writer, source string, format archiveFormat, filter *fileFilter, ix *fileIndex, progress *db.BackupProgress) error {
+	enc, err := encryptWriter(w, format.recipients)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %v", err)
+	}
+	defer enc.Close()
+
+	cw, err := compressWriter(enc, format.compression, format.level)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+
+	tw := tar.NewWriter(cw)
+	defer tw.Close()
+
+	tracker := bs.newProgressTracker(progress)
+
+	err = filter.walk(source, func(path, rel string, info os.FileInfo) error {
+		if info.Mode().IsRegular() && ix.unchanged(rel, info) {
+			tracker.add(info.Size())
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			progress.CurrentFile = &rel
+			bs.BroadcastProgress(progress)
+			sum, err := copyFile(path, tw, tracker)
+			if err != nil {
+				return err
+			}
+			ix.add(rel, info, sum)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flush the archive before it is measured and hashed
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// ------------------- ZIP BACKUP -------------------
+// writeZipArchive writes the source as a zip archive to w, encrypted as a
+// whole when the backup is encrypted.
+func (bs *BackupService) writeZipArchive(w io.Writer, source string, format archiveFormat, filter *fileFilter, ix *fileIndex, progress *db.BackupProgress) error {
+	enc, err := encryptWriter(w, format.recipients)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %v", err)
+	}
+	defer enc.Close()
+
+	zw := zip.NewWriter(enc)
+	defer zw.Close()
+	registerZipCompressors(zw, format)
+
+	tracker := bs.newProgressTracker(progress)
+
+	err = filter.walk(source, func(path, rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ix.unchanged(rel, info) {
+			tracker.add(info.Size())
+			return nil
+		}
+
+		header := &zip.FileHeader{
+			Name:     filepath.ToSlash(rel),
+			Method:   zipEntryMethod(rel, format),
+			Modified: info.ModTime(),
+		}
+		header.SetMode(info.Mode())
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		progress.CurrentFile = &rel
+		bs.BroadcastProgress(progress)
+
+		sum, err := copyFile(path, writer, tracker)
+		if err != nil {
+			return err
+		}
+		ix.add(rel, info, sum)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -8,6 +8,8 @@ import (
 type BackupProgressResponse struct {
     ID             uint        `json:"id"`
     BackupID       uint        `json:"backup_id"`
+    RunID          *uint       `json:"run_id"`
+    Operation      string      `json:"operation"`
     Backup         db.Backup   `json:"backup"`
     Servers        []db.Server `json:"servers"`
     Status         string      `json:"status"`
@@ -33,6 +35,6 @@ func (bs *BackupService) GetBackupProgress(backupID uint) (*db.BackupProgress, e
 
 func (bs *BackupService) GetAllRunningBackups() ([]db.BackupProgress, error) {
     var progresses []db.BackupProgress
-    err := db.DB.Where("status IN ?", []string{"running", "failed", "completed"}).Preload("Backup").Find(&progresses).Error
+    err := db.DB.Where("status IN ?", []string{"running", "paused", "cancelled", "failed", "completed"}).Preload("Backup").Find(&progresses).Error
     return progresses, err
 }
@@ -0,0 +1,92 @@
+package backups
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Chunk sizes of repo backups. Boundaries are found with a gear hash over the
+// content (FastCDC), so an insertion only changes the chunks around it. The
+// sizes and the gear table are part of the repository format: changing them
+// changes every boundary and with it every chunk ID.
+const (
+	chunkMin = 512 << 10
+	chunkAvg = 1 << 20
+	chunkMax = 8 << 20
+
+	// Normalized chunking: a stricter mask below the average size and a
+	// looser one above it keep chunk sizes close to the average. The masks
+	// use the high bits of the hash, which depend on the last 64 bytes.
+	chunkMaskSmall uint64 = 0xFFFFFC0000000000 // 22 bits
+	chunkMaskLarge uint64 = 0xFFFFC00000000000 // 18 bits
+)
+
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r    io.Reader
+	buf  []byte
+	n    int // bytes buffered
+	last int // length of the chunk returned last, dropped on the next call
+	eof  bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, chunkMax)}
+}
+
+// next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	if c.last > 0 {
+		c.n = copy(c.buf, c.buf[c.last:c.n])
+		c.last = 0
+	}
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	c.last = cutPoint(c.buf[:c.n])
+	return c.buf[:c.last], nil
+}
+
+// cutPoint returns the length of the chunk at the start of data, which holds
+// either chunkMax bytes or the rest of the stream.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= chunkMin {
+		return n
+	}
+	normal := min(n, chunkAvg)
+	var h uint64
+	i := chunkMin
+	for ; i < normal; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
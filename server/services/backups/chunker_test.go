@@ -0,0 +1,120 @@
+package backups
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// randomData returns n pseudo-random bytes, the same for a seed.
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll splits data and returns copies of the chunks.
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestCutPoint(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"short", make([]byte, 100), 100},
+		{"min", make([]byte, chunkMin), chunkMin},
+		// Zeros never match a mask, so the cut falls at the end.
+		{"zeros", make([]byte, chunkMax), chunkMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutPoint(tt.data); got != tt.want {
+				t.Errorf("cutPoint = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunker(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"below min", randomData(1, chunkMin-1)},
+		{"one max", make([]byte, chunkMax)},
+		{"zeros", make([]byte, 2*chunkMax+10)},
+		{"random", randomData(2, 24<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkAll(t, tt.data)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatalf("chunks do not reassemble the input")
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > chunkMax {
+					t.Errorf("chunk %d has %d bytes, above the maximum", i, len(chunk))
+				}
+				if i < len(chunks)-1 && len(chunk) <= chunkMin {
+					t.Errorf("chunk %d has %d bytes, below the minimum", i, len(chunk))
+				}
+			}
+			if len(tt.data) <= chunkMin && len(chunks) > 1 {
+				t.Errorf("got %d chunks for %d bytes, want 1", len(chunks), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	data := randomData(3, 16<<20)
+	a, b := chunkAll(t, data), chunkAll(t, data)
+	if len(a) != len(b) {
+		t.Fatalf("got %d and %d chunks", len(a), len(b))
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Fatalf("chunk %d differs", i)
+		}
+	}
+}
+
+// An insertion only changes the chunks around it.
+func TestChunkerResync(t *testing.T) {
+	data := randomData(4, 32<<20)
+	edited := append(append(append([]byte(nil), data[:10<<20]...), []byte("inserted")...), data[10<<20:]...)
+
+	seen := make(map[string]bool)
+	before := chunkAll(t, data)
+	for _, chunk := range before {
+		seen[string(chunk)] = true
+	}
+	after := chunkAll(t, edited)
+	changed := 0
+	for _, chunk := range after {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after an insertion, want at most 2", changed, len(after))
+	}
+}
@@ -0,0 +1,241 @@
+package backups
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"snaptrack/db"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Zip method IDs assigned by APPNOTE.TXT for codecs the standard library does
+// not register itself.
+const (
+	zipMethodZstd uint16 = 93
+	zipMethodXz   uint16 = 95
+)
+
+// alreadyCompressed lists extensions of files that gain nothing from another
+// compression pass.
+var alreadyCompressed = map[string]bool{
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true,
+	".zip": true, ".7z": true, ".rar": true, ".age": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true,
+}
+
+// archiveFormat describes how the archive of a run is encoded.
+type archiveFormat struct {
+	compression    string // none / gzip / zstd / xz
+	level          int    // 0 selects the codec default
+	skipRecompress bool   // store already-compressed files as-is (zip only)
+	recipients     []age.Recipient
+}
+
+// archiveFormatFor returns the encoding configured for a backup.
+func archiveFormatFor(backup db.Backup) (archiveFormat, error) {
+	recipients, err := encryptionRecipients(backup)
+	if err != nil {
+		return archiveFormat{}, fmt.Errorf("failed to load encryption key: %v", err)
+	}
+	return archiveFormat{
+		compression:    compressionOf(backup),
+		level:          backup.CompressionLevel,
+		skipRecompress: backup.SkipRecompress,
+		recipients:     recipients,
+	}, nil
+}
+
+// compressionOf returns the codec of a backup; backups created before codecs
+// were selectable use gzip.
+func compressionOf(backup db.Backup) string {
+	if backup.Compression == "" {
+		return "gzip"
+	}
+	return backup.Compression
+}
+
+// ValidateCompression checks the codec and level of a backup.
+func ValidateCompression(backup db.Backup) error {
+	level := backup.CompressionLevel
+	switch compressionOf(backup) {
+	case "none", "xz":
+		if level != 0 {
+			return fmt.Errorf("compression %s does not support levels", backup.Compression)
+		}
+	case "gzip":
+		if level < 0 || level > 9 {
+			return fmt.Errorf("gzip level must be between 1 and 9")
+		}
+	case "zstd":
+		if level < 0 || level > 22 {
+			return fmt.Errorf("zstd level must be between 1 and 22")
+		}
+	default:
+		return fmt.Errorf("unsupported compression: %s", backup.Compression)
+	}
+	return nil
+}
+
+// tarExt returns the extension of a tar stream compressed with the codec.
+func tarExt(codec string) string {
+	switch codec {
+	case "none":
+		return ".tar"
+	case "zstd":
+		return ".tar.zst"
+	case "xz":
+		return ".tar.xz"
+	}
+	return ".tar.gz"
+}
+
+// compressWriter wraps w with the codec's compressor.
+func compressWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "", "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case "xz":
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", codec)
+}
+
+// decompressReader decodes a stream written by compressWriter.
+func decompressReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "none":
+		return io.NopCloser(r), nil
+	case "", "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", codec)
+}
+
+// zipMethod returns the zip method that stores an entry with the codec.
+func zipMethod(codec string) uint16 {
+	switch codec {
+	case "none":
+		return zip.Store
+	case "zstd":
+		return zipMethodZstd
+	case "xz":
+		return zipMethodXz
+	}
+	return zip.Deflate
+}
+
+// zipEntryMethod picks the method for a single file, storing already
+// compressed files when the format asks for it.
+func zipEntryMethod(rel string, format archiveFormat) uint16 {
+	if format.skipRecompress && alreadyCompressed[strings.ToLower(filepath.Ext(rel))] {
+		return zip.Store
+	}
+	return zipMethod(format.compression)
+}
+
+// registerZipCompressors makes the zip writer use the configured level and
+// the zstd and xz methods.
+func registerZipCompressors(zw *zip.Writer, format archiveFormat) {
+	level := format.level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+	zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+		return compressWriter(w, "zstd", format.level)
+	})
+	zw.RegisterCompressor(zipMethodXz, func(w io.Writer) (io.WriteCloser, error) {
+		return &lazyWriteCloser{w: w, codec: "xz"}, nil
+	})
+}
+
+// lazyWriteCloser creates its compressor on first use. The zip writer builds
+// compressors before it writes the local file header, and the xz writer
+// emits its stream header as soon as it is constructed.
+type lazyWriteCloser struct {
+	w     io.Writer
+	codec string
+	wc    io.WriteCloser
+}
+
+func (l *lazyWriteCloser) open() error {
+	if l.wc != nil {
+		return nil
+	}
+	wc, err := compressWriter(l.w, l.codec, 0)
+	if err != nil {
+		return err
+	}
+	l.wc = wc
+	return nil
+}
+
+func (l *lazyWriteCloser) Write(p []byte) (int, error) {
+	if err := l.open(); err != nil {
+		return 0, err
+	}
+	return l.wc.Write(p)
+}
+
+func (l *lazyWriteCloser) Close() error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.wc.Close()
+}
+
+type errReadCloser struct{ err error }
+
+func (e errReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errReadCloser) Close() error             { return nil }
+
+// registerZipDecompressors lets the zip reader open zstd and xz entries.
+func registerZipDecompressors(zr *zip.Reader) {
+	for _, m := range []struct {
+		method uint16
+		codec  string
+	}{{zipMethodZstd, "zstd"}, {zipMethodXz, "xz"}} {
+		codec := m.codec
+		zr.RegisterDecompressor(m.method, func(r io.Reader) io.ReadCloser {
+			rc, err := decompressReader(r, codec)
+			if err != nil {
+				return errReadCloser{err}
+			}
+			return rc
+		})
+	}
+}
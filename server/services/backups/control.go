@@ -0,0 +1,304 @@
+package backups
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"snaptrack/db"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrNotRunning is returned when a process has no live backup or restore.
+	ErrNotRunning = errors.New("process is not running")
+	// ErrCancelled is the error of a run that was cancelled by a user.
+	ErrCancelled = errors.New("cancelled by user")
+)
+
+// jobControl lets a running backup or restore be cancelled, paused and
+// resumed. Walk loops and copies check it between entries and chunks; child
+// processes are stopped with SIGSTOP while the job is paused.
+type jobControl struct {
+	bs       *BackupService
+	backupID uint
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	progress *db.BackupProgress
+	paused   bool
+	resumed  chan struct{} // closed when a pause ends
+	procs    map[*os.Process]bool
+}
+
+// startJob registers a controllable job under the ID of its progress row.
+func (bs *BackupService) startJob(progress *db.BackupProgress) *jobControl {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &jobControl{
+		bs:       bs,
+		backupID: progress.BackupID,
+		ctx:      ctx,
+		cancel:   cancel,
+		progress: progress,
+		procs:    make(map[*os.Process]bool),
+	}
+	bs.jobsMu.Lock()
+	bs.jobs[progress.ID] = j
+	bs.jobsMu.Unlock()
+	return j
+}
+
+// attach moves the job to a new progress row, used when a backup continues
+// with its next server.
+func (j *jobControl) attach(progress *db.BackupProgress) {
+	j.bs.jobsMu.Lock()
+	j.mu.Lock()
+	delete(j.bs.jobs, j.progress.ID)
+	j.progress = progress
+	j.bs.jobs[progress.ID] = j
+	j.mu.Unlock()
+	j.bs.jobsMu.Unlock()
+}
+
+// endJob unregisters the job and releases its context.
+func (bs *BackupService) endJob(j *jobControl) {
+	bs.jobsMu.Lock()
+	j.mu.Lock()
+	delete(bs.jobs, j.progress.ID)
+	j.mu.Unlock()
+	bs.jobsMu.Unlock()
+	j.cancel()
+}
+
+// jobFor returns the job reporting to the progress row, or nil.
+func (bs *BackupService) jobFor(progress *db.BackupProgress) *jobControl {
+	bs.jobsMu.Lock()
+	defer bs.jobsMu.Unlock()
+	return bs.jobs[progress.ID]
+}
+
+// backupActive reports whether a job of the backup is running in this process.
+func (bs *BackupService) backupActive(backupID uint) bool {
+	bs.jobsMu.Lock()
+	defer bs.jobsMu.Unlock()
+	for _, j := range bs.jobs {
+		if j.backupID == backupID {
+			return true
+		}
+	}
+	return false
+}
+
+func (bs *BackupService) lookupJob(progressID uint) (*jobControl, error) {
+	bs.jobsMu.Lock()
+	defer bs.jobsMu.Unlock()
+	j, ok := bs.jobs[progressID]
+	if !ok {
+		return nil, ErrNotRunning
+	}
+	return j, nil
+}
+
+// cancelled reports whether the job was cancelled.
+func (j *jobControl) cancelled() bool {
+	return j != nil && j.ctx.Err() != nil
+}
+
+// context returns the context of the job; a nil job never ends.
+func (j *jobControl) context() context.Context {
+	if j == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// wait blocks while the job is paused and returns ErrCancelled once it has
+// been cancelled. A nil job never waits.
+func (j *jobControl) wait() error {
+	if j == nil {
+		return nil
+	}
+	for {
+		j.mu.Lock()
+		paused, resumed := j.paused, j.resumed
+		j.mu.Unlock()
+		if j.ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if !paused {
+			return nil
+		}
+		select {
+		case <-j.ctx.Done():
+		case <-resumed:
+		}
+	}
+}
+
+// command prepares a child process that is stopped together with the job.
+// The process runs in its own group so that the ssh it spawns is signalled
+// as well; on cancellation the group gets SIGTERM, then SIGKILL.
+func (j *jobControl) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(j.context(), name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// start waits for the job to be resumed, starts cmd and tracks it so that it
+// follows pauses. The returned function must be called after cmd.Wait.
+func (j *jobControl) start(cmd *exec.Cmd) (func(), error) {
+	if err := j.wait(); err != nil {
+		return func() {}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return func() {}, err
+	}
+	if j == nil {
+		return func() {}, nil
+	}
+	j.mu.Lock()
+	j.procs[cmd.Process] = true
+	if j.paused {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGSTOP)
+	}
+	j.mu.Unlock()
+	return func() {
+		j.mu.Lock()
+		delete(j.procs, cmd.Process)
+		j.mu.Unlock()
+	}, nil
+}
+
+// signal sends sig to the process groups of the job. Callers hold j.mu.
+func (j *jobControl) signal(sig syscall.Signal) {
+	for p := range j.procs {
+		syscall.Kill(-p.Pid, sig)
+	}
+}
+
+// CancelProcess stops the backup or restore reporting to the progress row.
+// The worker marks the progress and run as cancelled once it has stopped.
+func (bs *BackupService) CancelProcess(progressID uint) error {
+	j, err := bs.lookupJob(progressID)
+	if err != nil {
+		return err
+	}
+	j.cancel()
+	j.mu.Lock()
+	if j.paused {
+		// Stopped processes only act on SIGTERM once they are continued
+		j.signal(syscall.SIGCONT)
+	}
+	j.mu.Unlock()
+	return nil
+}
+
+// PauseProcess suspends the backup or restore reporting to the progress row.
+func (bs *BackupService) PauseProcess(progressID uint) error {
+	j, err := bs.lookupJob(progressID)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.paused || j.ctx.Err() != nil {
+		return nil
+	}
+	j.paused = true
+	j.resumed = make(chan struct{})
+	j.signal(syscall.SIGSTOP)
+	bs.setProgressStatus(progressID, "paused", "Paused")
+	return nil
+}
+
+// ResumeProcess continues a paused backup or restore.
+func (bs *BackupService) ResumeProcess(progressID uint) error {
+	j, err := bs.lookupJob(progressID)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.paused {
+		return nil
+	}
+	j.paused = false
+	close(j.resumed)
+	j.signal(syscall.SIGCONT)
+	bs.setProgressStatus(progressID, "running", "Resumed")
+	return nil
+}
+
+// setProgressStatus records a pause or resume on the progress row. The
+// worker owns the in-memory progress, so the row is updated and broadcast
+// from the database; saveProgress keeps the worker from overwriting it.
+// Callers hold j.mu.
+func (bs *BackupService) setProgressStatus(progressID uint, status, message string) {
+	db.DB.Model(&db.BackupProgress{}).Where("id = ?", progressID).UpdateColumns(map[string]any{
+		"status":     status,
+		"message":    message,
+		"updated_at": time.Now(),
+	})
+	var progress db.BackupProgress
+	if err := db.DB.First(&progress, progressID).Error; err == nil {
+		bs.BroadcastProgress(&progress)
+	}
+}
+
+// saveProgress persists a progress row of a worker. While its job is paused
+// the row keeps reporting so, whatever the worker is at.
+func (bs *BackupService) saveProgress(progress *db.BackupProgress) {
+	j := bs.jobFor(progress)
+	if j == nil {
+		db.DB.Save(progress)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.paused && progress.Status == "running" {
+		progress.Status = "paused"
+	} else if !j.paused && progress.Status == "paused" {
+		progress.Status = "running"
+	}
+	db.DB.Save(progress)
+}
+
+// CancelBackup cancels every queued and running job of a backup.
+func (bs *BackupService) CancelBackup(backupID uint) {
+	db.DB.Model(&db.BackupJob{}).Where("backup_id = ? AND status = ?", backupID, "queued").
+		Updates(map[string]any{"status": "cancelled", "finished_at": time.Now()})
+
+	bs.jobsMu.Lock()
+	var ids []uint
+	for id, j := range bs.jobs {
+		if j.backupID == backupID {
+			ids = append(ids, id)
+		}
+	}
+	bs.jobsMu.Unlock()
+	for _, id := range ids {
+		bs.CancelProcess(id)
+	}
+}
+
+// jobReader stops reading at the next chunk while its job is paused or once
+// it has been cancelled.
+type jobReader struct {
+	r   io.Reader
+	job *jobControl
+}
+
+func (jr jobReader) Read(p []byte) (int, error) {
+	if err := jr.job.wait(); err != nil {
+		return 0, err
+	}
+	return jr.r.Read(p)
+}
@@ -0,0 +1,352 @@
+package backups
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"snaptrack/services/secrets"
+	"strings"
+	"time"
+)
+
+// Destination is the storage a server keeps the runs of backups on. Names
+// are slash-separated: absolute paths on local and SSH servers, paths below
+// the configured root or bucket on the others. Missing objects are reported
+// as fs.ErrNotExist.
+type Destination interface {
+	// Create opens a writer for a new object. The object only appears under
+	// name once the writer is committed.
+	Create(name string) (ObjectWriter, error)
+	// Open reads an object.
+	Open(name string) (io.ReadCloser, error)
+	// Stat describes an object or directory.
+	Stat(name string) (ObjectInfo, error)
+	// List returns the entries directly below dir. Symlinks are left out.
+	List(dir string) ([]ObjectInfo, error)
+	// Delete removes an object.
+	Delete(name string) error
+	Close() error
+}
+
+// ObjectWriter writes an object to a destination. Commit puts the object in
+// place, Abort discards what was written.
+type ObjectWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// ObjectInfo describes an entry of a destination.
+type ObjectInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// mirrorDestination is implemented by destinations that keep raw backups, a
+// mirror of the source tree in a directory. The index of the run is built on
+// the way.
+type mirrorDestination interface {
+	Mirror(source, dir string, filter *fileFilter, ix *fileIndex) error
+}
+
+// checksumDestination is implemented by destinations that hash stored
+// objects themselves, returning the hex SHA-256 of an object.
+type checksumDestination interface {
+	Checksum(name string) (string, error)
+}
+
+// openDestination connects to the storage of a server. Transfers follow the
+// pauses and cancellation of job and, where tracker is set, report to it.
+func openDestination(server db.Server, job *jobControl, tracker *progressTracker) (Destination, error) {
+	switch server.Type {
+	case "local":
+		return &localDestination{tracker: tracker}, nil
+	case "remote":
+		rc, err := openRemote(server, job)
+		if err != nil {
+			return nil, err
+		}
+		rc.tracker = tracker
+		return &sftpDestination{rc: rc}, nil
+	case "s3":
+		return openS3(server, job)
+	case "webdav":
+		return openWebDAV(server, job)
+	case "ftp":
+		return openFTP(server, job)
+	}
+	return nil, fmt.Errorf("server %s has unsupported type %q", server.Name, server.Type)
+}
+
+// ConfigureDestination checks the settings of a server that stores backups
+// behind credentials and seals a new secret into it: the secret access key
+// of S3 servers, the password of WebDAV and FTP servers. A nil or empty
+// secret keeps the sealed one.
+func ConfigureDestination(server *db.Server, secret *string) error {
+	switch server.Type {
+	case "s3":
+		return configureS3(server, secret)
+	case "webdav":
+		if _, err := webdavBase(server.Host); err != nil {
+			return err
+		}
+	case "ftp":
+		if _, _, err := ftpAddress(server.Host); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if server.Username == nil || strings.TrimSpace(*server.Username) == "" {
+		return fmt.Errorf("a username is required for %s servers", server.Type)
+	}
+	if secret != nil && strings.TrimSpace(*secret) != "" {
+		sealed, err := secrets.Seal(*secret)
+		if err != nil {
+			return fmt.Errorf("failed to store password: %v", err)
+		}
+		server.SealedPassword = &sealed
+	}
+	if server.SealedPassword == nil {
+		return fmt.Errorf("a password is required for %s servers", server.Type)
+	}
+	return nil
+}
+
+// openPassword returns the password of a WebDAV or FTP server.
+func openPassword(server db.Server) (string, string, error) {
+	if server.Username == nil || server.SealedPassword == nil {
+		return "", "", fmt.Errorf("server %s has no credentials", server.Name)
+	}
+	password, err := secrets.Open(*server.SealedPassword)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read password of %s: %v", server.Name, err)
+	}
+	return *server.Username, password, nil
+}
+
+// CheckDestination checks that the storage of a server can be reached with
+// its credentials by listing its root.
+func CheckDestination(server db.Server) error {
+	if server.Type == "s3" {
+		return checkS3Server(server)
+	}
+	dest, err := openDestination(server, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if _, err := dest.List(""); err != nil {
+		return fmt.Errorf("failed to list %s: %w", server.Name, err)
+	}
+	return nil
+}
+
+// ValidateTargets checks that the target servers of a backup can store it:
+// raw backups are only kept on local and SSH servers.
+func ValidateTargets(backup db.Backup) error {
+	if backup.FileType != "raw" || len(backup.ServerIDs) == 0 {
+		return nil
+	}
+	var serverIDs []uint
+	if err := json.Unmarshal(backup.ServerIDs, &serverIDs); err != nil {
+		return fmt.Errorf("invalid server_ids: %v", err)
+	}
+	var servers []db.Server
+	if len(serverIDs) > 0 {
+		db.DB.Where("id IN ? AND type NOT IN ?", serverIDs, []string{"local", "remote"}).Find(&servers)
+	}
+	if len(servers) > 0 {
+		return fmt.Errorf("raw backups cannot be stored on %s server %s", servers[0].Type, servers[0].Name)
+	}
+	return nil
+}
+
+// verifyObject checks a stored archive against its size and, where the
+// destination hashes objects, its checksum. A damaged copy is deleted.
+func verifyObject(dest Destination, name string, size int64, checksum string) error {
+	info, err := dest.Stat(name)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", name, err)
+	}
+	if info.Size != size {
+		dest.Delete(name)
+		return fmt.Errorf("size mismatch for %s: stored %d bytes, wrote %d", name, info.Size, size)
+	}
+	if cd, ok := dest.(checksumDestination); ok {
+		sum, err := cd.Checksum(name)
+		if err != nil {
+			return err
+		}
+		if sum != checksum {
+			dest.Delete(name)
+			return fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	return nil
+}
+
+// ------------------- LOCAL -------------------
+
+// localDestination stores runs in the file system of this host.
+type localDestination struct {
+	tracker *progressTracker
+}
+
+func (d *localDestination) Create(name string) (ObjectWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	w := &localWriter{f: f, name: name}
+	if d.tracker != nil {
+		w.backupID = &d.tracker.progress.BackupID
+	}
+	return w, nil
+}
+
+// localWriter writes an archive to a temporary file next to it and moves it
+// into place on Commit, so an archive already at the name survives a failed
+// run. An aborted archive is removed.
+type localWriter struct {
+	f        *os.File
+	name     string
+	backupID *uint // for logging, nil outside of a job
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *localWriter) Commit() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := os.Chmod(w.f.Name(), 0644); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := os.Rename(w.f.Name(), w.name); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to move %s into place: %v", w.name, err)
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() {
+	w.f.Close()
+	if err := os.Remove(w.f.Name()); err != nil && !os.IsNotExist(err) {
+		logs.NewLogService(db.DB).Warning(fmt.Sprintf("Failed to remove partial archive %s", w.f.Name()),
+			logs.PtrString("backup"), w.backupID, map[string]interface{}{
+				"path":  w.f.Name(),
+				"error": err.Error(),
+			})
+	}
+}
+
+func (d *localDestination) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (d *localDestination) Stat(name string) (ObjectInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (d *localDestination) List(dir string) ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ObjectInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		list = append(list, ObjectInfo{Name: path.Join(dir, e.Name()), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()})
+	}
+	return list, nil
+}
+
+func (d *localDestination) Delete(name string) error {
+	return os.Remove(name)
+}
+
+func (d *localDestination) Close() error {
+	return nil
+}
+
+func (d *localDestination) Checksum(name string) (string, error) {
+	return hashFile(name)
+}
+
+// Mirror copies the changed files of source into dir and removes files that
+// were deleted from the source.
+func (d *localDestination) Mirror(source, dir string, filter *fileFilter, ix *fileIndex) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	tracker := d.tracker
+	err := filter.walk(source, func(p, rel string, info os.FileInfo) error {
+		destPath := filepath.Join(dir, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(destPath, info.Mode())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ix.unchanged(rel, info) {
+			tracker.add(info.Size())
+			return nil
+		}
+
+		tracker.progress.CurrentFile = &rel
+		tracker.bs.BroadcastProgress(tracker.progress)
+
+		out, err := os.Create(destPath)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		sum, err := copyFile(p, out, tracker)
+		if err != nil {
+			return err
+		}
+		ix.add(rel, info, sum)
+		return os.Chtimes(destPath, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range ix.deleted() {
+		if err := os.Remove(filepath.Join(dir, rel)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove deleted file %s: %v", rel, err)
+		}
+	}
+	return nil
+}
+
+// isNotExist reports whether a destination error is about a missing object.
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
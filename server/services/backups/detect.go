@@ -0,0 +1,318 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"sort"
+	"strings"
+)
+
+// Defaults of the change detection thresholds, see db.ChangeDetection.
+const (
+	detectMinFiles   = 20
+	detectChangedPct = 50
+	detectEntropyPct = 20
+	detectRenamePct  = 20
+)
+
+const (
+	// Files are sampled from their first bytes. Encrypted data comes close
+	// to 8 bits of entropy per byte while text and most documents stay well
+	// below; smaller files are too short for a useful estimate.
+	entropySample  = 64 << 10
+	entropyMinSize = 4 << 10
+	highEntropy    = 7.5
+
+	// An archive that suddenly compresses much worse than the previous one,
+	// by at least ratioJump of the data size, holds data that no longer
+	// compresses: encrypted data.
+	ratioMinBytes = 1 << 20
+	ratioJump     = 0.3
+)
+
+// ErrNotSuspicious is returned when dismissing a run that is not flagged.
+var ErrNotSuspicious = errors.New("run is not flagged as suspicious")
+
+// ValidateDetection rejects percentages outside 0-100 and negative counts.
+func ValidateDetection(d db.ChangeDetection) error {
+	if d.MinFiles < 0 {
+		return fmt.Errorf("min_files must not be negative")
+	}
+	for _, pct := range []int{d.MaxChangedPct, d.MaxEntropyPct, d.MaxRenamePct} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("detection percentages must be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+// detectionLimits fills in the defaults of unset thresholds.
+func detectionLimits(d db.ChangeDetection) db.ChangeDetection {
+	if d.MinFiles == 0 {
+		d.MinFiles = detectMinFiles
+	}
+	if d.MaxChangedPct == 0 {
+		d.MaxChangedPct = detectChangedPct
+	}
+	if d.MaxEntropyPct == 0 {
+		d.MaxEntropyPct = detectEntropyPct
+	}
+	if d.MaxRenamePct == 0 {
+		d.MaxRenamePct = detectRenamePct
+	}
+	return d
+}
+
+// detectChanges compares a finished run with the previous run of the backup
+// on the same server and flags it as suspicious when the source looks
+// mass-modified or encrypted. Flagged runs raise an error in the log.
+func (bs *BackupService) detectChanges(backup db.Backup, run *db.BackupRun, ix *fileIndex, size int64) {
+	if backup.Detection.Disabled {
+		return
+	}
+	prev, baseline := previousIndex(run, ix)
+	if prev == nil {
+		return
+	}
+	reasons := changeReasons(backup, *run, ix.entries, *prev, baseline, size)
+	if len(reasons) == 0 {
+		return
+	}
+
+	run.Suspicious = true
+	run.SuspiciousReasons = reasons
+	logs.NewLogService(db.DB).Error(
+		fmt.Sprintf("Run %d of backup %s looks suspicious: %s", run.ID, backup.Name, strings.Join(reasons, "; ")),
+		logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+			"alert":       "suspicious_run",
+			"run_id":      run.ID,
+			"previous_id": prev.ID,
+			"reasons":     reasons,
+		})
+}
+
+// previousIndex returns the run a run is compared with and its index: the
+// parent of an incremental run, or the latest completed run on the server.
+func previousIndex(run *db.BackupRun, ix *fileIndex) (*db.BackupRun, map[string]db.RunFile) {
+	var prev db.BackupRun
+	if run.ParentRunID != nil && ix.prev != nil {
+		if err := db.DB.First(&prev, *run.ParentRunID).Error; err != nil {
+			return nil, nil
+		}
+		return &prev, ix.prev
+	}
+
+	err := db.DB.Where("backup_id = ? AND server_id = ? AND status = ? AND started_at < ?", run.BackupID, run.ServerID, "completed", run.StartedAt).
+		Order("started_at DESC").First(&prev).Error
+	if err != nil {
+		return nil, nil
+	}
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", prev.ID, false).Find(&files).Error; err != nil {
+		return nil, nil
+	}
+	baseline := make(map[string]db.RunFile, len(files))
+	for _, f := range files {
+		baseline[f.Path] = f
+	}
+	return &prev, baseline
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// changeReasons applies the heuristics to the index of a run. The file
+// checks need a previous run of at least MinFiles files; the compression
+// check applies to compressed tar and zip archives.
+func changeReasons(backup db.Backup, run db.BackupRun, entries []db.RunFile, prev db.BackupRun, baseline map[string]db.RunFile, size int64) []string {
+	limits := detectionLimits(backup.Detection)
+	var reasons []string
+
+	current := make(map[string]db.RunFile, len(entries))
+	var stored int64
+	for _, f := range entries {
+		if f.Deleted {
+			continue
+		}
+		current[f.Path] = f
+		if f.StoredRunID == run.ID {
+			stored += f.Size
+		}
+	}
+
+	if len(baseline) >= limits.MinFiles {
+		var modified, added []string
+		removed := make(map[string]bool)
+		for p, f := range current {
+			old, ok := baseline[p]
+			if !ok {
+				added = append(added, p)
+			} else if old.SHA256 != f.SHA256 || old.Size != f.Size {
+				modified = append(modified, p)
+			}
+		}
+		for p := range baseline {
+			if _, ok := current[p]; !ok {
+				removed[p] = true
+			}
+		}
+
+		if pct := percent(len(modified)+len(removed), len(baseline)); pct >= float64(limits.MaxChangedPct) {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of the files changed since run %d (%d modified, %d removed)",
+				pct, prev.ID, len(modified), len(removed)))
+		}
+
+		renamed, ext := renamedFiles(baseline, removed, added)
+		if pct := percent(len(renamed), len(baseline)); pct >= float64(limits.MaxRenamePct) {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of the files were renamed to extensions the source did not have, mostly %s",
+				pct, ext))
+		}
+
+		// Renamed files are sampled as well: their content usually changed
+		// along with the name
+		high := 0
+		for _, rel := range append(modified, renamed...) {
+			f := current[rel]
+			if f.Size < entropyMinSize || alreadyCompressed[strings.ToLower(filepath.Ext(rel))] {
+				continue
+			}
+			if e, err := sampleEntropy(filepath.Join(backup.Source, rel)); err == nil && e >= highEntropy {
+				high++
+			}
+		}
+		if pct := percent(high, len(baseline)); pct >= float64(limits.MaxEntropyPct) {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of the files were rewritten with random-looking content", pct))
+		}
+	}
+
+	if reason := ratioJumped(backup, run, prev, stored, size); reason != "" {
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+// renamedFiles returns the added files that replace a removed file under an
+// extension the previous run had no file with, e.g. report.docx turning into
+// report.docx.locked or report.crypt, and the most common new extension.
+func renamedFiles(baseline map[string]db.RunFile, removed map[string]bool, added []string) ([]string, string) {
+	known := make(map[string]bool)
+	stems := make(map[string]bool)
+	for p := range baseline {
+		ext := filepath.Ext(p)
+		known[strings.ToLower(ext)] = true
+		if removed[p] {
+			stems[strings.TrimSuffix(p, ext)] = true
+		}
+	}
+
+	var renamed []string
+	counts := make(map[string]int)
+	for _, p := range added {
+		ext := filepath.Ext(p)
+		if ext == "" || known[strings.ToLower(ext)] {
+			continue
+		}
+		base := strings.TrimSuffix(p, ext)
+		if removed[base] || stems[base] {
+			renamed = append(renamed, p)
+			counts[strings.ToLower(ext)]++
+		}
+	}
+	exts := make([]string, 0, len(counts))
+	for ext := range counts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if counts[exts[i]] != counts[exts[j]] {
+			return counts[exts[i]] > counts[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	top := ""
+	if len(exts) > 0 {
+		top = exts[0]
+	}
+	return renamed, top
+}
+
+// sampleEntropy returns the Shannon entropy, in bits per byte, of the start
+// of a file.
+func sampleEntropy(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, entropySample)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	var counts [256]int
+	for _, b := range buf[:n] {
+		counts[b]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			e -= p * math.Log2(p)
+		}
+	}
+	return e, nil
+}
+
+// ratioJumped compares how well the archives of a run and the previous run
+// compressed the data they stored.
+func ratioJumped(backup db.Backup, run, prev db.BackupRun, stored, size int64) string {
+	if (backup.FileType != "tar" && backup.FileType != "zip") || run.Compression == "none" || prev.Compression != run.Compression {
+		return ""
+	}
+	var prevStored int64
+	db.DB.Model(&db.RunFile{}).Where("run_id = ? AND stored_run_id = ? AND deleted = ?", prev.ID, prev.ID, false).
+		Select("COALESCE(SUM(size), 0)").Scan(&prevStored)
+	if stored < ratioMinBytes || prevStored < ratioMinBytes {
+		return ""
+	}
+	ratio := float64(size) / float64(stored)
+	prevRatio := float64(prev.SizeBytes) / float64(prevStored)
+	if ratio-prevRatio < ratioJump {
+		return ""
+	}
+	return fmt.Sprintf("the archive holds %.0f%% of the data size, up from %.0f%% in run %d", ratio*100, prevRatio*100, prev.ID)
+}
+
+// DismissSuspicious clears the suspicious flag of a run after it has been
+// checked, releasing the older runs it protected from retention. The reasons
+// are kept.
+func (bs *BackupService) DismissSuspicious(backup db.Backup, runID uint, dismissedBy string) (*db.BackupRun, error) {
+	run, err := bs.GetRun(backup.ID, runID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: run %d of backup %d", ErrRunNotFound, runID, backup.ID)
+	}
+	if !run.Suspicious {
+		return nil, ErrNotSuspicious
+	}
+	run.Suspicious = false
+	if err := db.DB.Model(run).Update("suspicious", false).Error; err != nil {
+		return nil, err
+	}
+	logs.NewLogService(db.DB).Info(
+		fmt.Sprintf("Run %d of backup %s was dismissed as not suspicious by %s", run.ID, backup.Name, dismissedBy),
+		logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+			"run_id":       run.ID,
+			"reasons":      run.SuspiciousReasons,
+			"dismissed_by": dismissedBy,
+		})
+	return run, nil
+}
@@ -0,0 +1,158 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"snaptrack/db"
+	"sort"
+	"time"
+)
+
+// ErrRunNotFound is returned for run IDs that do not name a suitable run of
+// the backup, such as a failed run to compare.
+var ErrRunNotFound = errors.New("run not found")
+
+// FileChange is a file that differs between two runs. Sizes of added files
+// are their size in the newer run, those of removed files their size in the
+// older one.
+type FileChange struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	OldSize   int64     `json:"old_size"`
+	SizeDelta int64     `json:"size_delta"`
+	ModTime   time.Time `json:"mtime"`
+	Changes   []string  `json:"changes,omitempty"` // modified files: content / mode / owner
+}
+
+// DiffSummary counts the changes between two runs.
+type DiffSummary struct {
+	Added        int     `json:"added"`
+	Removed      int     `json:"removed"`
+	Modified     int     `json:"modified"`
+	Unchanged    int     `json:"unchanged"`
+	AddedBytes   int64   `json:"added_bytes"`
+	RemovedBytes int64   `json:"removed_bytes"`
+	SizeDelta    int64   `json:"size_delta"`    // change of the total size of all files
+	ChangedRatio float64 `json:"changed_ratio"` // share of the files of from that were modified or removed
+}
+
+// RunDiff compares the file indexes of two runs of a backup.
+type RunDiff struct {
+	From     db.BackupRun `json:"from"`
+	To       db.BackupRun `json:"to"`
+	Summary  DiffSummary  `json:"summary"`
+	Added    []FileChange `json:"added"`
+	Removed  []FileChange `json:"removed"`
+	Modified []FileChange `json:"modified"`
+}
+
+// diffRun loads a run of the backup that can be compared: completed runs,
+// and pruned ones, whose index is kept.
+func diffRun(backupID, runID uint) (db.BackupRun, error) {
+	var run db.BackupRun
+	err := db.DB.Where("backup_id = ? AND status IN ?", backupID, []string{"completed", "pruned"}).First(&run, runID).Error
+	if err != nil {
+		return run, fmt.Errorf("%w: run %d of backup %d", ErrRunNotFound, runID, backupID)
+	}
+	return run, nil
+}
+
+// DiffRuns lists the files added, removed and modified between the runs from
+// and to. Without to the latest completed run is used; without from the
+// completed run before to on the same server.
+func (bs *BackupService) DiffRuns(backup db.Backup, fromID, toID uint) (*RunDiff, error) {
+	var to, from db.BackupRun
+	var err error
+	if toID != 0 {
+		if to, err = diffRun(backup.ID, toID); err != nil {
+			return nil, err
+		}
+	} else if err := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed").
+		Order("started_at DESC").First(&to).Error; err != nil {
+		return nil, fmt.Errorf("%w: backup %d has no completed run", ErrRunNotFound, backup.ID)
+	}
+	if fromID != 0 {
+		if from, err = diffRun(backup.ID, fromID); err != nil {
+			return nil, err
+		}
+	} else if err := db.DB.Where("backup_id = ? AND server_id = ? AND status = ? AND started_at < ?", backup.ID, to.ServerID, "completed", to.StartedAt).
+		Order("started_at DESC").First(&from).Error; err != nil {
+		return nil, fmt.Errorf("%w: no completed run before run %d", ErrRunNotFound, to.ID)
+	}
+
+	load := func(run db.BackupRun) (map[string]db.RunFile, error) {
+		var files []db.RunFile
+		if err := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false).Find(&files).Error; err != nil {
+			return nil, err
+		}
+		byPath := make(map[string]db.RunFile, len(files))
+		for _, f := range files {
+			byPath[f.Path] = f
+		}
+		return byPath, nil
+	}
+	oldFiles, err := load(from)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := load(to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &RunDiff{From: from, To: to, Added: []FileChange{}, Removed: []FileChange{}, Modified: []FileChange{}}
+	s := &diff.Summary
+	for p, f := range newFiles {
+		s.SizeDelta += f.Size
+		old, ok := oldFiles[p]
+		if !ok {
+			diff.Added = append(diff.Added, FileChange{Path: p, Size: f.Size, SizeDelta: f.Size, ModTime: f.ModTime})
+			s.AddedBytes += f.Size
+			continue
+		}
+		if changes := fileChanges(old, f); len(changes) > 0 {
+			diff.Modified = append(diff.Modified, FileChange{
+				Path:      p,
+				Size:      f.Size,
+				OldSize:   old.Size,
+				SizeDelta: f.Size - old.Size,
+				ModTime:   f.ModTime,
+				Changes:   changes,
+			})
+		} else {
+			s.Unchanged++
+		}
+	}
+	for p, f := range oldFiles {
+		s.SizeDelta -= f.Size
+		if _, ok := newFiles[p]; !ok {
+			diff.Removed = append(diff.Removed, FileChange{Path: p, OldSize: f.Size, SizeDelta: -f.Size, ModTime: f.ModTime})
+			s.RemovedBytes += f.Size
+		}
+	}
+
+	for _, list := range [][]FileChange{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	s.Added, s.Removed, s.Modified = len(diff.Added), len(diff.Removed), len(diff.Modified)
+	if len(oldFiles) > 0 {
+		s.ChangedRatio = float64(s.Modified+s.Removed) / float64(len(oldFiles))
+	}
+	return diff, nil
+}
+
+// fileChanges names what differs between two index entries of a file. Mode
+// and owner are only compared when both runs recorded them.
+func fileChanges(old, cur db.RunFile) []string {
+	var changes []string
+	if old.SHA256 != cur.SHA256 || old.Size != cur.Size {
+		changes = append(changes, "content")
+	}
+	if old.Mode != 0 && cur.Mode != 0 && old.Mode != cur.Mode {
+		changes = append(changes, "mode")
+	}
+	if old.Owner != "" && cur.Owner != "" && old.Owner != cur.Owner {
+		changes = append(changes, "owner")
+	}
+	return changes
+}
@@ -0,0 +1,735 @@
+package backups
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"snaptrack/db"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// defaultDockerHelper is the image of the helper container that reads and
+// writes volumes; it only needs tar. DOCKER_HELPER_IMAGE overrides it.
+const defaultDockerHelper = "busybox"
+
+// dockerManifestName is the archive entry the docker manifest is stored in.
+const dockerManifestName = "docker.json"
+
+var dockerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// DockerManifest describes what a run of a docker source read: the container
+// as inspected before it was quiesced and the volumes that were archived. It
+// is kept on the run and in the archive, and used to recreate the volumes.
+type DockerManifest struct {
+	Container *DockerContainer `json:"container,omitempty"`
+	Volumes   []DockerVolume   `json:"volumes"`
+	Quiesce   string           `json:"quiesce"`
+}
+
+// redacted returns a copy of the manifest without the values of the
+// container's environment, which often hold passwords and tokens. The run
+// keeps this copy in the database; the archive keeps the full manifest.
+func (m *DockerManifest) redacted() *DockerManifest {
+	r := *m
+	if m.Container != nil {
+		c := *m.Container
+		c.Env = make([]string, len(m.Container.Env))
+		for i, kv := range m.Container.Env {
+			name, _, _ := strings.Cut(kv, "=")
+			c.Env[i] = name + "=" + redactedValue
+		}
+		r.Container = &c
+	}
+	return &r
+}
+
+// redactedValue replaces the values of environment variables in run manifests.
+const redactedValue = "[redacted]"
+
+type DockerContainer struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Image       string            `json:"image"` // image reference the container was created from, e.g. postgres:16
+	ImageID     string            `json:"image_id"`
+	RepoTags    []string          `json:"repo_tags"`
+	RepoDigests []string          `json:"repo_digests"`
+	Env         []string          `json:"env"`
+	Labels      map[string]string `json:"labels"`
+	Cmd         []string          `json:"cmd"`
+	Status      string            `json:"status"`
+	Mounts      []DockerMount     `json:"mounts"`
+}
+
+type DockerMount struct {
+	Type        string `json:"type"` // volume / bind / tmpfs
+	Name        string `json:"name,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	RW          bool   `json:"rw"`
+}
+
+type DockerVolume struct {
+	Name        string            `json:"name"`
+	Driver      string            `json:"driver"`
+	Labels      map[string]string `json:"labels"`
+	Options     map[string]string `json:"options"`
+	Destination string            `json:"destination,omitempty"` // where the container mounts it
+}
+
+// DockerInventory lists the containers and volumes of a server.
+type DockerInventory struct {
+	Containers []DockerContainerInfo `json:"containers"`
+	Volumes    []DockerVolumeInfo    `json:"volumes"`
+}
+
+type DockerContainerInfo struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Image   string   `json:"image"`
+	Status  string   `json:"status"`
+	Volumes []string `json:"volumes"` // named volumes it mounts
+}
+
+type DockerVolumeInfo struct {
+	Name       string   `json:"name"`
+	Driver     string   `json:"driver"`
+	Containers []string `json:"containers"` // containers mounting it
+}
+
+// containerInspect and volumeInspect are the parts of docker inspect output
+// that are used.
+type containerInspect struct {
+	ID     string `json:"Id"`
+	Name   string
+	Image  string
+	Config struct {
+		Image  string
+		Env    []string
+		Labels map[string]string
+		Cmd    []string
+	}
+	State struct {
+		Status string
+	}
+	Mounts []struct {
+		Type        string
+		Name        string
+		Source      string
+		Destination string
+		RW          bool
+	}
+}
+
+type volumeInspect struct {
+	Name    string
+	Driver  string
+	Labels  map[string]string
+	Options map[string]string
+}
+
+func dockerHelperImage() string {
+	if image := os.Getenv("DOCKER_HELPER_IMAGE"); image != "" {
+		return image
+	}
+	return defaultDockerHelper
+}
+
+// dockerScript quotes a docker command line for the shell.
+func dockerScript(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return "docker " + strings.Join(quoted, " ")
+}
+
+// helperScript runs tar in a throwaway helper container with the volume
+// mounted at /volume. Its output bypasses the log driver, so volume content
+// never ends up in container logs.
+func helperScript(volume string, readOnly bool, tarArgs ...string) string {
+	mount := volume + ":/volume"
+	args := []string{"run", "--rm", "--network", "none", "--log-driver", "none"}
+	if readOnly {
+		mount += ":ro"
+	} else {
+		args = append(args, "-i")
+	}
+	args = append(args, "-v", mount, dockerHelperImage(), "tar")
+	return dockerScript(append(args, tarArgs...)...)
+}
+
+// validateDocker checks the docker settings of a backup.
+func validateDocker(backup *db.Backup) error {
+	d := &backup.Docker
+	if backup.FileType != "tar" {
+		return errors.New("docker sources are stored as tar archives, which keep file ownership")
+	}
+	if backup.Type == "incremental" {
+		return errors.New("docker sources are always full backups")
+	}
+	if backup.Source == "" && len(d.Volumes) == 0 {
+		return errors.New("a container or at least one volume is required")
+	}
+	if backup.Source != "" && !dockerName.MatchString(backup.Source) {
+		return fmt.Errorf("invalid container name %q", backup.Source)
+	}
+	for _, v := range d.Volumes {
+		if !dockerName.MatchString(v) {
+			return fmt.Errorf("invalid volume name %q", v)
+		}
+	}
+	switch d.Quiesce {
+	case "":
+		d.Quiesce = "none"
+	case "none":
+	case "pause", "stop":
+		if backup.Source == "" {
+			return fmt.Errorf("quiesce %s needs a container", d.Quiesce)
+		}
+	default:
+		return fmt.Errorf("unsupported quiesce mode: %s", d.Quiesce)
+	}
+	return nil
+}
+
+// inspectContainers returns docker inspect output for the given containers.
+func inspectContainers(server *db.Server, job *jobControl, names ...string) ([]containerInspect, error) {
+	out, err := runScript(server, job, dockerScript(append([]string{"inspect", "--type", "container"}, names...)...))
+	if err != nil {
+		return nil, fmt.Errorf("docker inspect failed: %w", err)
+	}
+	var list []containerInspect
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("unexpected docker inspect output: %v", err)
+	}
+	return list, nil
+}
+
+func inspectVolumes(server *db.Server, job *jobControl, names ...string) ([]volumeInspect, error) {
+	out, err := runScript(server, job, dockerScript(append([]string{"volume", "inspect"}, names...)...))
+	if err != nil {
+		return nil, fmt.Errorf("docker volume inspect failed: %w", err)
+	}
+	var list []volumeInspect
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("unexpected docker volume inspect output: %v", err)
+	}
+	return list, nil
+}
+
+// inspectDocker builds the manifest of a run: the container of the backup,
+// with its image, environment and mounts, and the volumes to archive.
+func inspectDocker(server *db.Server, job *jobControl, backup db.Backup) (*DockerManifest, error) {
+	manifest := &DockerManifest{Quiesce: backup.Docker.Quiesce}
+	destinations := make(map[string]string)
+	names := append([]string(nil), backup.Docker.Volumes...)
+
+	if backup.Source != "" {
+		list, err := inspectContainers(server, job, backup.Source)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("container %s not found", backup.Source)
+		}
+		ci := list[0]
+		c := &DockerContainer{
+			ID:      ci.ID,
+			Name:    strings.TrimPrefix(ci.Name, "/"),
+			Image:   ci.Config.Image,
+			ImageID: ci.Image,
+			Env:     ci.Config.Env,
+			Labels:  ci.Config.Labels,
+			Cmd:     ci.Config.Cmd,
+			Status:  ci.State.Status,
+		}
+		var mounted []string
+		for _, m := range ci.Mounts {
+			c.Mounts = append(c.Mounts, DockerMount{Type: m.Type, Name: m.Name, Source: m.Source, Destination: m.Destination, RW: m.RW})
+			if m.Type == "volume" {
+				mounted = append(mounted, m.Name)
+				destinations[m.Name] = m.Destination
+			}
+		}
+		if len(names) == 0 {
+			names = mounted
+		}
+		// Tags and digests pin down the image; a missing image is no reason
+		// to skip the backup
+		var images []struct {
+			RepoTags    []string
+			RepoDigests []string
+		}
+		if out, err := runScript(server, job, dockerScript("image", "inspect", ci.Image)); err == nil && json.Unmarshal([]byte(out), &images) == nil && len(images) > 0 {
+			c.RepoTags = images[0].RepoTags
+			c.RepoDigests = images[0].RepoDigests
+		}
+		manifest.Container = c
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("container %s has no named volumes", backup.Source)
+	}
+
+	volumes, err := inspectVolumes(server, job, names...)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		manifest.Volumes = append(manifest.Volumes, DockerVolume{
+			Name:        v.Name,
+			Driver:      v.Driver,
+			Labels:      v.Labels,
+			Options:     v.Options,
+			Destination: destinations[v.Name],
+		})
+	}
+	return manifest, nil
+}
+
+// ListDocker enumerates the containers and volumes of a local or remote
+// server with the docker CLI.
+func ListDocker(server db.Server) (*DockerInventory, error) {
+	var host *db.Server
+	if server.Type == "remote" {
+		host = &server
+	}
+	inv := &DockerInventory{Containers: []DockerContainerInfo{}, Volumes: []DockerVolumeInfo{}}
+
+	out, err := runScript(host, nil, "docker ps -aq --no-trunc")
+	if err != nil {
+		return nil, fmt.Errorf("docker ps failed: %w", err)
+	}
+	users := make(map[string][]string)
+	if ids := strings.Fields(out); len(ids) > 0 {
+		list, err := inspectContainers(host, nil, ids...)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list {
+			info := DockerContainerInfo{
+				ID:      c.ID,
+				Name:    strings.TrimPrefix(c.Name, "/"),
+				Image:   c.Config.Image,
+				Status:  c.State.Status,
+				Volumes: []string{},
+			}
+			for _, m := range c.Mounts {
+				if m.Type == "volume" {
+					info.Volumes = append(info.Volumes, m.Name)
+					users[m.Name] = append(users[m.Name], info.Name)
+				}
+			}
+			inv.Containers = append(inv.Containers, info)
+		}
+	}
+
+	out, err = runScript(host, nil, "docker volume ls -q")
+	if err != nil {
+		return nil, fmt.Errorf("docker volume ls failed: %w", err)
+	}
+	if names := strings.Fields(out); len(names) > 0 {
+		list, err := inspectVolumes(host, nil, names...)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			containers := users[v.Name]
+			if containers == nil {
+				containers = []string{}
+			}
+			inv.Volumes = append(inv.Volumes, DockerVolumeInfo{Name: v.Name, Driver: v.Driver, Containers: containers})
+		}
+	}
+	sort.Slice(inv.Containers, func(i, j int) bool { return inv.Containers[i].Name < inv.Containers[j].Name })
+	sort.Slice(inv.Volumes, func(i, j int) bool { return inv.Volumes[i].Name < inv.Volumes[j].Name })
+	return inv, nil
+}
+
+// quiesceContainer pauses or stops a running container while its volumes are
+// read and returns the function that resumes it. Both run without the job,
+// so a cancelled backup still brings the container back.
+func quiesceContainer(server *db.Server, c *DockerContainer, mode string) (func() error, error) {
+	resumed := func() error { return nil }
+	if c == nil || c.Status != "running" {
+		return resumed, nil
+	}
+	var stop, resume string
+	switch mode {
+	case "pause":
+		stop, resume = "pause", "unpause"
+	case "stop":
+		stop, resume = "stop", "start"
+	default:
+		return resumed, nil
+	}
+	if _, err := runScript(server, nil, dockerScript(stop, c.ID)); err != nil {
+		return resumed, fmt.Errorf("failed to %s container %s: %w", stop, c.Name, err)
+	}
+	return func() error {
+		if _, err := runScript(server, nil, dockerScript(resume, c.ID)); err != nil {
+			return fmt.Errorf("failed to %s container %s: %w", resume, c.Name, err)
+		}
+		return nil
+	}, nil
+}
+
+// writeDockerArchive writes the manifest and the volumes of a docker source
+// to w as a tar archive, each volume below volumes/<name>. The volumes are
+// streamed out of a helper container; ownership is kept by numeric IDs.
+func (bs *BackupService) writeDockerArchive(w io.Writer, backup db.Backup, format archiveFormat, ix *fileIndex, progress *db.BackupProgress) error {
+	server, err := sourceServer(backup)
+	if err != nil {
+		return err
+	}
+	job := bs.jobFor(progress)
+	bs.updateProgress(progress, 0, "running", "Inspecting docker...")
+	manifest, err := inspectDocker(server, job, backup)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	stored, err := json.MarshalIndent(manifest.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	ix.run.Manifest = datatypes.JSON(stored)
+
+	enc, err := encryptWriter(w, format.recipients)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %v", err)
+	}
+	defer enc.Close()
+	cw, err := compressWriter(enc, format.compression, format.level)
+	if err != nil {
+		return err
+	}
+	defer cw.Close()
+	tw := tar.NewWriter(cw)
+	defer tw.Close()
+
+	now := time.Now()
+	header := &tar.Header{Name: dockerManifestName, Mode: 0600, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	ix.addEntry(dockerManifestName, header.Size, now, hex.EncodeToString(sum[:])).Mode = 0600
+
+	resume, err := quiesceContainer(server, manifest.Container, manifest.Quiesce)
+	if err != nil {
+		return err
+	}
+	tracker := bs.newProgressTracker(progress)
+	for _, v := range manifest.Volumes {
+		if err = bs.archiveVolume(tw, server, job, v.Name, ix, tracker, progress); err != nil {
+			break
+		}
+	}
+	if rerr := resume(); err == nil {
+		err = rerr
+	} else if rerr != nil {
+		err = fmt.Errorf("%w; %v", err, rerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// archiveVolume copies the tar stream of a volume, read by a helper
+// container, into tw below volumes/<name>.
+func (bs *BackupService) archiveVolume(tw *tar.Writer, server *db.Server, job *jobControl, volume string, ix *fileIndex, tracker *progressTracker, progress *db.BackupProgress) error {
+	prefix := path.Join("volumes", volume)
+	progress.CurrentFile = &prefix
+	bs.updateProgress(progress, progress.Progress, "running", fmt.Sprintf("Reading volume %s...", volume))
+
+	proc, err := startScript(server, job, helperScript(volume, true, "-C", "/volume", "-cf", "-", "."), nil)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(tracker.reader(proc))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			proc.abort()
+			return fmt.Errorf("failed to read volume %s: %w", volume, err)
+		}
+		rel := path.Clean(hdr.Name)
+		if rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+			continue
+		}
+		hdr.Name = path.Join(prefix, rel)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(prefix, path.Clean(hdr.Linkname))
+		}
+		// Names would be mapped through the users of wherever the archive
+		// is extracted; the numeric IDs are what the container uses
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Format = tar.FormatUnknown
+		if err := tw.WriteHeader(hdr); err != nil {
+			proc.abort()
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, hash), tr); err != nil {
+			proc.abort()
+			return err
+		}
+		entry := ix.addEntry(hdr.Name, hdr.Size, hdr.ModTime, hex.EncodeToString(hash.Sum(nil)))
+		entry.Mode = uint32(hdr.Mode & 07777)
+		entry.Owner = fmt.Sprintf("%d:%d", hdr.Uid, hdr.Gid)
+	}
+	if err := proc.wait(); err != nil {
+		if errors.Is(err, ErrCancelled) {
+			return err
+		}
+		return fmt.Errorf("failed to read volume %s: %w", volume, err)
+	}
+	return nil
+}
+
+// volumeWriter feeds a tar stream into a helper container that extracts it
+// into a volume.
+type volumeWriter struct {
+	name string
+	skip bool
+	tw   *tar.Writer
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// openVolume recreates a volume on the target with the driver, options and
+// labels of the manifest and starts extracting into it. An existing volume is
+// written into, or left alone when the overwrite policy is skip.
+func openVolume(server *db.Server, job *jobControl, v DockerVolume, policy string) (*volumeWriter, error) {
+	out, err := runScript(server, job, "if "+dockerScript("volume", "inspect", v.Name)+" >/dev/null 2>&1; then echo exists; fi")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "exists" {
+		if policy == "skip" {
+			return &volumeWriter{name: v.Name, skip: true}, nil
+		}
+	} else {
+		args := []string{"volume", "create"}
+		if v.Driver != "" {
+			args = append(args, "--driver", v.Driver)
+		}
+		for _, k := range sortedKeys(v.Options) {
+			args = append(args, "--opt", k+"="+v.Options[k])
+		}
+		for _, k := range sortedKeys(v.Labels) {
+			args = append(args, "--label", k+"="+v.Labels[k])
+		}
+		if _, err := runScript(server, job, dockerScript(append(args, v.Name)...)); err != nil {
+			return nil, fmt.Errorf("failed to create volume %s: %w", v.Name, err)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	proc, err := startScript(server, job, helperScript(v.Name, false, "-C", "/volume", "-xpf", "-"), pr)
+	if err != nil {
+		return nil, err
+	}
+	vw := &volumeWriter{name: v.Name, tw: tar.NewWriter(pw), pw: pw, done: make(chan error, 1)}
+	go func() {
+		io.Copy(io.Discard, proc)
+		err := proc.wait()
+		// Fail further writes once the helper is gone
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.CloseWithError(errors.New("volume helper exited early"))
+		}
+		vw.done <- err
+	}()
+	return vw, nil
+}
+
+// close finishes the tar stream, or cuts it off after a failure, and waits
+// for the helper to exit.
+func (vw *volumeWriter) close(failed error) error {
+	if vw.skip {
+		return nil
+	}
+	err := failed
+	if err == nil {
+		err = vw.tw.Close()
+	}
+	vw.pw.CloseWithError(err)
+	if werr := <-vw.done; werr != nil {
+		if errors.Is(werr, ErrCancelled) {
+			return werr
+		}
+		return fmt.Errorf("failed to restore volume %s: %w", vw.name, werr)
+	}
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// volumeEntry splits an archive path below volumes/<name> into the volume
+// and the path inside it.
+func volumeEntry(rel string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(rel, "volumes/")
+	if !ok || rest == "" {
+		return "", "", false
+	}
+	name, inner, _ := strings.Cut(rest, "/")
+	if inner == "" {
+		inner = "."
+	}
+	return name, inner, true
+}
+
+// restoreVolumes recreates the volumes of a docker run on the target server
+// from its archive, instead of restoring them as files.
+func (bs *BackupService) restoreVolumes(backup db.Backup, run db.BackupRun, target db.Server, opts RestoreOptions, progress *db.BackupProgress) error {
+	var manifest DockerManifest
+	if err := json.Unmarshal(run.Manifest, &manifest); err != nil {
+		return fmt.Errorf("run %d has no docker manifest", run.ID)
+	}
+	specs := make(map[string]DockerVolume)
+	for _, v := range manifest.Volumes {
+		specs[v.Name] = v
+	}
+	want := pathFilter(opts.Paths)
+
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false).Find(&files).Error; err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		if _, _, ok := volumeEntry(f.Path); ok && want(f.Path) {
+			total += f.Size
+		}
+	}
+	progress.TotalBytes = &total
+	progress.BytesProcessed = 0
+
+	var server *db.Server
+	if target.Type == "remote" {
+		server = &target
+	}
+	job := bs.jobFor(progress)
+	tracker := bs.newProgressTracker(progress)
+
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Reading data of run %d...", run.ID))
+	ids, err := decryptionIdentities(backup, run, opts.Secret)
+	if err != nil {
+		return err
+	}
+	archive, cleanup, err := bs.fetchArchive(backup, run, job)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	r, err := openArchive(archive, run, ids)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cr, err := decompressReader(r, run.Compression)
+	if err != nil {
+		return fmt.Errorf("failed to open %s stream: %v", run.Compression, err)
+	}
+	defer cr.Close()
+
+	var current *volumeWriter
+	err = func() error {
+		tr := tar.NewReader(cr)
+		for {
+			if err := job.wait(); err != nil {
+				return err
+			}
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rel := path.Clean(hdr.Name)
+			name, inner, ok := volumeEntry(rel)
+			if !ok || !want(rel) {
+				continue
+			}
+			if current == nil || current.name != name {
+				if current != nil {
+					err := current.close(nil)
+					current = nil
+					if err != nil {
+						return err
+					}
+				}
+				spec, ok := specs[name]
+				if !ok {
+					spec = DockerVolume{Name: name}
+				}
+				bs.updateProgress(progress, progress.Progress, "running", fmt.Sprintf("Restoring volume %s on %s...", name, target.Name))
+				if current, err = openVolume(server, job, spec, opts.Overwrite); err != nil {
+					return err
+				}
+			}
+			if current.skip {
+				continue
+			}
+			hdr.Name = inner
+			if hdr.Typeflag == tar.TypeLink {
+				_, hdr.Linkname, _ = volumeEntry(path.Clean(hdr.Linkname))
+			}
+			if err := current.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(current.tw, tracker.reader(tr)); err != nil {
+					return err
+				}
+			}
+		}
+	}()
+	if current != nil {
+		if cerr := current.close(err); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
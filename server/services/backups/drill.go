@@ -0,0 +1,369 @@
+package backups
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A restore drill proves that a backup can be restored, which a checksum
+// alone does not: the run is restored into a scratch directory on a server,
+// the restored files are compared with the index of the run and an optional
+// command validates them, e.g. pg_restore --list. The scratch directory is
+// removed afterwards whatever the outcome.
+
+// ErrDrillNotConfigured is returned when a drill is started for a backup
+// without a drill server and scratch path.
+var ErrDrillNotConfigured = errors.New("restore drill is not configured")
+
+// maxDiffPaths caps the paths recorded per kind of difference.
+const maxDiffPaths = 100
+
+// maxCommandOutput caps the recorded output of the validation command.
+const maxCommandOutput = 64 << 10
+
+// DrillDiff lists the differences between a restore and the index of the
+// restored run.
+type DrillDiff struct {
+	Missing    []string `json:"missing"`    // indexed but not restored
+	Mismatched []string `json:"mismatched"` // restored with different content
+	Extra      []string `json:"extra"`      // restored but not indexed
+}
+
+// ValidateDrill checks the drill settings of a backup. Settings without a
+// server and scratch path leave drills disabled.
+func ValidateDrill(drill db.RestoreDrill) error {
+	configured := drill.ServerID != nil || drill.ScratchPath != nil && strings.TrimSpace(*drill.ScratchPath) != ""
+	scheduled := drill.Schedule != nil && strings.TrimSpace(*drill.Schedule) != ""
+	if !configured {
+		if scheduled {
+			return errors.New("a scheduled restore drill needs a server and scratch path")
+		}
+		return nil
+	}
+	if drill.ServerID == nil {
+		return errors.New("drill server_id is required")
+	}
+	var server db.Server
+	if err := db.DB.First(&server, *drill.ServerID).Error; err != nil {
+		return fmt.Errorf("drill server %d not found", *drill.ServerID)
+	}
+	if server.Type != "local" && server.Type != "remote" {
+		return fmt.Errorf("cannot restore to %s server %s", server.Type, server.Name)
+	}
+	if drill.ScratchPath == nil || !path.IsAbs(strings.TrimSpace(*drill.ScratchPath)) {
+		return errors.New("drill scratch_path must be an absolute path")
+	}
+	if path.Clean(strings.TrimSpace(*drill.ScratchPath)) == "/" {
+		return errors.New("drill scratch_path must not be the root directory")
+	}
+	return nil
+}
+
+// StartDrill runs the restore drill of a backup in the background. Progress
+// is reported like a restore, with operation "drill"; the outcome is recorded
+// in the returned result.
+func (bs *BackupService) StartDrill(backup db.Backup, executedBy string) (*db.DrillResult, error) {
+	drill := backup.Drill
+	if drill.ServerID == nil || drill.ScratchPath == nil || strings.TrimSpace(*drill.ScratchPath) == "" {
+		return nil, ErrDrillNotConfigured
+	}
+	if backup.Status == "running" {
+		return nil, ErrBackupRunning
+	}
+	if err := ValidateDrill(drill); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+	var target db.Server
+	if err := db.DB.First(&target, *drill.ServerID).Error; err != nil {
+		return nil, fmt.Errorf("%w: server %d not found", ErrInvalidOption, *drill.ServerID)
+	}
+
+	var run db.BackupRun
+	query := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed")
+	if drill.RunID != nil && *drill.RunID != 0 {
+		query = query.Where("id = ?", *drill.RunID)
+	}
+	if err := query.Order("started_at DESC").First(&run).Error; err != nil {
+		return nil, ErrNoRun
+	}
+	if err := checkRawMirror(backup, run); err != nil {
+		return nil, err
+	}
+	if _, err := decryptionIdentities(backup, run, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+
+	progress := &db.BackupProgress{
+		BackupID:  backup.ID,
+		RunID:     &run.ID,
+		Operation: "drill",
+		Status:    "running",
+		Message:   "Starting restore drill...",
+	}
+	db.DB.Create(progress)
+	result := &db.DrillResult{
+		BackupID:   backup.ID,
+		RunID:      run.ID,
+		ServerID:   target.ID,
+		ProgressID: progress.ID,
+		Status:     "running",
+		StartedAt:  time.Now(),
+		ExecutedBy: executedBy,
+	}
+	if err := db.DB.Create(result).Error; err != nil {
+		return nil, err
+	}
+	// Every drill restores into a directory of its own, so nothing of a
+	// previous drill or anything else below the scratch path is touched
+	result.Path = path.Join(path.Clean(strings.TrimSpace(*drill.ScratchPath)), fmt.Sprintf("snaptrack-drill-%d", result.ID))
+	db.DB.Model(result).UpdateColumn("path", result.Path)
+	bs.BroadcastProgress(progress)
+	job := bs.startJob(progress)
+
+	go func() {
+		defer bs.endJob(job)
+		bs.runDrill(backup, run, target, result, progress)
+	}()
+	return result, nil
+}
+
+func (bs *BackupService) runDrill(backup db.Backup, run db.BackupRun, target db.Server, result *db.DrillResult, progress *db.BackupProgress) {
+	ls := logs.NewLogService(db.DB)
+	job := bs.jobFor(progress)
+
+	opts := RestoreOptions{RunID: run.ID, ServerID: target.ID, TargetPath: result.Path, Overwrite: "overwrite"}
+	err := bs.restoreRun(backup, run, target, opts, progress)
+	var diff DrillDiff
+	if err == nil {
+		bs.updateProgress(progress, 100, "running", "Comparing restored files with the index...")
+		diff, result.Files, err = compareRestore(target, result.Path, run, job)
+		result.Missing, result.Mismatched, result.Extra = len(diff.Missing), len(diff.Mismatched), len(diff.Extra)
+		diff.Missing = capPaths(diff.Missing)
+		diff.Mismatched = capPaths(diff.Mismatched)
+		diff.Extra = capPaths(diff.Extra)
+		result.Diff, _ = json.Marshal(diff)
+	}
+	if err == nil && backup.Drill.Command != nil && strings.TrimSpace(*backup.Drill.Command) != "" {
+		bs.updateProgress(progress, 100, "running", "Running validation command...")
+		var out string
+		out, err = runDrillCommand(target, result.Path, strings.TrimSpace(*backup.Drill.Command), job)
+		if len(out) > maxCommandOutput {
+			out = out[:maxCommandOutput]
+		}
+		result.CommandOutput = &out
+		if err != nil {
+			err = fmt.Errorf("validation command failed: %w", err)
+		}
+	}
+
+	bs.updateProgress(progress, 100, "running", "Removing scratch directory...")
+	if cerr := removeScratch(target, result.Path); cerr != nil {
+		ls.Warning(fmt.Sprintf("Scratch directory of restore drill %d could not be removed", result.ID), logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+			"path":  result.Path,
+			"error": cerr.Error(),
+		})
+	}
+
+	now := time.Now()
+	result.FinishedAt = &now
+	result.DurationSec = int64(now.Sub(result.StartedAt).Seconds())
+	switch {
+	case err != nil && job.cancelled():
+		result.Status = "cancelled"
+	case err != nil:
+		result.Status = "failed"
+		msg := err.Error()
+		result.Error = &msg
+	case result.Missing+result.Mismatched+result.Extra > 0:
+		result.Status = "failed"
+		msg := fmt.Sprintf("restore differs from the index: %d missing, %d mismatched, %d extra files", result.Missing, result.Mismatched, result.Extra)
+		result.Error = &msg
+	default:
+		result.Status = "passed"
+	}
+	db.DB.Save(result)
+
+	meta := map[string]interface{}{
+		"drill_id":     result.ID,
+		"run_id":       run.ID,
+		"server_id":    target.ID,
+		"duration_sec": result.DurationSec,
+		"executed_by":  result.ExecutedBy,
+	}
+	switch result.Status {
+	case "cancelled":
+		bs.updateProgress(progress, progress.Progress, "cancelled", "Restore drill cancelled")
+		ls.Warning(fmt.Sprintf("Restore drill of backup %s was cancelled", backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+	case "failed":
+		bs.updateProgress(progress, progress.Progress, "failed", fmt.Sprintf("Restore drill failed: %s", *result.Error))
+		meta["error"] = *result.Error
+		ls.Error(fmt.Sprintf("Restore drill of backup %s failed", backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+	default:
+		bs.updateProgress(progress, 100, "completed", fmt.Sprintf("Restore drill passed: %d files restored and verified", result.Files))
+		ls.Info("Restore drill passed", logs.PtrString("backup"), &backup.ID, meta)
+	}
+}
+
+// compareRestore hashes the regular files restored into dir and compares
+// them with the index of the run. It returns the differences and the number
+// of indexed files.
+func compareRestore(target db.Server, dir string, run db.BackupRun, job *jobControl) (DrillDiff, int, error) {
+	diff := DrillDiff{Missing: []string{}, Mismatched: []string{}, Extra: []string{}}
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false).Find(&files).Error; err != nil {
+		return diff, 0, err
+	}
+	if len(files) == 0 {
+		// Runs without an index can only be checked by the command
+		return diff, 0, nil
+	}
+
+	restored, err := restoredFiles(target, dir, job)
+	if err != nil {
+		return diff, 0, fmt.Errorf("failed to read restored files: %w", err)
+	}
+	indexed := make(map[string]bool, len(files))
+	for _, f := range files {
+		rel := filepath.ToSlash(f.Path)
+		indexed[rel] = true
+		sum, ok := restored[rel]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, rel)
+		case sum != f.SHA256:
+			diff.Mismatched = append(diff.Mismatched, rel)
+		}
+	}
+	for rel := range restored {
+		if !indexed[rel] {
+			diff.Extra = append(diff.Extra, rel)
+		}
+	}
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Mismatched)
+	sort.Strings(diff.Extra)
+	return diff, len(files), nil
+}
+
+// restoredFiles returns the SHA-256 of the regular files below dir by their
+// slash-separated path relative to it. Remote files are hashed on the server.
+func restoredFiles(target db.Server, dir string, job *jobControl) (map[string]string, error) {
+	sums := make(map[string]string)
+	if target.Type != "remote" {
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			if err := job.wait(); err != nil {
+				return err
+			}
+			sum, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			sums[filepath.ToSlash(rel)] = sum
+			return nil
+		})
+		return sums, err
+	}
+
+	rc, err := openRemote(target, job)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var paths []string
+	walker := rc.sftp.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, rc.err(err)
+		}
+		if walker.Stat().Mode().IsRegular() {
+			paths = append(paths, walker.Path())
+		}
+	}
+	remote, err := rc.sha256(paths...)
+	if err != nil {
+		return nil, err
+	}
+	for p, sum := range remote {
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+		sums[rel] = sum
+	}
+	return sums, nil
+}
+
+// runDrillCommand runs the validation command of a drill with the restored
+// directory as working directory, also passed as SNAPTRACK_DRILL_DIR. It
+// returns the combined output.
+func runDrillCommand(target db.Server, dir, command string, job *jobControl) (string, error) {
+	if target.Type == "remote" {
+		rc, err := openRemote(target, job)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		session, err := rc.ssh.NewSession()
+		if err != nil {
+			return "", rc.err(fmt.Errorf("failed to create SSH session: %w", err))
+		}
+		defer session.Close()
+		script := fmt.Sprintf("cd %s && SNAPTRACK_DRILL_DIR=%s; export SNAPTRACK_DRILL_DIR; %s", shellQuote(dir), shellQuote(dir), command)
+		out, err := session.CombinedOutput("sh -c " + shellQuote(script))
+		return string(out), rc.err(err)
+	}
+
+	cmd := job.command("sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "SNAPTRACK_DRILL_DIR="+dir)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	done, err := job.start(cmd)
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Wait()
+	done()
+	if err != nil && job.cancelled() {
+		return out.String(), ErrCancelled
+	}
+	return out.String(), err
+}
+
+// removeScratch deletes the directory a drill restored into.
+func removeScratch(target db.Server, dir string) error {
+	if target.Type != "remote" {
+		return os.RemoveAll(dir)
+	}
+	rc, err := openRemote(target, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := rc.sftp.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return rc.sftp.RemoveAll(dir)
+}
+
+func capPaths(paths []string) []string {
+	if len(paths) > maxDiffPaths {
+		return paths[:maxDiffPaths]
+	}
+	return paths
+}
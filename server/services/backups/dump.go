@@ -0,0 +1,520 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"snaptrack/db"
+	"snaptrack/services/secrets"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Source types of a backup. Files archives the source path; the others
+// archive the output of a database dump tool or the volumes of docker.
+const (
+	SourceFiles    = "files"
+	SourcePostgres = "postgres"
+	SourceMySQL    = "mysql"
+	SourceSQLite   = "sqlite"
+	SourceRedis    = "redis"
+	SourceDocker   = "docker"
+)
+
+// maxScriptStderr is how much of the error output of a script is kept for
+// the error message of a failed run.
+const maxScriptStderr = 4 << 10
+
+// redisSaveTimeout is how long a Redis dump waits for BGSAVE to finish.
+const redisSaveTimeout = time.Hour
+
+// isDumpSource reports whether the runs of a backup archive what a command
+// produces, rather than reading the source path.
+func isDumpSource(backup db.Backup) bool {
+	return backup.SourceType != "" && backup.SourceType != SourceFiles
+}
+
+func isDatabaseSource(backup db.Backup) bool {
+	return isDumpSource(backup) && backup.SourceType != SourceDocker
+}
+
+// ConfigureSource validates the source type of a backup with its database
+// connection or docker settings, and seals a newly supplied database
+// password. A nil or empty password keeps the stored one.
+func ConfigureSource(backup *db.Backup, password *string) error {
+	if backup.SourceType == "" {
+		backup.SourceType = SourceFiles
+	}
+	d := &backup.Database
+	if d.Host != nil && strings.TrimSpace(*d.Host) == "" {
+		d.Host = nil
+	}
+	if d.User != nil && strings.TrimSpace(*d.User) == "" {
+		d.User = nil
+	}
+	if d.Port != nil && *d.Port == 0 {
+		d.Port = nil
+	}
+	if password != nil && *password == "" {
+		password = nil
+	}
+
+	if backup.SourceType != SourceDocker {
+		backup.Docker = db.DockerSource{}
+	}
+	switch backup.SourceType {
+	case SourceFiles:
+		backup.Database = db.DatabaseSource{}
+		if backup.FileType == "repo" && backup.Type == "incremental" {
+			return errors.New("repo backups are full backups; their repository stores unchanged files only once")
+		}
+		return nil
+	case SourceDocker:
+		backup.Database = db.DatabaseSource{}
+		return validateDocker(backup)
+	case SourcePostgres, SourceMySQL, SourceRedis:
+	case SourceSQLite:
+		if strings.TrimSpace(backup.Source) == "" {
+			return errors.New("source must be the path of the SQLite database file")
+		}
+		if d.Host != nil || d.Port != nil || d.User != nil || password != nil {
+			return errors.New("SQLite sources take no host, port, user or password")
+		}
+		d.SealedPassword = nil
+	default:
+		return fmt.Errorf("unsupported source type: %s", backup.SourceType)
+	}
+
+	if backup.FileType == "raw" || backup.FileType == "repo" {
+		return fmt.Errorf("database dumps cannot be stored as %s backups", backup.FileType)
+	}
+	if backup.Type == "incremental" {
+		return errors.New("database dumps are always full backups")
+	}
+	if strings.HasPrefix(backup.Source, "-") {
+		return fmt.Errorf("invalid database name %q", backup.Source)
+	}
+	if d.Port != nil && (*d.Port < 1 || *d.Port > 65535) {
+		return fmt.Errorf("invalid database port %d", *d.Port)
+	}
+	if password != nil {
+		sealed, err := secrets.Seal(*password)
+		if err != nil {
+			return fmt.Errorf("failed to seal database password: %v", err)
+		}
+		d.SealedPassword = &sealed
+	}
+	return nil
+}
+
+// dumpName is the name the dump of a backup is stored under in its archive.
+func dumpName(backup db.Backup) string {
+	safe := func(s string) string {
+		return strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+	}
+	switch backup.SourceType {
+	case SourcePostgres:
+		if backup.Source == "" {
+			return "all-databases.sql"
+		}
+		return safe(backup.Source) + ".dump"
+	case SourceMySQL:
+		if backup.Source == "" {
+			return "all-databases.sql"
+		}
+		return safe(backup.Source) + ".sql"
+	case SourceSQLite:
+		return path.Base(backup.Source)
+	default:
+		return "dump.rdb"
+	}
+}
+
+// dumpScript returns the shell script that writes the dump of a backup to
+// stdout. The password is read from the first line of stdin, so it never
+// shows up in the process list or the environment of the SSH session.
+func dumpScript(backup db.Backup) (string, error) {
+	d := backup.Database
+	flag := func(name string, value *string) string {
+		if value == nil {
+			return ""
+		}
+		return " " + name + " " + shellQuote(*value)
+	}
+	var port *string
+	if d.Port != nil {
+		p := strconv.Itoa(*d.Port)
+		port = &p
+	}
+
+	var s strings.Builder
+	s.WriteString("set -e\nIFS= read -r password || true\n")
+	switch backup.SourceType {
+	case SourcePostgres:
+		s.WriteString(`if [ -n "$password" ]; then PGPASSWORD=$password; export PGPASSWORD; fi` + "\n")
+		conn := " -w" + flag("-h", d.Host) + flag("-p", port) + flag("-U", d.User)
+		if backup.Source == "" {
+			s.WriteString("exec pg_dumpall" + conn + "\n")
+		} else {
+			s.WriteString("exec pg_dump --format=custom" + conn + " " + shellQuote(backup.Source) + "\n")
+		}
+	case SourceMySQL:
+		s.WriteString(`if [ -n "$password" ]; then MYSQL_PWD=$password; export MYSQL_PWD; fi` + "\n")
+		conn := flag("-h", d.Host) + flag("-P", port) + flag("-u", d.User)
+		target := " --all-databases"
+		if backup.Source != "" {
+			target = " " + shellQuote(backup.Source)
+		}
+		s.WriteString("exec mysqldump --single-transaction --quick --routines --events --triggers" + conn + target + "\n")
+	case SourceSQLite:
+		// The online backup API copies a consistent snapshot while the
+		// database stays in use; sqlite3 would create a missing file instead
+		// of failing.
+		file := shellQuote(backup.Source)
+		fmt.Fprintf(&s, "[ -f %s ] || { echo %s >&2; exit 1; }\n", file, shellQuote(backup.Source+": no such file"))
+		s.WriteString("tmp=$(mktemp)\ntrap 'rm -f \"$tmp\"' EXIT\n")
+		fmt.Fprintf(&s, "sqlite3 %s \".backup '$tmp'\"\n", file)
+		s.WriteString("cat \"$tmp\"\n")
+	case SourceRedis:
+		// BGSAVE writes a new RDB file in the background; once LASTSAVE
+		// moves on, the file is complete and is read from the data directory
+		// of the server, which therefore must be the host the dump runs on.
+		s.WriteString(`if [ -n "$password" ]; then REDISCLI_AUTH=$password; export REDISCLI_AUTH; fi` + "\n")
+		fmt.Fprintf(&s, "cli() { redis-cli%s \"$@\"; }\n", flag("-h", d.Host)+flag("-p", port)+flag("--user", d.User))
+		fmt.Fprintf(&s, redisDump, int(redisSaveTimeout.Seconds()))
+	default:
+		return "", fmt.Errorf("unsupported source type: %s", backup.SourceType)
+	}
+	return s.String(), nil
+}
+
+// redisDump is the part of the Redis dump script after the connection setup.
+// It waits for BGSAVE up to the given number of seconds.
+const redisDump = `last=$(cli LASTSAVE)
+case "$last" in ''|*[!0-9]*) echo "redis: $last" >&2; exit 1;; esac
+if [ "$last" -ge "$(date +%%s)" ]; then sleep 1; fi
+reply=$(cli BGSAVE 2>&1) || true
+case "$reply" in *Background*) ;; *) echo "BGSAVE failed: $reply" >&2; exit 1;; esac
+i=0
+while [ "$(cli LASTSAVE)" = "$last" ]; do
+	i=$((i + 1))
+	if [ $i -gt %d ]; then echo 'BGSAVE did not finish in time' >&2; exit 1; fi
+	case "$(cli INFO persistence)" in
+	*rdb_bgsave_in_progress:0*rdb_last_bgsave_status:err*) echo 'BGSAVE failed, see the Redis log' >&2; exit 1;;
+	esac
+	sleep 1
+done
+dir=$(cli --raw CONFIG GET dir | sed -n 2p)
+file=$(cli --raw CONFIG GET dbfilename | sed -n 2p)
+cat "$dir/$file"
+`
+
+// stderrTail keeps the last output a script wrote to stderr.
+type stderrTail struct {
+	buf []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > maxScriptStderr {
+		t.buf = t.buf[len(t.buf)-maxScriptStderr:]
+	}
+	return len(p), nil
+}
+
+func (t *stderrTail) error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(string(t.buf)); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
+// scriptProcess is a running shell script. Its output is read from the
+// embedded reader; wait must be called once it is drained, abort when it is
+// not.
+type scriptProcess struct {
+	io.Reader
+	wait  func() error
+	abort func()
+}
+
+// sourceServer returns the server the source of a backup is read on, or nil
+// for this host.
+func sourceServer(backup db.Backup) (*db.Server, error) {
+	if backup.SourceServerID == nil {
+		return nil, nil
+	}
+	var server db.Server
+	if err := db.DB.First(&server, *backup.SourceServerID).Error; err != nil {
+		return nil, fmt.Errorf("source server %d not found", *backup.SourceServerID)
+	}
+	return &server, nil
+}
+
+// startScript starts a shell script on a remote server over SSH, or on this
+// host when server is nil, feeding it stdin. It follows pauses and
+// cancellation of the job; a nil job runs it to completion.
+func startScript(server *db.Server, job *jobControl, script string, stdin io.Reader) (*scriptProcess, error) {
+	stderr := &stderrTail{}
+	if server != nil {
+		if err := job.wait(); err != nil {
+			return nil, err
+		}
+		rc, err := openRemote(*server, job)
+		if err != nil {
+			return nil, err
+		}
+		session, err := rc.ssh.NewSession()
+		if err != nil {
+			rc.Close()
+			return nil, rc.err(fmt.Errorf("failed to create SSH session: %w", err))
+		}
+		session.Stdin = stdin
+		session.Stderr = stderr
+		out, err := session.StdoutPipe()
+		if err == nil {
+			err = session.Start("sh -c " + shellQuote(script))
+		}
+		if err != nil {
+			session.Close()
+			rc.Close()
+			return nil, rc.err(err)
+		}
+		return &scriptProcess{
+			Reader: out,
+			wait: func() error {
+				err := session.Wait()
+				session.Close()
+				rc.Close()
+				return rc.err(stderr.error(err))
+			},
+			abort: func() {
+				session.Close()
+				rc.Close()
+			},
+		}, nil
+	}
+
+	cmd := job.command("sh", "-c", script)
+	cmd.Stdin = stdin
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	done, err := job.start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptProcess{
+		Reader: out,
+		wait: func() error {
+			err := cmd.Wait()
+			done()
+			if err != nil && job.cancelled() {
+				return ErrCancelled
+			}
+			return stderr.error(err)
+		},
+		abort: func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			done()
+		},
+	}, nil
+}
+
+// runScript runs a shell script like startScript and returns its output.
+func runScript(server *db.Server, job *jobControl, script string) (string, error) {
+	proc, err := startScript(server, job, script, nil)
+	if err != nil {
+		return "", err
+	}
+	out, err := io.ReadAll(proc)
+	if err != nil {
+		proc.abort()
+		return "", err
+	}
+	return string(out), proc.wait()
+}
+
+// startDump starts the dump tool of a backup on its source server, or on this
+// host when it has none.
+func startDump(backup db.Backup, job *jobControl) (*scriptProcess, error) {
+	script, err := dumpScript(backup)
+	if err != nil {
+		return nil, err
+	}
+	var password string
+	if backup.Database.SealedPassword != nil {
+		if password, err = secrets.Open(*backup.Database.SealedPassword); err != nil {
+			return nil, fmt.Errorf("failed to open database password: %v", err)
+		}
+	}
+	server, err := sourceServer(backup)
+	if err != nil {
+		return nil, err
+	}
+	proc, err := startScript(server, job, script, strings.NewReader(password+"\n"))
+	if err != nil {
+		return nil, err
+	}
+	wait := proc.wait
+	proc.wait = func() error {
+		err := wait()
+		if err != nil && !errors.Is(err, ErrCancelled) {
+			return fmt.Errorf("database dump failed: %w", err)
+		}
+		return err
+	}
+	return proc, nil
+}
+
+// runDump stores a dump of the database or docker source of a backup as a
+// run. The dump is always complete, so there is nothing to scan beforehand.
+func (bs *BackupService) runDump(backup db.Backup, server db.Server, dest Destination, run *db.BackupRun, progress *db.BackupProgress) (int64, string, error) {
+	progress.TotalBytes = nil
+	progress.Progress = 0
+	progress.BytesProcessed = 0
+
+	ix := bs.newFileIndex(run)
+	size, checksum, err := bs.writeArchive(backup, server, dest, *run.ArchivePath, nil, ix, progress)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := ix.save(); err != nil {
+		return 0, "", fmt.Errorf("failed to save file index: %v", err)
+	}
+
+	progress.Progress = 100
+	progress.Message = "Backup completed successfully"
+	bs.BroadcastProgress(progress)
+	return size, checksum, nil
+}
+
+// writeDumpArchive runs the dump tool of a backup and writes its output to w
+// as the single entry of a tar or zip archive. Zip entries are streamed as
+// the dump is produced; a tar header needs the size up front, so for tar
+// archives the dump is spooled to a temporary file first.
+func (bs *BackupService) writeDumpArchive(w io.Writer, backup db.Backup, format archiveFormat, ix *fileIndex, progress *db.BackupProgress) error {
+	enc, err := encryptWriter(w, format.recipients)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %v", err)
+	}
+	defer enc.Close()
+
+	name := dumpName(backup)
+	progress.CurrentFile = &name
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Dumping %s database...", backup.SourceType))
+
+	dump, err := startDump(backup, bs.jobFor(progress))
+	if err != nil {
+		return err
+	}
+	tracker := bs.newProgressTracker(progress)
+	hash := sha256.New()
+	in := io.TeeReader(tracker.reader(dump), hash)
+	modTime := time.Now()
+
+	var size int64
+	if backup.FileType == "tar" {
+		size, err = writeTarDump(enc, dump, in, name, modTime, format)
+	} else {
+		size, err = writeZipDump(enc, dump, in, name, modTime, format)
+	}
+	if err != nil {
+		return err
+	}
+	ix.addEntry(name, size, modTime, hex.EncodeToString(hash.Sum(nil))).Mode = 0600
+	return enc.Close()
+}
+
+// writeTarDump spools the output of the dump, read through in, to a temporary
+// file and writes it as a tar entry once the dump tool has succeeded.
+func writeTarDump(w io.Writer, dump *scriptProcess, in io.Reader, name string, modTime time.Time, format archiveFormat) (int64, error) {
+	spool, err := os.CreateTemp("", "snaptrack-dump-*")
+	if err != nil {
+		dump.abort()
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, in)
+	if err != nil {
+		dump.abort()
+		return 0, err
+	}
+	if err := dump.wait(); err != nil {
+		return 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	cw, err := compressWriter(w, format.compression, format.level)
+	if err != nil {
+		return 0, err
+	}
+	defer cw.Close()
+	tw := tar.NewWriter(cw)
+	defer tw.Close()
+
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(tw, spool); err != nil {
+		return 0, err
+	}
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	return size, cw.Close()
+}
+
+// writeZipDump streams the output of the dump, read through in, into a zip
+// entry.
+func writeZipDump(w io.Writer, dump *scriptProcess, in io.Reader, name string, modTime time.Time, format archiveFormat) (int64, error) {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+	registerZipCompressors(zw, format)
+
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zipEntryMethod(name, format),
+		Modified: modTime,
+	}
+	header.SetMode(0600)
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		dump.abort()
+		return 0, err
+	}
+	size, err := io.Copy(entry, in)
+	if err != nil {
+		dump.abort()
+		return 0, err
+	}
+	if err := dump.wait(); err != nil {
+		return 0, err
+	}
+	return size, zw.Close()
+}
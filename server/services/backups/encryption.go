@@ -0,0 +1,236 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"snaptrack/db"
+	"snaptrack/services/secrets"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ErrKeyRequired is returned when an encrypted run cannot be decrypted with
+// the key stored for its backup.
+var ErrKeyRequired = errors.New("encryption key required")
+
+func encrypted(mode string) bool { return mode != "" && mode != "none" }
+
+// ConfigureEncryption validates the encryption settings of a backup and seals
+// the given secret, a passphrase or an age identity (AGE-SECRET-KEY-1...),
+// with the master key. Only the sealed form is ever stored. Without a secret
+// the previously sealed key is kept while the mode stays the same; a key
+// sealed for the previous mode is dropped, so passphrase encryption then
+// needs a new passphrase.
+func ConfigureEncryption(backup *db.Backup, previous string, secret *string) error {
+	if backup.Encryption == "" {
+		backup.Encryption = "none"
+	}
+	if previous == "" {
+		previous = "none"
+	}
+	if backup.Encryption != previous {
+		backup.SealedKey = nil
+	}
+	if secret != nil && strings.TrimSpace(*secret) == "" {
+		secret = nil
+	}
+
+	switch backup.Encryption {
+	case "none":
+		backup.SealedKey = nil
+		return nil
+	case "passphrase":
+		if secret == nil && backup.SealedKey == nil {
+			return errors.New("a passphrase is required for passphrase encryption")
+		}
+	case "age":
+		var recipients []string
+		if backup.Recipients != nil {
+			parsed, err := age.ParseRecipients(strings.NewReader(*backup.Recipients))
+			if err != nil && strings.TrimSpace(*backup.Recipients) != "" {
+				return fmt.Errorf("invalid age recipients: %v", err)
+			}
+			for _, r := range parsed {
+				if x, ok := r.(*age.X25519Recipient); ok {
+					recipients = append(recipients, x.String())
+				}
+			}
+		}
+		if secret != nil {
+			identity, err := age.ParseX25519Identity(strings.TrimSpace(*secret))
+			if err != nil {
+				return fmt.Errorf("invalid age identity: %v", err)
+			}
+			own := identity.Recipient().String()
+			found := false
+			for _, r := range recipients {
+				found = found || r == own
+			}
+			if !found {
+				recipients = append(recipients, own)
+			}
+		}
+		if len(recipients) == 0 {
+			return errors.New("at least one age recipient is required")
+		}
+		list := strings.Join(recipients, "\n")
+		backup.Recipients = &list
+	default:
+		return fmt.Errorf("unsupported encryption mode: %s", backup.Encryption)
+	}
+
+	if backup.FileType == "raw" {
+		return errors.New("raw backups cannot be encrypted")
+	}
+	if secret != nil {
+		sealed, err := secrets.Seal(strings.TrimSpace(*secret))
+		if err != nil {
+			return fmt.Errorf("failed to seal encryption key: %v", err)
+		}
+		backup.SealedKey = &sealed
+	}
+	return nil
+}
+
+// encryptionRecipients returns who the archives of a backup are encrypted to,
+// or nil when encryption is disabled.
+func encryptionRecipients(backup db.Backup) ([]age.Recipient, error) {
+	switch backup.Encryption {
+	case "", "none":
+		return nil, nil
+	case "passphrase":
+		if backup.SealedKey == nil {
+			return nil, errors.New("backup has no passphrase")
+		}
+		passphrase, err := secrets.Open(*backup.SealedKey)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	case "age":
+		if backup.Recipients == nil {
+			return nil, errors.New("backup has no age recipients")
+		}
+		return age.ParseRecipients(strings.NewReader(*backup.Recipients))
+	}
+	return nil, fmt.Errorf("unsupported encryption mode: %s", backup.Encryption)
+}
+
+// decryptionIdentities returns the identities able to decrypt a run: the key
+// sealed for the backup, if it still uses the run's mode, and a passphrase or
+// age identity supplied by the caller.
+func decryptionIdentities(backup db.Backup, run db.BackupRun, supplied string) ([]age.Identity, error) {
+	if !encrypted(run.Encryption) {
+		return nil, nil
+	}
+
+	var keys []string
+	if s := strings.TrimSpace(supplied); s != "" {
+		keys = append(keys, s)
+	}
+	if backup.Encryption == run.Encryption && backup.SealedKey != nil {
+		key, err := secrets.Open(*backup.SealedKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	var ids []age.Identity
+	for _, key := range keys {
+		if run.Encryption == "passphrase" {
+			id, err := age.NewScryptIdentity(key)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+			continue
+		}
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age identity: %v", err)
+		}
+		ids = append(ids, parsed...)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: run %d is encrypted with %s", ErrKeyRequired, run.ID, run.Encryption)
+	}
+	return ids, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptWriter wraps w so that everything written is encrypted to the
+// recipients. Close must be called to flush the last chunk. Without
+// recipients the data is passed through unchanged.
+func encryptWriter(w io.Writer, recipients []age.Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+type archiveReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r archiveReader) Close() error { return r.f.Close() }
+
+// openArchive opens an archive file, decrypting it on the fly when the run
+// that wrote it was encrypted.
+func openArchive(path string, run db.BackupRun, ids []age.Identity) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted(run.Encryption) {
+		return f, nil
+	}
+	r, err := age.Decrypt(f, ids...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decrypt archive of run %d: %v", run.ID, err)
+	}
+	return archiveReader{Reader: r, f: f}, nil
+}
+
+// plainArchivePath returns a path to the unencrypted archive. Zip readers
+// need random access, so encrypted archives are decrypted into a temporary
+// file that cleanup removes.
+func plainArchivePath(path string, run db.BackupRun, ids []age.Identity) (string, func(), error) {
+	noop := func() {}
+	if !encrypted(run.Encryption) {
+		return path, noop, nil
+	}
+	r, err := openArchive(path, run, ids)
+	if err != nil {
+		return "", noop, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "decrypted-*")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", noop, fmt.Errorf("failed to decrypt archive of run %d: %v", run.ID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -0,0 +1,325 @@
+package backups
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"snaptrack/db"
+	"strings"
+	"time"
+)
+
+// IgnoreFileName is read from every directory of a source tree. It uses a
+// subset of the .gitignore syntax: one glob per line, # comments, a leading !
+// re-includes, a leading / anchors to the directory of the file, a trailing /
+// matches directories only and ** matches across directories.
+const IgnoreFileName = ".snaptrackignore"
+
+// globRule is one compiled include, exclude or ignore-file pattern.
+type globRule struct {
+	re       *regexp.Regexp
+	anchored bool // match the path relative to the rule's base, not just the name
+	dirOnly  bool
+	negate   bool
+}
+
+// compileGlob turns a glob into a rule. Patterns without a slash match the
+// name of an entry at any depth; others match the path from the base.
+func compileGlob(pattern string) (globRule, error) {
+	var r globRule
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		r.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	if pattern == "" {
+		return r, fmt.Errorf("empty pattern")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return r, fmt.Errorf("unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return r, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+func (r globRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return r.re.MatchString(rel)
+	}
+	return r.re.MatchString(path.Base(rel))
+}
+
+func compileGlobs(patterns []string) ([]globRule, error) {
+	var rules []globRule
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		r, err := compileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		if r.negate {
+			return nil, fmt.Errorf("negated pattern %q is only allowed in %s", p, IgnoreFileName)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// ValidateFilters checks the include/exclude patterns and limits of a backup.
+func ValidateFilters(backup db.Backup) error {
+	if _, err := compileGlobs(backup.Includes); err != nil {
+		return fmt.Errorf("includes: %v", err)
+	}
+	if _, err := compileGlobs(backup.Excludes); err != nil {
+		return fmt.Errorf("excludes: %v", err)
+	}
+	if backup.MinFileSize < 0 || backup.MaxFileSize < 0 || backup.SkipRecentSec < 0 {
+		return fmt.Errorf("file size and age limits must not be negative")
+	}
+	if backup.MaxFileSize > 0 && backup.MinFileSize > backup.MaxFileSize {
+		return fmt.Errorf("min_file_size must not exceed max_file_size")
+	}
+	return nil
+}
+
+// fileFilter decides which entries below a backup source are backed up.
+// Sockets, devices and named pipes are always skipped.
+type fileFilter struct {
+	includes []globRule
+	excludes []globRule
+	minSize  int64
+	maxSize  int64
+	cutoff   time.Time             // files modified after this are skipped
+	ignores  map[string][]globRule // ignore-file rules by directory
+	job      *jobControl           // pauses and cancels walks, may be nil
+}
+
+func newFileFilter(backup db.Backup) (*fileFilter, error) {
+	f := &fileFilter{
+		minSize: backup.MinFileSize,
+		maxSize: backup.MaxFileSize,
+		ignores: make(map[string][]globRule),
+	}
+	var err error
+	if f.includes, err = compileGlobs(backup.Includes); err != nil {
+		return nil, fmt.Errorf("includes: %v", err)
+	}
+	if f.excludes, err = compileGlobs(backup.Excludes); err != nil {
+		return nil, fmt.Errorf("excludes: %v", err)
+	}
+	if backup.SkipRecentSec > 0 {
+		f.cutoff = time.Now().Add(-time.Duration(backup.SkipRecentSec) * time.Second)
+	}
+	return f, nil
+}
+
+// loadIgnoreFile reads the ignore file of a directory, if there is one.
+func (f *fileFilter) loadIgnoreFile(dir, rel string) error {
+	file, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return f.readIgnoreRules(file, rel)
+}
+
+// readIgnoreRules parses the ignore file of the directory rel.
+func (f *fileFilter) readIgnoreRules(r io.Reader, rel string) error {
+	var rules []globRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := compileGlob(line)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filepath.Join(rel, IgnoreFileName), err)
+		}
+		rules = append(rules, r)
+	}
+	if len(rules) > 0 {
+		f.ignores[rel] = rules
+	}
+	return scanner.Err()
+}
+
+// ignored applies the ignore files of all ancestor directories; the last
+// matching rule wins, so deeper files override shallower ones.
+func (f *fileFilter) ignored(rel string, isDir bool) bool {
+	ignored := false
+	dir := rel
+	var chain []string
+	for dir != "." {
+		dir = path.Dir(dir)
+		chain = append(chain, dir)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		base := chain[i]
+		sub := rel
+		if base != "." {
+			sub = strings.TrimPrefix(rel, base+"/")
+		}
+		for _, r := range f.ignores[base] {
+			if r.match(sub, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// skip reports whether an entry is left out. For a directory it means the
+// whole subtree is skipped.
+func (f *fileFilter) skip(rel string, info os.FileInfo) bool {
+	rel = filepath.ToSlash(rel)
+	mode := info.Mode()
+	if mode&(os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe) != 0 {
+		return true
+	}
+	if rel == "." {
+		return false
+	}
+	isDir := info.IsDir()
+	for _, r := range f.excludes {
+		if r.match(rel, isDir) {
+			return true
+		}
+	}
+	if f.ignored(rel, isDir) {
+		return true
+	}
+	if isDir {
+		return false
+	}
+
+	if len(f.includes) > 0 {
+		matched := false
+		for _, r := range f.includes {
+			if r.match(rel, false) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return true
+		}
+	}
+	if mode.IsRegular() {
+		if f.minSize > 0 && info.Size() < f.minSize {
+			return true
+		}
+		if f.maxSize > 0 && info.Size() > f.maxSize {
+			return true
+		}
+		if !f.cutoff.IsZero() && info.ModTime().After(f.cutoff) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk is filepath.Walk over the entries the filter keeps. fn receives the
+// path relative to source as well. The walk waits while the job of the filter
+// is paused and ends with ErrCancelled once it is cancelled.
+func (f *fileFilter) walk(source string, fn func(path, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := f.job.wait(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		if f.skip(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := f.loadIgnoreFile(p, filepath.ToSlash(rel)); err != nil {
+				return err
+			}
+		}
+		return fn(p, rel, info)
+	})
+}
+
+// totalSize sums the size of the files the filter keeps.
+func (f *fileFilter) totalSize(source string) (int64, error) {
+	var total int64
+	err := f.walk(source, func(_, _ string, info os.FileInfo) error {
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
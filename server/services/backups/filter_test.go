@@ -0,0 +1,147 @@
+package backups
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "x.log", false, true},
+		{"*.log", "a/b/x.log", false, true},
+		{"*.log", "a/x.log.gz", false, false},
+		{"*.log", "a.log/x", false, false},
+		{"a.b", "axb", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "docs/sub/a.md", false, false},
+		{"**/node_modules", "node_modules", true, true},
+		{"**/node_modules", "a/b/node_modules", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "ab/b", false, false},
+		{"logs/**", "logs/x/y", false, true},
+		{"logs/**", "logs", true, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"[abc].txt", "b.txt", false, true},
+		{"[abc].txt", "d.txt", false, false},
+		{"[!abc].txt", "d.txt", false, true},
+		{"[!abc].txt", "a.txt", false, false},
+		{"[a-c]*", "cat", false, true},
+		{`\*.txt`, "*.txt", false, true},
+		{`\*.txt`, "a.txt", false, false},
+		{"!*.tmp", "x.tmp", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.rel, func(t *testing.T) {
+			r, err := compileGlob(tt.pattern)
+			if err != nil {
+				t.Fatalf("compileGlob(%q): %v", tt.pattern, err)
+			}
+			if r.negate != strings.HasPrefix(tt.pattern, "!") {
+				t.Errorf("negate = %v", r.negate)
+			}
+			if got := r.match(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("match(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileGlobErrors(t *testing.T) {
+	for _, pattern := range []string{"!", "/", "[abc", "a/[b"} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("compileGlob(%q) succeeded", pattern)
+		}
+	}
+	if _, err := compileGlobs([]string{"*.tmp", "!keep.tmp"}); err == nil {
+		t.Error("compileGlobs accepted a negated pattern")
+	}
+	rules, err := compileGlobs([]string{"", "  ", "*.tmp"})
+	if err != nil || len(rules) != 1 {
+		t.Errorf("compileGlobs = %d rules, %v; want 1 rule", len(rules), err)
+	}
+}
+
+// fakeInfo is the os.FileInfo of an entry that does not exist on disk.
+type fakeInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi fakeInfo) Name() string       { return fi.name }
+func (fi fakeInfo) Size() int64        { return fi.size }
+func (fi fakeInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeInfo) Sys() any           { return nil }
+
+func TestFileFilterSkip(t *testing.T) {
+	cutoff := time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC)
+	f := &fileFilter{minSize: 10, maxSize: 1000, cutoff: cutoff, ignores: make(map[string][]globRule)}
+	var err error
+	if f.includes, err = compileGlobs([]string{"*.go", "*.md"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.excludes, err = compileGlobs([]string{"*.tmp", "cache/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.readIgnoreRules(strings.NewReader("# docs\n*.md\n!README.md\nvendor/\n"), "."); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.readIgnoreRules(strings.NewReader("!*.md\n/old.go\n"), "docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := cutoff.Add(-time.Hour)
+	file := func(size int64) fakeInfo { return fakeInfo{size: size, modTime: old} }
+	dir := fakeInfo{mode: os.ModeDir | 0o755, modTime: old}
+	tests := []struct {
+		rel  string
+		info fakeInfo
+		want bool
+	}{
+		{".", dir, false},
+		{"src", dir, false},
+		{"main.go", file(100), false},
+		{"main.tmp", file(100), true},
+		{"cache", dir, true},
+		{"src/cache", dir, true},
+		{"notes.txt", file(100), true},
+		{"CHANGES.md", file(100), true},
+		{"README.md", file(100), false},
+		{"docs/guide.md", file(100), false},
+		{"docs/old.go", file(100), true},
+		{"docs/sub/old.go", file(100), false},
+		{"vendor", dir, true},
+		{"small.go", file(5), true},
+		{"big.go", file(5000), true},
+		{"new.go", fakeInfo{size: 100, modTime: cutoff.Add(time.Minute)}, true},
+		{"sock.go", fakeInfo{mode: os.ModeSocket, modTime: old}, true},
+		{"fifo.go", fakeInfo{mode: os.ModeNamedPipe, modTime: old}, true},
+		{"link.go", fakeInfo{mode: os.ModeSymlink, modTime: old}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			tt.info.name = path.Base(tt.rel)
+			if got := f.skip(tt.rel, tt.info); got != tt.want {
+				t.Errorf("skip(%q) = %v, want %v", tt.rel, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package backups
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"path"
+	"snaptrack/db"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// FTP servers are given as host[:port]; ftps:// selects explicit TLS.
+
+// ftpAddress parses the host of an FTP server into its address and whether
+// TLS is used.
+func ftpAddress(host string) (string, bool, error) {
+	host = strings.TrimSpace(host)
+	secure := false
+	switch {
+	case strings.HasPrefix(host, "ftps://"):
+		secure = true
+		host = strings.TrimPrefix(host, "ftps://")
+	case strings.HasPrefix(host, "ftp://"):
+		host = strings.TrimPrefix(host, "ftp://")
+	case strings.Contains(host, "://"):
+		return "", false, fmt.Errorf("invalid FTP host %q: use ftp:// or ftps://", host)
+	}
+	host = strings.TrimSuffix(host, "/")
+	if host == "" || strings.Contains(host, "/") {
+		return "", false, fmt.Errorf("invalid FTP host %q", host)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "21")
+	}
+	return host, secure, nil
+}
+
+// ftpDestination is a logged in FTP control connection. It carries one
+// transfer at a time.
+type ftpDestination struct {
+	server db.Server
+	conn   *ftp.ServerConn
+	job    *jobControl
+	stop   func() bool
+}
+
+func openFTP(server db.Server, job *jobControl) (*ftpDestination, error) {
+	addr, secure, err := ftpAddress(server.Host)
+	if err != nil {
+		return nil, err
+	}
+	user, password, err := openPassword(server)
+	if err != nil {
+		return nil, err
+	}
+	opts := []ftp.DialOption{ftp.DialWithTimeout(10 * time.Second), ftp.DialWithContext(job.context())}
+	if secure {
+		hostname, _, _ := net.SplitHostPort(addr)
+		opts = append(opts, ftp.DialWithExplicitTLS(&tls.Config{ServerName: hostname}))
+	}
+	conn, err := ftp.Dial(addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", server.Name, err)
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("login to %s failed: %w", server.Name, err)
+	}
+	d := &ftpDestination{server: server, conn: conn, job: job}
+	// Closing the connection makes a blocked transfer return
+	d.stop = context.AfterFunc(job.context(), func() { conn.Quit() })
+	return d, nil
+}
+
+// err maps the errors of FTP commands: missing files to fs.ErrNotExist and
+// any failure of a cancelled job to ErrCancelled.
+func (d *ftpDestination) err(err error) error {
+	if err == nil {
+		return nil
+	}
+	if d.job.cancelled() {
+		return ErrCancelled
+	}
+	var proto *textproto.Error
+	if errors.As(err, &proto) {
+		switch proto.Code {
+		case ftp.StatusFileUnavailable:
+			return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+		case ftp.Status452, ftp.StatusExceededStorage:
+			return fmt.Errorf("no space left on %s: %v", d.server.Name, err)
+		}
+	}
+	return err
+}
+
+// mkdirAll creates the directories of dir; existing ones make MKD fail,
+// which is ignored.
+func (d *ftpDestination) mkdirAll(dir string) {
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		d.conn.MakeDir(current)
+	}
+}
+
+// Create stores the object under a partial name; Commit renames it into
+// place.
+func (d *ftpDestination) Create(name string) (ObjectWriter, error) {
+	d.mkdirAll(path.Dir(name))
+	part := partialPath(name, "upload")
+	pr, pw := io.Pipe()
+	w := &ftpWriter{d: d, name: name, part: part, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := d.err(d.conn.Stor(part, pr))
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type ftpWriter struct {
+	d    *ftpDestination
+	name string
+	part string
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *ftpWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *ftpWriter) Commit() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		w.d.conn.Delete(w.part)
+		return fmt.Errorf("upload to %s failed: %w", w.d.server.Name, err)
+	}
+	// Not every server replaces an existing file on rename
+	w.d.conn.Delete(w.name)
+	return w.d.err(w.d.conn.Rename(w.part, w.name))
+}
+
+func (w *ftpWriter) Abort() {
+	w.pw.CloseWithError(errors.New("upload aborted"))
+	<-w.done
+	w.d.conn.Delete(w.part)
+}
+
+func (d *ftpDestination) Open(name string) (io.ReadCloser, error) {
+	resp, err := d.conn.Retr(name)
+	if err != nil {
+		return nil, d.err(err)
+	}
+	return ftpReader{Reader: jobReader{r: resp, job: d.job}, resp: resp}, nil
+}
+
+type ftpReader struct {
+	io.Reader
+	resp *ftp.Response
+}
+
+func (r ftpReader) Close() error {
+	return r.resp.Close()
+}
+
+// Stat looks the entry up in the listing of its parent, which every server
+// supports.
+func (d *ftpDestination) Stat(name string) (ObjectInfo, error) {
+	list, err := d.List(path.Dir(name))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	for _, info := range list {
+		if path.Base(info.Name) == path.Base(name) {
+			info.Name = name
+			return info, nil
+		}
+	}
+	return ObjectInfo{}, fmt.Errorf("%w: %s on %s", fs.ErrNotExist, name, d.server.Name)
+}
+
+func (d *ftpDestination) List(dir string) ([]ObjectInfo, error) {
+	entries, err := d.conn.List(dir)
+	if err != nil {
+		return nil, d.err(err)
+	}
+	list := make([]ObjectInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." || e.Type == ftp.EntryTypeLink {
+			continue
+		}
+		list = append(list, ObjectInfo{
+			Name:    path.Join(dir, path.Base(e.Name)),
+			Size:    int64(e.Size),
+			ModTime: e.Time,
+			IsDir:   e.Type == ftp.EntryTypeFolder,
+		})
+	}
+	return list, nil
+}
+
+func (d *ftpDestination) Delete(name string) error {
+	return d.err(d.conn.Delete(name))
+}
+
+func (d *ftpDestination) Close() error {
+	d.stop()
+	return d.conn.Quit()
+}
@@ -0,0 +1,145 @@
+package backups
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"snaptrack/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// ErrHostKeyUnknown is returned when connecting to a server whose host
+	// key is neither pinned nor listed in known_hosts.
+	ErrHostKeyUnknown = errors.New("unknown SSH host key")
+	// ErrHostKeyMismatch is returned when a server presents another host
+	// key than the one it is known by.
+	ErrHostKeyMismatch = errors.New("SSH host key mismatch")
+)
+
+// knownHostsFile is checked for servers without a pinned host key:
+// SSH_KNOWN_HOSTS, or ~/.ssh/known_hosts.
+func knownHostsFile() string {
+	if p := os.Getenv("SSH_KNOWN_HOSTS"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+func pinnedHostKey(server db.Server) bool {
+	return server.HostKey != nil && strings.TrimSpace(*server.HostKey) != ""
+}
+
+// parseHostKey parses a host key in authorized_keys format, such as the
+// output of ssh-keyscan without the host name.
+func parseHostKey(s string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(s)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %v", err)
+	}
+	return key, nil
+}
+
+// HostKeyCallback verifies the host key of a remote server against its
+// pinned key, or against known_hosts when none is pinned.
+func HostKeyCallback(server db.Server) (ssh.HostKeyCallback, error) {
+	if pinnedHostKey(server) {
+		want, err := parseHostKey(*server.HostKey)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", server.Name, err)
+		}
+		return func(host string, remote net.Addr, got ssh.PublicKey) error {
+			if !bytes.Equal(got.Marshal(), want.Marshal()) {
+				return fmt.Errorf("%w: %s presented %s, pinned is %s", ErrHostKeyMismatch,
+					server.Name, ssh.FingerprintSHA256(got), ssh.FingerprintSHA256(want))
+			}
+			return nil
+		}, nil
+	}
+
+	file := knownHostsFile()
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: server %s has no pinned host key and %s cannot be read: %v", ErrHostKeyUnknown, server.Name, file, err)
+	}
+	return func(host string, remote net.Addr, got ssh.PublicKey) error {
+		err := check(host, remote, got)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("%w: %s (%s) is not in %s and has no pinned host key", ErrHostKeyUnknown,
+				host, ssh.FingerprintSHA256(got), file)
+		}
+		return fmt.Errorf("%w: %s presented %s, which is not the key in %s", ErrHostKeyMismatch,
+			host, ssh.FingerprintSHA256(got), file)
+	}, nil
+}
+
+// scanHostKey reads the host key a server presents, without logging in.
+func scanHostKey(addr string) (ssh.PublicKey, net.Addr, error) {
+	var key ssh.PublicKey
+	var remote net.Addr
+	config := &ssh.ClientConfig{
+		User: "snaptrack",
+		HostKeyCallback: func(host string, r net.Addr, k ssh.PublicKey) error {
+			key, remote = k, r
+			return errors.New("host key scanned")
+		},
+		Timeout: 10 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", addr, config)
+	if client != nil {
+		client.Close()
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("cannot read the host key of %s: %v", addr, err)
+	}
+	return key, remote, nil
+}
+
+// PinHostKey pins the host key a remote server presents when it is saved,
+// trusting it on first use, unless a key is pinned already or known_hosts
+// lists the server. Backups and restores only connect to servers whose key
+// matches.
+func PinHostKey(server *db.Server) error {
+	if pinnedHostKey(*server) {
+		_, err := parseHostKey(*server.HostKey)
+		return err
+	}
+	if server.SSHPort == nil {
+		return fmt.Errorf("missing SSH port")
+	}
+	addr := net.JoinHostPort(server.Host, strconv.Itoa(*server.SSHPort))
+	key, remote, err := scanHostKey(addr)
+	if err != nil {
+		return err
+	}
+	if check, err := knownhosts.New(knownHostsFile()); err == nil {
+		err := check(addr, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return fmt.Errorf("%w: %s presented %s, which is not the key in %s", ErrHostKeyMismatch,
+				addr, ssh.FingerprintSHA256(key), knownHostsFile())
+		}
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	server.HostKey = &line
+	return nil
+}
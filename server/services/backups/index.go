@@ -0,0 +1,222 @@
+package backups
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"snaptrack/db"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// fileIndex builds the file index of a run while the source is walked and,
+// for incremental runs, decides which files can be skipped because they are
+// unchanged since the parent run.
+type fileIndex struct {
+	run     *db.BackupRun
+	prev    map[string]db.RunFile
+	seen    map[string]bool
+	entries []db.RunFile
+	names   map[string]string // user and group names by "u<uid>" / "g<gid>"
+}
+
+// newFileIndex prepares the index for a run. Incremental runs load the index
+// of their parent run to detect unchanged and deleted files.
+func (bs *BackupService) newFileIndex(run *db.BackupRun) *fileIndex {
+	ix := &fileIndex{
+		run:   run,
+		seen:  make(map[string]bool),
+		names: make(map[string]string),
+	}
+	if run.ParentRunID == nil {
+		return ix
+	}
+
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", *run.ParentRunID, false).Find(&files).Error; err != nil {
+		// Without the parent index every file is stored again
+		run.Type = "full"
+		run.ParentRunID = nil
+		db.DB.Save(run)
+		return ix
+	}
+	ix.prev = make(map[string]db.RunFile, len(files))
+	for _, f := range files {
+		ix.prev[f.Path] = f
+	}
+	return ix
+}
+
+// indexTime normalises a modification time to the precision Postgres keeps.
+func indexTime(t time.Time) time.Time { return t.UTC().Truncate(time.Microsecond) }
+
+func (ix *fileIndex) incremental() bool { return ix.prev != nil }
+
+// unchanged reports whether the file matches the parent run by size and
+// modification time. Matching files are carried over into this run's index;
+// their mode and owner are taken from the walk, as they may have changed.
+func (ix *fileIndex) unchanged(rel string, info os.FileInfo) bool {
+	prev, ok := ix.prev[rel]
+	if !ok || prev.Size != info.Size() || !prev.ModTime.Equal(indexTime(info.ModTime())) {
+		return false
+	}
+	ix.seen[rel] = true
+	mode, owner := ix.fileMeta(info)
+	ix.entries = append(ix.entries, db.RunFile{
+		Path:        rel,
+		Size:        prev.Size,
+		Mode:        mode,
+		ModTime:     prev.ModTime,
+		Owner:       owner,
+		SHA256:      prev.SHA256,
+		StoredRunID: prev.StoredRunID,
+	})
+	return true
+}
+
+// add records a file whose content is stored in this run.
+func (ix *fileIndex) add(rel string, info os.FileInfo, sum string) *db.RunFile {
+	entry := ix.addEntry(rel, info.Size(), info.ModTime(), sum)
+	entry.Mode, entry.Owner = ix.fileMeta(info)
+	return entry
+}
+
+// addEntry records content stored in this run that was not read from a file,
+// such as a database dump. The entry stays valid until the next one is added.
+func (ix *fileIndex) addEntry(rel string, size int64, modTime time.Time, sum string) *db.RunFile {
+	ix.seen[rel] = true
+	ix.entries = append(ix.entries, db.RunFile{
+		Path:        rel,
+		Size:        size,
+		ModTime:     indexTime(modTime),
+		SHA256:      sum,
+		StoredRunID: ix.run.ID,
+	})
+	return &ix.entries[len(ix.entries)-1]
+}
+
+// fileMeta returns the permission bits and the owner ("user:group") of a
+// file. Users and groups without a name are given by their numeric ID.
+func (ix *fileIndex) fileMeta(info os.FileInfo) (uint32, string) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return uint32(info.Mode().Perm()), ""
+	}
+	return st.Mode & 07777, ix.lookupName("u", st.Uid) + ":" + ix.lookupName("g", st.Gid)
+}
+
+func (ix *fileIndex) lookupName(kind string, id uint32) string {
+	key := kind + strconv.FormatUint(uint64(id), 10)
+	if name, ok := ix.names[key]; ok {
+		return name
+	}
+	name := strconv.FormatUint(uint64(id), 10)
+	if kind == "u" {
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+	} else if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+	ix.names[key] = name
+	return name
+}
+
+// scan indexes the source tree without archiving it, hashing only files that
+// changed since the parent run. It is used when another tool moves the data.
+func (ix *fileIndex) scan(source string, filter *fileFilter) error {
+	return filter.walk(source, func(path, rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if ix.unchanged(rel, info) {
+			return nil
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		ix.add(rel, info, sum)
+		return nil
+	})
+}
+
+// deleted returns the files of the parent run that no longer exist.
+func (ix *fileIndex) deleted() []string {
+	var paths []string
+	for path := range ix.prev {
+		if !ix.seen[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// save writes the index, including tombstones for deleted files.
+func (ix *fileIndex) save() error {
+	for _, path := range ix.deleted() {
+		ix.entries = append(ix.entries, db.RunFile{
+			Path:        path,
+			StoredRunID: ix.run.ID,
+			Deleted:     true,
+		})
+	}
+	for i := range ix.entries {
+		ix.entries[i].RunID = ix.run.ID
+	}
+	if len(ix.entries) == 0 {
+		return nil
+	}
+	return db.DB.CreateInBatches(ix.entries, 500).Error
+}
+
+// treeChecksum is the checksum of a raw backup: the SHA-256 of its file list,
+// one "sum  path" line per file in path order. Tombstones are left out.
+func treeChecksum(files []db.RunFile) string {
+	list := make([]db.RunFile, 0, len(files))
+	for _, f := range files {
+		if !f.Deleted {
+			list = append(list, f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	hash := sha256.New()
+	for _, f := range list {
+		fmt.Fprintf(hash, "%s  %s\n", f.SHA256, f.Path)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyFile streams a file into w, reporting progress and returning the
+// SHA-256 of its content.
+func copyFile(path string, w io.Writer, tracker *progressTracker) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), tracker.reader(in)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
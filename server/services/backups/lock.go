@@ -0,0 +1,164 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrRunLocked is returned when removing a locked run or something that
+	// would take its archive with it. The error names the lock reason.
+	ErrRunLocked = errors.New("run is locked")
+	// ErrInvalidLock is returned for lock requests that lock nothing.
+	ErrInvalidLock = errors.New("invalid lock")
+	// ErrNotLocked is returned when unlocking a run without a legal hold.
+	ErrNotLocked = errors.New("run is not under legal hold")
+)
+
+// RunLock locks a run: a legal hold keeps it until the hold is released, a
+// date keeps it until then. Both may be set.
+type RunLock struct {
+	LegalHold bool       `json:"legal_hold"`
+	Until     *time.Time `json:"until"`
+	Reason    string     `json:"reason"`
+}
+
+// lockError describes the lock of a run, or returns nil when the run is not
+// locked.
+func lockError(run db.BackupRun) error {
+	reason := ""
+	if run.LockReason != nil {
+		reason = ": " + *run.LockReason
+	}
+	switch {
+	case run.LegalHold:
+		return fmt.Errorf("%w: run %d is under legal hold%s", ErrRunLocked, run.ID, reason)
+	case run.LockedUntil != nil && run.LockedUntil.After(time.Now()):
+		return fmt.Errorf("%w: run %d is locked until %s%s", ErrRunLocked, run.ID, run.LockedUntil.Format(time.RFC3339), reason)
+	}
+	return nil
+}
+
+// firstLocked returns the lock error of the first locked run of the query.
+func firstLocked(query *gorm.DB) error {
+	var run db.BackupRun
+	err := query.Where("(legal_hold = ? OR locked_until > ?)", true, time.Now()).Order("id").First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lockError(run)
+}
+
+// CheckRunsUnlocked returns an ErrRunLocked error when one of the runs is
+// locked.
+func CheckRunsUnlocked(runIDs []uint) error {
+	if len(runIDs) == 0 {
+		return nil
+	}
+	return firstLocked(db.DB.Where("id IN ?", runIDs))
+}
+
+// CheckBackupUnlocked returns an ErrRunLocked error when a run of the backup
+// is locked.
+func CheckBackupUnlocked(backupID uint) error {
+	return firstLocked(db.DB.Where("backup_id = ?", backupID))
+}
+
+// LockRun locks a completed run against pruning and deletion. Runs of raw
+// backups have no data of their own to protect. Locks only ever add
+// protection: a legal hold stays until UnlockRun, and the date of a
+// time lock can be moved later but not earlier.
+func (bs *BackupService) LockRun(backup db.Backup, runID uint, lock RunLock, lockedBy string) (*db.BackupRun, error) {
+	if !lock.LegalHold && lock.Until == nil {
+		return nil, fmt.Errorf("%w: legal_hold or until is required", ErrInvalidLock)
+	}
+	if lock.Reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", ErrInvalidLock)
+	}
+	now := time.Now()
+	if lock.Until != nil && !lock.Until.After(now) {
+		return nil, fmt.Errorf("%w: until must be in the future", ErrInvalidLock)
+	}
+
+	var run db.BackupRun
+	if err := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed").First(&run, runID).Error; err != nil {
+		return nil, fmt.Errorf("%w: no completed run %d of backup %d", ErrRunNotFound, runID, backup.ID)
+	}
+	if backup.FileType == "raw" {
+		// All runs share the mirror, which the next run overwrites
+		return nil, fmt.Errorf("%w: runs of raw backups cannot be locked, the next run overwrites their mirror", ErrInvalidLock)
+	}
+	if lock.Until != nil && run.LockedUntil != nil && lock.Until.Before(*run.LockedUntil) {
+		return nil, fmt.Errorf("%w: run %d is locked until %s, the lock can only be extended",
+			ErrRunLocked, run.ID, run.LockedUntil.Format(time.RFC3339))
+	}
+
+	run.LegalHold = run.LegalHold || lock.LegalHold
+	if lock.Until != nil {
+		run.LockedUntil = lock.Until
+	}
+	run.LockReason = &lock.Reason
+	run.LockedBy = &lockedBy
+	run.LockedAt = &now
+	if err := db.DB.Model(&run).Select("LegalHold", "LockedUntil", "LockReason", "LockedBy", "LockedAt").Updates(&run).Error; err != nil {
+		return nil, err
+	}
+
+	logs.NewLogService(db.DB).Info(
+		fmt.Sprintf("Run %d of backup %s was locked by %s: %s", run.ID, backup.Name, lockedBy, lock.Reason),
+		logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+			"action":       "lock",
+			"run_id":       run.ID,
+			"legal_hold":   run.LegalHold,
+			"locked_until": run.LockedUntil,
+			"reason":       lock.Reason,
+			"user":         lockedBy,
+		})
+	return &run, nil
+}
+
+// UnlockRun releases the legal hold of a run. A time lock that has not
+// expired stays in place.
+func (bs *BackupService) UnlockRun(backup db.Backup, runID uint, unlockedBy string) (*db.BackupRun, error) {
+	run, err := bs.GetRun(backup.ID, runID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: run %d of backup %d", ErrRunNotFound, runID, backup.ID)
+	}
+	if !run.LegalHold {
+		if err := lockError(*run); err != nil {
+			return nil, fmt.Errorf("%w, time locks cannot be removed", err)
+		}
+		return nil, ErrNotLocked
+	}
+
+	reason := ""
+	if run.LockReason != nil {
+		reason = *run.LockReason
+	}
+	run.LegalHold = false
+	if lockError(*run) == nil {
+		run.LockedUntil, run.LockReason, run.LockedBy, run.LockedAt = nil, nil, nil, nil
+	}
+	if err := db.DB.Model(run).Select("LegalHold", "LockedUntil", "LockReason", "LockedBy", "LockedAt").Updates(run).Error; err != nil {
+		return nil, err
+	}
+
+	logs.NewLogService(db.DB).Info(
+		fmt.Sprintf("Legal hold of run %d of backup %s was released by %s", run.ID, backup.Name, unlockedBy),
+		logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+			"action":       "unlock",
+			"run_id":       run.ID,
+			"locked_until": run.LockedUntil,
+			"reason":       reason,
+			"user":         unlockedBy,
+		})
+	return run, nil
+}
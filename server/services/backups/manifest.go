@@ -0,0 +1,289 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ErrNoFile is returned for paths that are not in the file index of a run.
+var ErrNoFile = errors.New("no such file in run")
+
+// RunEntry is an entry of a directory of a run's file index: a file, or a
+// directory holding files. Directories only exist through the files below
+// them; their size, count and time are totals over those files.
+type RunEntry struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Type        string    `json:"type"` // file / dir
+	Size        int64     `json:"size"`
+	Files       int       `json:"files,omitempty"` // dirs: number of files below
+	Mode        uint32    `json:"mode,omitempty"`
+	ModTime     time.Time `json:"mtime"` // dirs: newest file below
+	Owner       string    `json:"owner,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	StoredRunID uint      `json:"stored_run_id,omitempty"`
+}
+
+// cleanRunPath normalises a path inside a run, which cannot climb above the
+// root. The root itself is "".
+func cleanRunPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListRunFiles lists the directory dir of a run's file index, directories
+// first. An empty dir lists the root.
+func (bs *BackupService) ListRunFiles(run db.BackupRun, dir string) ([]RunEntry, error) {
+	dir = cleanRunPath(dir)
+	query := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false)
+	if dir != "" {
+		query = query.Where(`path LIKE ? ESCAPE '\'`, escapeLike(dir)+"/%")
+	}
+	var files []db.RunFile
+	if err := query.Find(&files).Error; err != nil {
+		return nil, err
+	}
+	if dir != "" && len(files) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoFile, dir)
+	}
+
+	entries := []RunEntry{}
+	dirs := make(map[string]int)
+	for _, f := range files {
+		rel := filepath.ToSlash(f.Path)
+		if dir != "" {
+			rel = strings.TrimPrefix(rel, dir+"/")
+		}
+		name, _, nested := strings.Cut(rel, "/")
+		if !nested {
+			entries = append(entries, RunEntry{
+				Name:        name,
+				Path:        path.Join(dir, name),
+				Type:        "file",
+				Size:        f.Size,
+				Mode:        f.Mode,
+				ModTime:     f.ModTime,
+				Owner:       f.Owner,
+				SHA256:      f.SHA256,
+				StoredRunID: f.StoredRunID,
+			})
+			continue
+		}
+		i, ok := dirs[name]
+		if !ok {
+			i = len(entries)
+			dirs[name] = i
+			entries = append(entries, RunEntry{Name: name, Path: path.Join(dir, name), Type: "dir"})
+		}
+		d := &entries[i]
+		d.Size += f.Size
+		d.Files++
+		if f.ModTime.After(d.ModTime) {
+			d.ModTime = f.ModTime
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type == "dir"
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// fileReader streams a file out of a run. Close releases what was opened to
+// reach it, innermost first.
+type fileReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *fileReader) push(close func() error) { r.closers = append(r.closers, close) }
+
+func (r *fileReader) Close() error {
+	var first error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	r.closers = nil
+	return first
+}
+
+// OpenRunFile opens a single file of a run for reading, without restoring
+// the run. The file is read from the run that stores its content: tar
+// archives are streamed up to the entry, zip archives are read through their
+// directory (remote ones are fetched first), raw and repo backups read the
+// file alone.
+func (bs *BackupService) OpenRunFile(backup db.Backup, run db.BackupRun, rel string) (io.ReadCloser, *db.RunFile, error) {
+	rel = cleanRunPath(rel)
+	var file db.RunFile
+	if err := db.DB.Where("run_id = ? AND path = ? AND deleted = ?", run.ID, filepath.FromSlash(rel), false).First(&file).Error; err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoFile, rel)
+	}
+	var stored db.BackupRun
+	if err := db.DB.First(&stored, file.StoredRunID).Error; err != nil {
+		return nil, nil, fmt.Errorf("run %d holding %s not found: %v", file.StoredRunID, rel, err)
+	}
+	if stored.ArchivePath == nil {
+		return nil, nil, fmt.Errorf("run %d has no archive path", stored.ID)
+	}
+	ids, err := decryptionIdentities(backup, stored, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := &fileReader{}
+	switch backup.FileType {
+	case "tar":
+		err = openTarFile(r, stored, rel, ids)
+	case "zip":
+		err = bs.openZipFile(r, backup, stored, rel, ids)
+	case "raw":
+		err = openRawFile(r, stored, rel)
+	case "repo":
+		err = openRepoFile(r, stored, rel, ids)
+	default:
+		err = fmt.Errorf("unsupported file type: %s", backup.FileType)
+	}
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, &file, nil
+}
+
+// openRunDestination opens the destination holding the data of a run.
+func openRunDestination(run db.BackupRun) (Destination, error) {
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, run.ServerID).Error; err != nil {
+		return nil, fmt.Errorf("server %d of run %d not found: %v", run.ServerID, run.ID, err)
+	}
+	return openDestination(server, nil, nil)
+}
+
+func openTarFile(r *fileReader, run db.BackupRun, rel string, ids []age.Identity) error {
+	dest, err := openRunDestination(run)
+	if err != nil {
+		return err
+	}
+	r.push(dest.Close)
+	in, err := dest.Open(*run.ArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive of run %d: %w", run.ID, err)
+	}
+	r.push(in.Close)
+
+	var plain io.Reader = in
+	if encrypted(run.Encryption) {
+		if plain, err = age.Decrypt(in, ids...); err != nil {
+			return fmt.Errorf("failed to decrypt archive of run %d: %v", run.ID, err)
+		}
+	}
+	cr, err := decompressReader(plain, run.Compression)
+	if err != nil {
+		return fmt.Errorf("failed to open %s stream: %v", run.Compression, err)
+	}
+	r.push(cr.Close)
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: %s is missing from the archive of run %d", ErrNoFile, rel, run.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.ToSlash(filepath.Clean(hdr.Name)) == rel {
+			r.Reader = tr
+			return nil
+		}
+	}
+}
+
+func (bs *BackupService) openZipFile(r *fileReader, backup db.Backup, run db.BackupRun, rel string, ids []age.Identity) error {
+	archive, cleanup, err := bs.fetchArchive(backup, run, nil)
+	if err != nil {
+		return err
+	}
+	r.push(func() error { cleanup(); return nil })
+	plain, done, err := plainArchivePath(archive, run, ids)
+	if err != nil {
+		return err
+	}
+	r.push(func() error { done(); return nil })
+
+	zr, err := zip.OpenReader(plain)
+	if err != nil {
+		return err
+	}
+	r.push(zr.Close)
+	registerZipDecompressors(&zr.Reader)
+	for _, f := range zr.File {
+		if f.Mode().IsRegular() && path.Clean(f.Name) == rel {
+			in, err := f.Open()
+			if err != nil {
+				return err
+			}
+			r.push(in.Close)
+			r.Reader = in
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is missing from the archive of run %d", ErrNoFile, rel, run.ID)
+}
+
+func openRawFile(r *fileReader, run db.BackupRun, rel string) error {
+	dest, err := openRunDestination(run)
+	if err != nil {
+		return err
+	}
+	r.push(dest.Close)
+	in, err := dest.Open(path.Join(*run.ArchivePath, rel))
+	if isNotExist(err) {
+		return fmt.Errorf("%w: %s is missing from run %d", ErrNoFile, rel, run.ID)
+	}
+	if err != nil {
+		return err
+	}
+	r.push(in.Close)
+	r.Reader = in
+	return nil
+}
+
+func openRepoFile(r *fileReader, run db.BackupRun, rel string, ids []age.Identity) error {
+	s, err := openRepoSnapshot(run, ids, nil)
+	if err != nil {
+		return err
+	}
+	r.push(s.Close)
+	for _, e := range s.snapshot.Files {
+		if e.Type != "file" || e.Path != rel {
+			continue
+		}
+		reader, err := s.reader(func(f snapshotEntry) bool { return f.Path == rel })
+		if err != nil {
+			return err
+		}
+		r.Reader = &chunkReader{r: reader, chunks: e.Chunks}
+		return nil
+	}
+	return fmt.Errorf("%w: %s is missing from the snapshot of run %d", ErrNoFile, rel, run.ID)
+}
@@ -0,0 +1,341 @@
+package backups
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"strconv"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// queuePollInterval bounds how long a queued job waits when no job finishes
+// and nothing is enqueued, e.g. for jobs queued by another instance.
+const queuePollInterval = 5 * time.Second
+
+// Default limits, overridden by BACKUP_MAX_CONCURRENT and
+// BACKUP_SERVER_CONCURRENCY.
+const (
+	defaultMaxConcurrent     = 2
+	defaultServerConcurrency = 1
+)
+
+// ErrNotQueued is returned when a job is no longer waiting or running.
+var ErrNotQueued = errors.New("job is not queued or running")
+
+// QueuedJob is a job of the queue with the backup it executes.
+type QueuedJob struct {
+	db.BackupJob
+	BackupName string `json:"backup_name"`
+	Position   int    `json:"position"` // 1-based place among queued jobs, 0 while running
+}
+
+func envLimit(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// StartQueue requeues jobs interrupted by a restart and starts dispatching
+// queued jobs to workers. At most BACKUP_MAX_CONCURRENT jobs run at once and
+// at most BACKUP_SERVER_CONCURRENCY per server, unless the server sets its
+// own limit.
+func (bs *BackupService) StartQueue() {
+	bs.maxConcurrent = envLimit("BACKUP_MAX_CONCURRENT", defaultMaxConcurrent)
+	bs.serverConcurrency = envLimit("BACKUP_SERVER_CONCURRENCY", defaultServerConcurrency)
+
+	db.DB.Model(&db.BackupJob{}).Where("status = ?", "running").Updates(map[string]any{
+		"status":     "queued",
+		"started_at": nil,
+	})
+
+	go func() {
+		ticker := time.NewTicker(queuePollInterval)
+		defer ticker.Stop()
+		for {
+			bs.dispatch()
+			select {
+			case <-bs.queueWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// wakeQueue makes the dispatcher look at the queue again.
+func (bs *BackupService) wakeQueue() {
+	select {
+	case bs.queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue adds a job for the backup. A backup is never queued twice; a
+// second request while it is queued or running returns ErrAlreadyRunning.
+// The backup row is locked while checking, so concurrent requests, e.g. from
+// the scheduler and a user, queue it once.
+func (bs *BackupService) Enqueue(backup db.Backup, executedBy string) (*db.BackupJob, error) {
+	job := &db.BackupJob{
+		BackupID:   backup.ID,
+		ServerIDs:  jobServers(backup),
+		Priority:   backup.Priority,
+		Status:     "queued",
+		Attempt:    1,
+		ExecutedBy: executedBy,
+		QueuedAt:   time.Now(),
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&db.Backup{}, backup.ID).Error; err != nil {
+			return fmt.Errorf("failed to queue backup: %v", err)
+		}
+		var count int64
+		tx.Model(&db.BackupJob{}).Where("backup_id = ? AND status IN ?", backup.ID, []string{"queued", "running"}).Count(&count)
+		if count > 0 || bs.backupActive(backup.ID) {
+			return ErrAlreadyRunning
+		}
+		if err := tx.Create(job).Error; err != nil {
+			return fmt.Errorf("failed to queue backup: %v", err)
+		}
+		return tx.Model(&db.Backup{}).Where("id = ?", backup.ID).Update("status", "queued").Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	bs.wakeQueue()
+	return job, nil
+}
+
+// ListQueue returns the queued and running jobs in the order they are served.
+func (bs *BackupService) ListQueue() ([]QueuedJob, error) {
+	var jobs []db.BackupJob
+	err := db.DB.Preload("Backup").Where("status IN ?", []string{"queued", "running"}).
+		Order("status DESC, priority DESC, queued_at, id").Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	list := make([]QueuedJob, 0, len(jobs))
+	position := 0
+	for _, job := range jobs {
+		q := QueuedJob{BackupJob: job, BackupName: job.Backup.Name}
+		if job.Status == "queued" {
+			position++
+			q.Position = position
+		}
+		list = append(list, q)
+	}
+	return list, nil
+}
+
+// CancelJob removes a queued job from the queue or cancels a running one.
+func (bs *BackupService) CancelJob(jobID uint) error {
+	var job db.BackupJob
+	if err := db.DB.First(&job, jobID).Error; err != nil {
+		return ErrNotQueued
+	}
+	switch job.Status {
+	case "queued":
+		res := db.DB.Model(&db.BackupJob{}).Where("id = ? AND status = ?", job.ID, "queued").
+			Updates(map[string]any{"status": "cancelled", "finished_at": time.Now()})
+		if res.RowsAffected == 0 {
+			// Claimed by a worker in the meantime
+			return bs.CancelJob(jobID)
+		}
+		db.DB.Model(&db.Backup{}).Where("id = ? AND status = ?", job.BackupID, "queued").Update("status", "cancelled")
+		return nil
+	case "running":
+		bs.CancelBackup(job.BackupID)
+		return nil
+	}
+	return ErrNotQueued
+}
+
+// dispatch starts queued jobs while the global and per-server limits allow.
+// A job whose servers are all busy is passed over, so it does not hold up
+// jobs for other servers queued behind it.
+func (bs *BackupService) dispatch() {
+	var running []db.BackupJob
+	if err := db.DB.Where("status = ?", "running").Find(&running).Error; err != nil {
+		log.Printf("[queue] failed to load running jobs: %v", err)
+		return
+	}
+	if len(running) >= bs.maxConcurrent {
+		return
+	}
+	busy := make(map[uint]int)
+	for _, job := range running {
+		for _, id := range jobServerIDs(job) {
+			busy[id]++
+		}
+	}
+
+	var queued []db.BackupJob
+	err := db.DB.Where("status = ? AND (not_before IS NULL OR not_before <= ?)", "queued", time.Now()).
+		Order("priority DESC, queued_at, id").Find(&queued).Error
+	if err != nil {
+		log.Printf("[queue] failed to load queued jobs: %v", err)
+		return
+	}
+	limits := make(map[uint]int)
+	active := len(running)
+	for _, job := range queued {
+		if active >= bs.maxConcurrent {
+			return
+		}
+		servers := jobServerIDs(job)
+		if !bs.serversFree(servers, busy, limits) {
+			continue
+		}
+
+		now := time.Now()
+		res := db.DB.Model(&db.BackupJob{}).Where("id = ? AND status = ?", job.ID, "queued").
+			Updates(map[string]any{"status": "running", "started_at": now})
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+		job.Status = "running"
+		job.StartedAt = &now
+		for _, id := range servers {
+			busy[id]++
+		}
+		active++
+		go bs.runJob(job)
+	}
+}
+
+// serversFree reports whether every server of a job is below its limit.
+func (bs *BackupService) serversFree(servers []uint, busy, limits map[uint]int) bool {
+	for _, id := range servers {
+		limit, ok := limits[id]
+		if !ok {
+			limit = bs.serverConcurrency
+			var server db.Server
+			if err := db.DB.Select("id", "max_concurrent").First(&server, id).Error; err == nil && server.MaxConcurrent > 0 {
+				limit = server.MaxConcurrent
+			}
+			limits[id] = limit
+		}
+		if busy[id] >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+// jobServers lists the servers a job of the backup occupies: its targets and
+// the server its source is read from.
+func jobServers(backup db.Backup) datatypes.JSON {
+	if backup.SourceServerID == nil {
+		return backup.ServerIDs
+	}
+	var ids []uint
+	json.Unmarshal(backup.ServerIDs, &ids)
+	for _, id := range ids {
+		if id == *backup.SourceServerID {
+			return backup.ServerIDs
+		}
+	}
+	data, _ := json.Marshal(append(ids, *backup.SourceServerID))
+	return datatypes.JSON(data)
+}
+
+func jobServerIDs(job db.BackupJob) []uint {
+	var ids []uint
+	if len(job.ServerIDs) > 0 {
+		json.Unmarshal(job.ServerIDs, &ids)
+	}
+	return ids
+}
+
+// runJob executes a claimed job and records how it ended.
+func (bs *BackupService) runJob(job db.BackupJob) {
+	defer bs.wakeQueue()
+
+	var backup db.Backup
+	if err := db.DB.First(&backup, job.BackupID).Error; err != nil {
+		bs.finishJob(&job, "failed", fmt.Errorf("backup %d not found", job.BackupID))
+		return
+	}
+	now := time.Now()
+	backup.Status = "running"
+	backup.StartedAt = &now
+	if err := saveBackupState(backup); err != nil {
+		bs.finishJob(&job, "failed", fmt.Errorf("failed to update backup status: %v", err))
+		return
+	}
+
+	var runErr error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[queue] job %d of backup %d panicked: %v", job.ID, backup.ID, r)
+				runErr = fmt.Errorf("backup worker panicked: %v", r)
+			}
+		}()
+		runErr = bs.executeAttempt(backup, job.ExecutedBy, job.Attempt)
+	}()
+
+	status := "completed"
+	if errors.Is(runErr, ErrCancelled) {
+		status = "cancelled"
+	} else if runErr != nil {
+		status = "failed"
+	}
+	// Attempts that fail before a run starts leave the backup running
+	db.DB.Model(&db.Backup{}).Where("id = ? AND status = ?", backup.ID, "running").Update("status", status)
+
+	if status == "failed" {
+		class := ClassifyError(runErr)
+		job.ErrorClass = &class
+		if shouldRetry(backup, job.Attempt, class) {
+			bs.retryJob(&job, backup, runErr)
+			return
+		}
+	}
+	bs.finishJob(&job, status, runErr)
+}
+
+// retryJob puts a failed job back into the queue once its backoff has passed.
+func (bs *BackupService) retryJob(job *db.BackupJob, backup db.Backup, runErr error) {
+	delay := retryDelay(backup, job.Attempt)
+	notBefore := time.Now().Add(delay)
+	msg := runErr.Error()
+	job.Status = "queued"
+	job.Attempt++
+	job.NotBefore = &notBefore
+	job.StartedAt = nil
+	job.Error = &msg
+	db.DB.Save(job)
+	db.DB.Model(&db.Backup{}).Where("id = ?", backup.ID).Update("status", "queued")
+	time.AfterFunc(delay, bs.wakeQueue)
+
+	note := fmt.Sprintf("Attempt %d of %d failed (%s); retrying in %s", job.Attempt-1, backup.MaxAttempts, *job.ErrorClass, delay)
+	if progress, err := bs.GetBackupProgress(backup.ID); err == nil {
+		bs.updateProgress(progress, progress.Progress, progress.Status, progress.Message+" - "+note)
+	}
+	logs.NewLogService(db.DB).Warning(fmt.Sprintf("Backup %s failed, will retry", backup.Name), logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+		"attempt":     job.Attempt - 1,
+		"max":         backup.MaxAttempts,
+		"error":       msg,
+		"error_class": *job.ErrorClass,
+		"retry_at":    notBefore,
+	})
+}
+
+func (bs *BackupService) finishJob(job *db.BackupJob, status string, err error) {
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	if err != nil {
+		msg := err.Error()
+		job.Error = &msg
+	}
+	db.DB.Save(job)
+}
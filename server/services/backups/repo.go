@@ -0,0 +1,1407 @@
+package backups
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Runs of repo backups are stored in a deduplicating repository, a directory
+// on the target server that any number of runs and backups share:
+//
+//	config               format of the repository
+//	keys/<name>          keys the chunks are encrypted with
+//	packs/<xx>/<sha256>  chunks, packed into files named by their checksum
+//	snapshots/<name>     one per run: the files of the run and their chunks
+//
+// Files are split into content-defined chunks identified by their SHA-256, so
+// a chunk is stored once however many files and runs contain it. Each chunk
+// is compressed and encrypted on its own. Which pack holds a chunk is kept in
+// the repo_packs and repo_chunks tables.
+
+const (
+	repoVersion = 1
+
+	// packSize is the size at which a pack is closed and stored.
+	packSize = 16 << 20
+
+	// packCacheSize is how many packs a restore keeps in memory.
+	packCacheSize = 4
+)
+
+// repoConfig is the format of a repository, written when it is created.
+type repoConfig struct {
+	Version  int    `json:"version"`
+	Chunker  string `json:"chunker"`
+	MinChunk int    `json:"min_chunk"`
+	AvgChunk int    `json:"avg_chunk"`
+	MaxChunk int    `json:"max_chunk"`
+}
+
+var currentRepoConfig = repoConfig{
+	Version:  repoVersion,
+	Chunker:  "fastcdc",
+	MinChunk: chunkMin,
+	AvgChunk: chunkAvg,
+	MaxChunk: chunkMax,
+}
+
+// repoKeyFile is a key of an encrypted repository. Chunks are encrypted to
+// its recipient, so runs and garbage collection only need the public half;
+// the identity is encrypted with the key of the backup and only opened by
+// restores.
+type repoKeyFile struct {
+	Version     int       `json:"version"`
+	Encryption  string    `json:"encryption"`
+	Fingerprint string    `json:"fingerprint"`
+	Recipient   string    `json:"recipient"`
+	Identity    []byte    `json:"identity"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// repoKey is a loaded repository key. identity is only set for reading.
+type repoKey struct {
+	name      string
+	recipient age.Recipient
+	identity  age.Identity
+}
+
+// keyName returns the name of a key, or "" for unencrypted data.
+func keyName(key *repoKey) string {
+	if key == nil {
+		return ""
+	}
+	return key.name
+}
+
+// blobHeader precedes sealed data that is not a chunk: it ends packs and
+// starts snapshots, naming the key and compression of the data.
+type blobHeader struct {
+	Version     int    `json:"version"`
+	Key         string `json:"key,omitempty"`
+	Compression string `json:"compression"`
+	IndexOffset int64  `json:"index_offset,omitempty"`
+	IndexLength int64  `json:"index_length,omitempty"`
+}
+
+// packEntry locates a chunk in a pack. The index of a pack lists them, so a
+// pack can be read without the database.
+type packEntry struct {
+	ID        string `json:"id"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	RawLength int64  `json:"raw_length"`
+}
+
+// repoSnapshot lists the files of a run.
+type repoSnapshot struct {
+	Version   int             `json:"version"`
+	Backup    string          `json:"backup"`
+	RunID     uint            `json:"run_id"`
+	StartedAt time.Time       `json:"started_at"`
+	Files     []snapshotEntry `json:"files"`
+}
+
+type snapshotEntry struct {
+	Path    string      `json:"path"`
+	Type    string      `json:"type"` // file / dir / symlink
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+// repoLocks keeps garbage collection away from the runs, restores and
+// verifications using a repository. They share it; a collection needs it to
+// itself.
+var repoLocks = struct {
+	sync.Mutex
+	m map[string]*sync.RWMutex
+}{m: make(map[string]*sync.RWMutex)}
+
+func repoLock(serverID uint, root string) *sync.RWMutex {
+	repoLocks.Lock()
+	defer repoLocks.Unlock()
+	k := fmt.Sprintf("%d:%s", serverID, root)
+	l, ok := repoLocks.m[k]
+	if !ok {
+		l = &sync.RWMutex{}
+		repoLocks.m[k] = l
+	}
+	return l
+}
+
+// repoObject returns the name of an object of the repository at root.
+func repoObject(server db.Server, root string, parts ...string) string {
+	name := path.Join(parts...)
+	if server.Type == "s3" {
+		return s3Key(root, name)
+	}
+	return path.Join(root, name)
+}
+
+// repoRoot returns the repository a backup stores its runs in on a server.
+func repoRoot(backup db.Backup, server db.Server) string {
+	return repoObject(server, backup.Destination)
+}
+
+// snapshotRepo returns the repository holding the snapshot of a run.
+func snapshotRepo(archive string) (string, bool) {
+	dir := path.Dir(archive)
+	if path.Base(dir) != "snapshots" {
+		return "", false
+	}
+	root := path.Dir(dir)
+	if root == "." {
+		root = ""
+	}
+	return root, true
+}
+
+type repository struct {
+	server db.Server
+	dest   Destination
+	root   string
+}
+
+func (r *repository) object(parts ...string) string {
+	return repoObject(r.server, r.root, parts...)
+}
+
+func (r *repository) packObject(name string) string {
+	return r.object("packs", name[:2], name)
+}
+
+// openRepo checks the format of the repository at root. With create, a
+// missing repository is initialised.
+func openRepo(server db.Server, dest Destination, root string, create bool) (*repository, error) {
+	repo := &repository{server: server, dest: dest, root: root}
+	data, err := readObject(dest, repo.object("config"))
+	if isNotExist(err) && create {
+		data, _ = json.MarshalIndent(currentRepoConfig, "", "  ")
+		return repo, repo.put(repo.object("config"), data)
+	}
+	if isNotExist(err) {
+		return nil, fmt.Errorf("no repository at %s on %s", root, server.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config on %s: %w", server.Name, err)
+	}
+	var config repoConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid repository config at %s on %s: %v", root, server.Name, err)
+	}
+	if config != currentRepoConfig {
+		return nil, fmt.Errorf("repository at %s on %s has an unsupported format (version %d, %s chunker)", root, server.Name, config.Version, config.Chunker)
+	}
+	return repo, nil
+}
+
+func readObject(dest Destination, name string) ([]byte, error) {
+	r, err := dest.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// put stores an object and verifies the stored copy.
+func (r *repository) put(name string, data []byte) error {
+	w, err := r.dest.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s on %s: %w", name, r.server.Name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return verifyObject(r.dest, name, int64(len(data)), hex.EncodeToString(sum[:]))
+}
+
+// keyFingerprint identifies what a repository key is encrypted with: the
+// recipients of an age backup or the sealed passphrase. A new passphrase or
+// recipient list starts a new key.
+func keyFingerprint(backup db.Backup) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", backup.Encryption)
+	switch backup.Encryption {
+	case "age":
+		if backup.Recipients != nil {
+			hash.Write([]byte(*backup.Recipients))
+		}
+	case "passphrase":
+		if backup.SealedKey != nil {
+			hash.Write([]byte(*backup.SealedKey))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// writerKey returns the key new chunks of the backup are encrypted with,
+// creating it on first use. Unencrypted backups have none.
+func (r *repository) writerKey(backup db.Backup) (*repoKey, error) {
+	if !encrypted(backup.Encryption) {
+		return nil, nil
+	}
+	fingerprint := keyFingerprint(backup)
+	list, err := r.dest.List(r.object("keys"))
+	if err != nil && !isNotExist(err) {
+		return nil, fmt.Errorf("failed to list repository keys: %w", err)
+	}
+	for _, obj := range list {
+		if obj.IsDir {
+			continue
+		}
+		kf, err := r.keyFile(path.Base(obj.Name))
+		if err != nil {
+			return nil, err
+		}
+		if kf.Fingerprint == fingerprint {
+			return parseRepoKey(path.Base(obj.Name), kf)
+		}
+	}
+
+	recipients, err := encryptionRecipients(backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %v", err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+	var wrapped bytes.Buffer
+	enc, err := encryptWriter(&wrapped, recipients)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(enc, identity.String())
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	kf := repoKeyFile{
+		Version:     repoVersion,
+		Encryption:  backup.Encryption,
+		Fingerprint: fingerprint,
+		Recipient:   identity.Recipient().String(),
+		Identity:    wrapped.Bytes(),
+		CreatedAt:   time.Now().UTC(),
+	}
+	sum := sha256.Sum256([]byte(kf.Recipient))
+	name := hex.EncodeToString(sum[:])[:16]
+	data, _ := json.MarshalIndent(kf, "", "  ")
+	if err := r.put(r.object("keys", name), data); err != nil {
+		return nil, err
+	}
+	return parseRepoKey(name, kf)
+}
+
+func (r *repository) keyFile(name string) (repoKeyFile, error) {
+	var kf repoKeyFile
+	data, err := readObject(r.dest, r.object("keys", name))
+	if err != nil {
+		return kf, fmt.Errorf("failed to read repository key %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return kf, fmt.Errorf("invalid repository key %s: %v", name, err)
+	}
+	return kf, nil
+}
+
+func parseRepoKey(name string, kf repoKeyFile) (*repoKey, error) {
+	recipient, err := age.ParseX25519Recipient(kf.Recipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository key %s: %v", name, err)
+	}
+	return &repoKey{name: name, recipient: recipient}, nil
+}
+
+// recipientKey loads a key for writing only.
+func (r *repository) recipientKey(name string) (*repoKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+	kf, err := r.keyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseRepoKey(name, kf)
+}
+
+// openKey loads a key and decrypts its identity with the identities of the
+// backup.
+func (r *repository) openKey(name string, ids []age.Identity) (*repoKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+	kf, err := r.keyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseRepoKey(name, kf)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: repository key %s is encrypted", ErrKeyRequired, name)
+	}
+	dr, err := age.Decrypt(bytes.NewReader(kf.Identity), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: repository key %s cannot be opened: %v", ErrKeyRequired, name, err)
+	}
+	s, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository key %s: %v", name, err)
+	}
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(string(s)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity in repository key %s: %v", name, err)
+	}
+	key.identity = identity
+	return key, nil
+}
+
+// sealBlob compresses data and encrypts it to the key.
+func sealBlob(data []byte, codec string, level int, key *repoKey) ([]byte, error) {
+	var recipients []age.Recipient
+	if key != nil {
+		recipients = []age.Recipient{key.recipient}
+	}
+	var buf bytes.Buffer
+	enc, err := encryptWriter(&buf, recipients)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := compressWriter(enc, codec, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openBlob reverses sealBlob.
+func openBlob(blob []byte, codec string, key *repoKey) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(blob)
+	if key != nil {
+		dr, err := age.Decrypt(r, key.identity)
+		if err != nil {
+			return nil, err
+		}
+		r = dr
+	}
+	cr, err := decompressReader(r, codec)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+	return io.ReadAll(cr)
+}
+
+// chunkLocation is a chunk with the pack holding it.
+type chunkLocation struct {
+	db.RepoChunk
+	Pack db.RepoPack
+}
+
+// locateChunks looks up the packs of the repository holding the given chunks
+// under the key. Chunks that are not stored are left out.
+func locateChunks(serverID uint, root, key string, hashes []string) (map[string]chunkLocation, error) {
+	var packs []db.RepoPack
+	if err := db.DB.Where("server_id = ? AND repo = ? AND key = ?", serverID, root, key).Find(&packs).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]db.RepoPack, len(packs))
+	ids := make([]uint, 0, len(packs))
+	for _, p := range packs {
+		byID[p.ID] = p
+		ids = append(ids, p.ID)
+	}
+	locations := make(map[string]chunkLocation, len(hashes))
+	for start := 0; start < len(hashes) && len(ids) > 0; start += 500 {
+		var chunks []db.RepoChunk
+		batch := hashes[start:min(start+500, len(hashes))]
+		if err := db.DB.Where("hash IN ? AND pack_id IN ?", batch, ids).Find(&chunks).Error; err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			locations[c.Hash] = chunkLocation{RepoChunk: c, Pack: byID[c.PackID]}
+		}
+	}
+	return locations, nil
+}
+
+// storedChunks returns the chunks of the repository stored under the key.
+func storedChunks(serverID uint, root, key string) (map[string]bool, error) {
+	var hashes []string
+	err := db.DB.Model(&db.RepoChunk{}).
+		Joins("JOIN repo_packs ON repo_packs.id = repo_chunks.pack_id").
+		Where("repo_packs.server_id = ? AND repo_packs.repo = ? AND repo_packs.key = ?", serverID, root, key).
+		Pluck("repo_chunks.hash", &hashes).Error
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		known[h] = true
+	}
+	return known, nil
+}
+
+// packWriter collects chunks into packs. A pack is stored once it reaches
+// packSize and its chunks are recorded right away, so they are found by the
+// runs that follow even if this one fails.
+type packWriter struct {
+	repo     *repository
+	key      *repoKey
+	codec    string
+	level    int
+	buf      bytes.Buffer
+	entries  []packEntry
+	packs    []string // names of the packs stored
+	written  int64    // bytes of the packs stored
+	progress *db.BackupProgress
+	uploaded int64 // bytes the destination reported to progress
+	flushed  func()
+}
+
+// add seals a chunk into the pack.
+func (p *packWriter) add(id string, data []byte) error {
+	blob, err := sealBlob(data, p.codec, p.level, p.key)
+	if err != nil {
+		return err
+	}
+	return p.addBlob(id, blob, int64(len(data)))
+}
+
+// addBlob adds a sealed chunk as-is.
+func (p *packWriter) addBlob(id string, blob []byte, rawLength int64) error {
+	p.entries = append(p.entries, packEntry{ID: id, Offset: int64(p.buf.Len()), Length: int64(len(blob)), RawLength: rawLength})
+	p.buf.Write(blob)
+	if p.buf.Len() >= packSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// flush ends the pack with its sealed index and header, followed by the
+// header length as a big-endian uint32, and stores it.
+func (p *packWriter) flush() error {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	index, err := json.Marshal(p.entries)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealBlob(index, p.codec, p.level, p.key)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(blobHeader{
+		Version:     repoVersion,
+		Key:         keyName(p.key),
+		Compression: p.codec,
+		IndexOffset: int64(p.buf.Len()),
+		IndexLength: int64(len(sealed)),
+	})
+	p.buf.Write(sealed)
+	p.buf.Write(header)
+	binary.Write(&p.buf, binary.BigEndian, uint32(len(header)))
+
+	data := p.buf.Bytes()
+	sum := sha256.Sum256(data)
+	pack := db.RepoPack{
+		ServerID: p.repo.server.ID,
+		Repo:     p.repo.root,
+		Name:     hex.EncodeToString(sum[:]),
+		Key:      keyName(p.key),
+		Size:     int64(len(data)),
+	}
+	var before int64
+	if p.progress != nil {
+		before = p.progress.BytesProcessed
+	}
+	if err := p.repo.put(p.repo.packObject(pack.Name), data); err != nil {
+		return err
+	}
+	if p.progress != nil {
+		p.uploaded += p.progress.BytesProcessed - before
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pack).Error; err != nil {
+			return err
+		}
+		chunks := make([]db.RepoChunk, len(p.entries))
+		for i, e := range p.entries {
+			chunks[i] = db.RepoChunk{PackID: pack.ID, Hash: e.ID, Offset: e.Offset, Length: e.Length, RawLength: e.RawLength}
+		}
+		return tx.CreateInBatches(chunks, 500).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record pack %s: %v", pack.Name, err)
+	}
+	p.written += pack.Size
+	p.packs = append(p.packs, pack.Name)
+	p.buf.Reset()
+	p.entries = nil
+	if p.flushed != nil {
+		p.flushed()
+	}
+	return nil
+}
+
+// parsePack returns the header of a pack read into memory.
+func parsePack(data []byte) (blobHeader, error) {
+	var header blobHeader
+	if len(data) < 4 {
+		return header, errors.New("pack is truncated")
+	}
+	n := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	if n > len(data)-4 {
+		return header, errors.New("pack header is truncated")
+	}
+	if err := json.Unmarshal(data[len(data)-4-n:len(data)-4], &header); err != nil {
+		return header, fmt.Errorf("invalid pack header: %v", err)
+	}
+	return header, nil
+}
+
+// sealSnapshot encodes a snapshot: a plain header line naming the key, then
+// the sealed file list.
+func sealSnapshot(snapshot repoSnapshot, codec string, level int, key *repoKey) ([]byte, error) {
+	list, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealBlob(list, codec, level, key)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(blobHeader{Version: repoVersion, Key: keyName(key), Compression: codec})
+	return append(append(header, '\n'), sealed...), nil
+}
+
+// snapshotHeader splits a stored snapshot into its header and sealed list.
+func snapshotHeader(data []byte) (blobHeader, []byte, error) {
+	var header blobHeader
+	line, rest, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return header, nil, errors.New("snapshot has no header")
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, nil, fmt.Errorf("invalid snapshot header: %v", err)
+	}
+	return header, rest, nil
+}
+
+// ------------------- WRITE -------------------
+
+// writeRepo stores a run in the repository of the backup on the server.
+// Files that are unchanged since the previous run of the backup on the server
+// keep their chunks without being read; the others are chunked and only the
+// chunks the repository lacks are stored. The snapshot of the run is written
+// last. It returns the bytes added to the repository and the checksum of the
+// snapshot. The caller holds the read lock of the repository.
+func (bs *BackupService) writeRepo(backup db.Backup, server db.Server, dest Destination, run *db.BackupRun, filter *fileFilter, ix *fileIndex, progress *db.BackupProgress) (int64, string, error) {
+	repo, err := openRepo(server, dest, repoRoot(backup, server), true)
+	if err != nil {
+		return 0, "", err
+	}
+	key, err := repo.writerKey(backup)
+	if err != nil {
+		return 0, "", err
+	}
+	known, err := storedChunks(server.ID, repo.root, keyName(key))
+	if err != nil {
+		return 0, "", err
+	}
+
+	prev := make(map[string]db.RunFile)
+	var last db.BackupRun
+	err = db.DB.Where("backup_id = ? AND server_id = ? AND status = ? AND id <> ?", backup.ID, server.ID, "completed", run.ID).
+		Order("started_at DESC").First(&last).Error
+	if err == nil {
+		var files []db.RunFile
+		db.DB.Where("run_id = ? AND deleted = ?", last.ID, false).Find(&files)
+		for _, f := range files {
+			prev[f.Path] = f
+		}
+	}
+
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Writing repository on %s...", server.Name))
+	tracker := bs.newProgressTracker(progress)
+	total := *progress.TotalBytes
+	packer := &packWriter{repo: repo, key: key, codec: run.Compression, level: backup.CompressionLevel, progress: progress}
+	packer.flushed = func() {
+		// Uploads to SSH servers report as transfers of their own; the bytes
+		// they counted are added to the total of the run
+		grown := total + packer.uploaded
+		progress.TotalBytes = &grown
+		progress.Message = fmt.Sprintf("Writing repository on %s...", server.Name)
+	}
+
+	snapshot := repoSnapshot{Version: repoVersion, Backup: backup.Name, RunID: run.ID, StartedAt: run.StartedAt}
+	err = filter.walk(backup.Source, func(p, rel string, info os.FileInfo) error {
+		if rel == "." {
+			return nil
+		}
+		entry := snapshotEntry{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime().UTC()}
+		switch {
+		case info.IsDir():
+			entry.Type = "dir"
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entry.Type, entry.Link = "symlink", link
+		case info.Mode().IsRegular():
+			entry.Type, entry.Size = "file", info.Size()
+			if f, ok := prev[rel]; ok && f.Size == info.Size() && f.ModTime.Equal(indexTime(info.ModTime())) && allKnown(f.Chunks, known) {
+				entry.SHA256, entry.Chunks = f.SHA256, f.Chunks
+				tracker.add(info.Size())
+			} else {
+				progress.CurrentFile = &rel
+				bs.BroadcastProgress(progress)
+				if entry.SHA256, entry.Chunks, err = storeFile(p, packer, known, tracker); err != nil {
+					return err
+				}
+			}
+			ix.add(rel, info, entry.SHA256).Chunks = entry.Chunks
+		default:
+			return nil
+		}
+		snapshot.Files = append(snapshot.Files, entry)
+		return nil
+	})
+	if err == nil {
+		err = packer.flush()
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	data, err := sealSnapshot(snapshot, run.Compression, backup.CompressionLevel, key)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := repo.put(*run.ArchivePath, data); err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(data)
+	return packer.written + int64(len(data)), hex.EncodeToString(sum[:]), nil
+}
+
+func allKnown(chunks []string, known map[string]bool) bool {
+	for _, c := range chunks {
+		if !known[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// storeFile chunks a file into the pack writer, skipping the chunks that are
+// already stored, and returns the SHA-256 of the file and its chunk IDs.
+func storeFile(p string, packer *packWriter, known map[string]bool, tracker *progressTracker) (string, []string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	ch := newChunker(io.TeeReader(tracker.reader(f), hash))
+	chunks := []string{}
+	for {
+		data, err := ch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		sum := sha256.Sum256(data)
+		id := hex.EncodeToString(sum[:])
+		chunks = append(chunks, id)
+		if known[id] {
+			continue
+		}
+		if err := packer.add(id, data); err != nil {
+			return "", nil, err
+		}
+		known[id] = true
+	}
+	return hex.EncodeToString(hash.Sum(nil)), chunks, nil
+}
+
+// ------------------- RESTORE -------------------
+
+// repoReader reads chunks from the packs of a repository, keeping the most
+// recently used packs in memory.
+type repoReader struct {
+	repo      *repository
+	key       *repoKey
+	codec     string
+	locations map[string]chunkLocation
+	cache     []cachedPack
+}
+
+type cachedPack struct {
+	name string
+	data []byte
+}
+
+func (r *repoReader) pack(name string) ([]byte, error) {
+	for i, c := range r.cache {
+		if c.name == name {
+			copy(r.cache[1:i+1], r.cache[:i])
+			r.cache[0] = c
+			return c.data, nil
+		}
+	}
+	data, err := readObject(r.repo.dest, r.repo.packObject(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack %s: %w", name, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != name {
+		return nil, fmt.Errorf("pack %s is damaged", name)
+	}
+	if len(r.cache) == packCacheSize {
+		r.cache = r.cache[:packCacheSize-1]
+	}
+	r.cache = append([]cachedPack{{name: name, data: data}}, r.cache...)
+	return data, nil
+}
+
+func (r *repoReader) chunk(id string) ([]byte, error) {
+	loc, ok := r.locations[id]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s is not in the repository", id)
+	}
+	data, err := r.pack(loc.Pack.Name)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Offset < 0 || loc.Offset+loc.Length > int64(len(data)) {
+		return nil, fmt.Errorf("chunk %s lies outside of pack %s", id, loc.Pack.Name)
+	}
+	plain, err := openBlob(data[loc.Offset:loc.Offset+loc.Length], r.codec, r.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", id, err)
+	}
+	if sum := sha256.Sum256(plain); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk %s is damaged", id)
+	}
+	return plain, nil
+}
+
+// chunkReader reads a file from its chunks.
+type chunkReader struct {
+	r      *repoReader
+	chunks []string
+	cur    []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.cur) == 0 {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := cr.r.chunk(cr.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		cr.cur, cr.chunks = data, cr.chunks[1:]
+	}
+	n := copy(p, cr.cur)
+	cr.cur = cr.cur[n:]
+	return n, nil
+}
+
+// openSnapshot is the open snapshot of a repo run. It holds the repository's
+// read lock until it is closed.
+type openSnapshot struct {
+	repo     *repository
+	key      *repoKey
+	header   blobHeader
+	snapshot repoSnapshot
+	lock     *sync.RWMutex
+}
+
+// openRepoSnapshot reads and decrypts the snapshot of a repo run.
+func openRepoSnapshot(run db.BackupRun, ids []age.Identity, job *jobControl) (*openSnapshot, error) {
+	if run.ArchivePath == nil {
+		return nil, fmt.Errorf("run %d has no snapshot", run.ID)
+	}
+	root, ok := snapshotRepo(*run.ArchivePath)
+	if !ok {
+		return nil, fmt.Errorf("run %d has no snapshot", run.ID)
+	}
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, run.ServerID).Error; err != nil {
+		return nil, fmt.Errorf("server %d of run %d not found: %v", run.ServerID, run.ID, err)
+	}
+	s := &openSnapshot{lock: repoLock(server.ID, root)}
+	s.lock.RLock()
+
+	store, err := openDestination(server, job, nil)
+	if err != nil {
+		s.lock.RUnlock()
+		return nil, err
+	}
+	if err := s.read(server, store, root, run, ids); err != nil {
+		store.Close()
+		s.lock.RUnlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *openSnapshot) read(server db.Server, store Destination, root string, run db.BackupRun, ids []age.Identity) error {
+	repo, err := openRepo(server, store, root, false)
+	if err != nil {
+		return err
+	}
+	data, err := readObject(store, *run.ArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot of run %d from %s: %w", run.ID, server.Name, err)
+	}
+	header, sealed, err := snapshotHeader(data)
+	if err != nil {
+		return err
+	}
+	key, err := repo.openKey(header.Key, ids)
+	if err != nil {
+		return err
+	}
+	list, err := openBlob(sealed, header.Compression, key)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot of run %d: %v", run.ID, err)
+	}
+	if err := json.Unmarshal(list, &s.snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot of run %d: %v", run.ID, err)
+	}
+	s.repo, s.key, s.header = repo, key, header
+	return nil
+}
+
+// reader returns a reader for the chunks of the files selected by want.
+func (s *openSnapshot) reader(want func(snapshotEntry) bool) (*repoReader, error) {
+	var hashes []string
+	for _, e := range s.snapshot.Files {
+		if e.Type == "file" && want(e) {
+			hashes = append(hashes, e.Chunks...)
+		}
+	}
+	locations, err := locateChunks(s.repo.server.ID, s.repo.root, s.header.Key, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return &repoReader{repo: s.repo, key: s.key, codec: s.header.Compression, locations: locations}, nil
+}
+
+func (s *openSnapshot) Close() error {
+	err := s.repo.dest.Close()
+	s.lock.RUnlock()
+	return err
+}
+
+// extractRepo restores the files of a repo run selected by want into dest.
+func (bs *BackupService) extractRepo(run db.BackupRun, ids []age.Identity, dest string, want entryFilter, policy string, tracker *progressTracker) error {
+	s, err := openRepoSnapshot(run, ids, tracker.job)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	snapshot := s.snapshot
+	reader, err := s.reader(func(e snapshotEntry) bool { return want(filepath.FromSlash(e.Path), true) })
+	if err != nil {
+		return err
+	}
+
+	for _, e := range snapshot.Files {
+		if err := tracker.job.wait(); err != nil {
+			return err
+		}
+		rel := filepath.Clean(filepath.FromSlash(e.Path))
+		if rel == "." || !want(rel, e.Type == "file") {
+			continue
+		}
+		target, err := safeJoin(dest, rel)
+		if err != nil {
+			return err
+		}
+
+		switch e.Type {
+		case "dir":
+			if err := os.MkdirAll(target, e.Mode.Perm()|0700); err != nil {
+				return err
+			}
+		case "file":
+			if !shouldWrite(target, e.ModTime, policy) {
+				tracker.add(e.Size)
+				continue
+			}
+			if err := writeFile(target, &chunkReader{r: reader, chunks: e.Chunks}, e.Mode, e.ModTime, tracker); err != nil {
+				return fmt.Errorf("%s: %v", e.Path, err)
+			}
+		case "symlink":
+			if !shouldWrite(target, e.ModTime, policy) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(e.Link, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ------------------- VERIFY -------------------
+
+// runPacks returns the packs holding the chunks of a repo run and the chunks
+// the repository lacks.
+func runPacks(serverID uint, root, key string, runID uint) ([]db.RepoPack, []string, error) {
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", runID, false).Find(&files).Error; err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	var hashes []string
+	for _, f := range files {
+		for _, c := range f.Chunks {
+			if !seen[c] {
+				seen[c] = true
+				hashes = append(hashes, c)
+			}
+		}
+	}
+	locations, err := locateChunks(serverID, root, key, hashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	var lacking []string
+	byID := make(map[uint]db.RepoPack)
+	for _, h := range hashes {
+		loc, ok := locations[h]
+		if !ok {
+			lacking = append(lacking, h)
+			continue
+		}
+		byID[loc.Pack.ID] = loc.Pack
+	}
+	packs := make([]db.RepoPack, 0, len(byID))
+	for _, p := range byID {
+		packs = append(packs, p)
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].ID < packs[j].ID })
+	return packs, lacking, nil
+}
+
+// verifyRepo checks the snapshot of a repo run against its checksum and
+// hashes every pack holding one of its chunks. Packs are named by their
+// checksum, so this needs no key.
+func verifyRepo(server db.Server, dest Destination, run db.BackupRun, tracker *progressTracker) error {
+	name := *run.ArchivePath
+	root, ok := snapshotRepo(name)
+	if !ok {
+		return missing("run %d has no snapshot", run.ID)
+	}
+	lock := repoLock(server.ID, root)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	data, err := readObject(dest, name)
+	if isNotExist(err) {
+		return missing("snapshot %s is missing on %s", name, server.Name)
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if run.Checksum != nil && hex.EncodeToString(sum[:]) != *run.Checksum {
+		return corrupted("checksum mismatch for snapshot %s", name)
+	}
+	header, _, err := snapshotHeader(data)
+	if err != nil {
+		return corrupted("snapshot %s cannot be read: %v", name, err)
+	}
+
+	packs, lacking, err := runPacks(server.ID, root, header.Key, run.ID)
+	if err != nil {
+		return err
+	}
+	if len(lacking) > 0 {
+		return corrupted("repository %s lacks %d chunks of run %d", root, len(lacking), run.ID)
+	}
+	repo := &repository{server: server, dest: dest, root: root}
+	var absent, damaged []string
+	for _, p := range packs {
+		got, err := packChecksum(dest, repo.packObject(p.Name), p.Size, tracker)
+		switch {
+		case isNotExist(err):
+			absent = append(absent, p.Name)
+		case err != nil:
+			return err
+		case got != p.Name:
+			damaged = append(damaged, p.Name)
+		}
+	}
+	if len(damaged) > 0 {
+		return corrupted("%d packs of run %d are damaged: %s", len(damaged), run.ID, examples(damaged))
+	}
+	if len(absent) > 0 {
+		return missing("%d packs of run %d are missing on %s: %s", len(absent), run.ID, server.Name, examples(absent))
+	}
+	return nil
+}
+
+// packChecksum hashes a pack, on the server itself where the destination
+// can.
+func packChecksum(dest Destination, name string, size int64, tracker *progressTracker) (string, error) {
+	cd, ok := dest.(checksumDestination)
+	if !ok {
+		return hashObject(dest, name, tracker)
+	}
+	sum, err := cd.Checksum(name)
+	if err == nil {
+		tracker.add(size)
+	}
+	return sum, err
+}
+
+// repoVerifySize returns the bytes verifying a repo run reads.
+func repoVerifySize(run db.BackupRun) int64 {
+	if run.ArchivePath == nil {
+		return 0
+	}
+	root, ok := snapshotRepo(*run.ArchivePath)
+	if !ok {
+		return 0
+	}
+	var keys []string
+	db.DB.Model(&db.RepoPack{}).Where("server_id = ? AND repo = ?", run.ServerID, root).Distinct().Pluck("key", &keys)
+	var size int64
+	for _, key := range keys {
+		packs, _, err := runPacks(run.ServerID, root, key, run.ID)
+		if err != nil {
+			continue
+		}
+		for _, p := range packs {
+			size += p.Size
+		}
+	}
+	return size
+}
+
+// ------------------- GARBAGE COLLECTION -------------------
+
+// RepoGCResult reports a garbage collection of one repository.
+type RepoGCResult struct {
+	ServerID      uint    `json:"server_id"`
+	Repo          string  `json:"repo"`
+	DryRun        bool    `json:"dry_run"`
+	Snapshots     int     `json:"snapshots"`      // runs whose chunks are kept
+	Packs         int     `json:"packs"`          // packs before the collection
+	DeletedPacks  int     `json:"deleted_packs"`  // packs without a used chunk
+	RepackedPacks int     `json:"repacked_packs"` // packs rewritten without their unused chunks
+	OrphanedPacks int     `json:"orphaned_packs"` // pack files not in the database, e.g. of an interrupted run
+	FreedBytes    int64   `json:"freed_bytes"`
+	Error         *string `json:"error,omitempty"`
+}
+
+// CollectGarbage removes the chunks no run references any more from the
+// repositories holding runs of the backup. Every repository is shared by the
+// runs of all backups stored in it, and all of them are taken into account.
+// Packs without a used chunk are deleted; packs that are at least half unused
+// are repacked. With dryRun nothing is changed.
+func (bs *BackupService) CollectGarbage(backup db.Backup, dryRun bool) ([]RepoGCResult, error) {
+	var runs []db.BackupRun
+	if err := db.DB.Where("backup_id = ? AND archive_path IS NOT NULL", backup.ID).Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	type target struct {
+		serverID uint
+		root     string
+	}
+	seen := make(map[target]bool)
+	var targets []target
+	for _, run := range runs {
+		root, ok := snapshotRepo(*run.ArchivePath)
+		t := target{run.ServerID, root}
+		if ok && !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].serverID != targets[j].serverID {
+			return targets[i].serverID < targets[j].serverID
+		}
+		return targets[i].root < targets[j].root
+	})
+
+	ls := logs.NewLogService(db.DB)
+	results := make([]RepoGCResult, 0, len(targets))
+	for _, t := range targets {
+		res := RepoGCResult{ServerID: t.serverID, Repo: t.root, DryRun: dryRun}
+		if err := collectRepo(t.serverID, t.root, &res); err != nil {
+			msg := err.Error()
+			res.Error = &msg
+		}
+		results = append(results, res)
+		if dryRun {
+			continue
+		}
+		meta := map[string]interface{}{
+			"server_id":      res.ServerID,
+			"repo":           res.Repo,
+			"deleted_packs":  res.DeletedPacks,
+			"repacked_packs": res.RepackedPacks,
+			"orphaned_packs": res.OrphanedPacks,
+			"freed_bytes":    res.FreedBytes,
+		}
+		if res.Error != nil {
+			meta["error"] = *res.Error
+			ls.Error(fmt.Sprintf("Garbage collection of repository %s failed", res.Repo), logs.PtrString("backup"), &backup.ID, meta)
+			continue
+		}
+		ls.Info(fmt.Sprintf("Collected garbage of repository %s", res.Repo), logs.PtrString("backup"), &backup.ID, meta)
+	}
+	return results, nil
+}
+
+// collectRepo collects the garbage of one repository into res.
+func collectRepo(serverID uint, root string, res *RepoGCResult) error {
+	lock := repoLock(serverID, root)
+	if !lock.TryLock() {
+		return errors.New("repository is in use")
+	}
+	defer lock.Unlock()
+
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, serverID).Error; err != nil {
+		return fmt.Errorf("server %d not found: %v", serverID, err)
+	}
+
+	// Running runs count: their chunks are recorded before they complete
+	var runs []db.BackupRun
+	err := db.DB.Where("server_id = ? AND status IN ? AND archive_path IS NOT NULL", serverID, []string{"completed", "running"}).Find(&runs).Error
+	if err != nil {
+		return err
+	}
+	var live []uint
+	for _, run := range runs {
+		if r, ok := snapshotRepo(*run.ArchivePath); ok && r == root {
+			live = append(live, run.ID)
+		}
+	}
+	res.Snapshots = len(live)
+	used := make(map[string]bool)
+	for start := 0; start < len(live); start += 500 {
+		var lists []datatypes.JSONSlice[string]
+		batch := live[start:min(start+500, len(live))]
+		if err := db.DB.Model(&db.RunFile{}).Where("run_id IN ? AND deleted = ?", batch, false).Pluck("chunks", &lists).Error; err != nil {
+			return err
+		}
+		for _, list := range lists {
+			for _, c := range list {
+				used[c] = true
+			}
+		}
+	}
+
+	var packs []db.RepoPack
+	if err := db.DB.Where("server_id = ? AND repo = ?", serverID, root).Order("id").Find(&packs).Error; err != nil {
+		return err
+	}
+	res.Packs = len(packs)
+	chunks := make(map[uint][]db.RepoChunk)
+	if len(packs) > 0 {
+		ids := make([]uint, len(packs))
+		for i, p := range packs {
+			ids[i] = p.ID
+		}
+		var list []db.RepoChunk
+		if err := db.DB.Where("pack_id IN ?", ids).Order("pack_id, id").Find(&list).Error; err != nil {
+			return err
+		}
+		for _, c := range list {
+			chunks[c.PackID] = append(chunks[c.PackID], c)
+		}
+	}
+
+	dest, err := openDestination(server, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	repo := &repository{server: server, dest: dest, root: root}
+
+	// A chunk is kept once per key; further copies are garbage
+	kept := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, pack := range packs {
+		var keep []db.RepoChunk
+		var keepBytes int64
+		for _, c := range chunks[pack.ID] {
+			if used[c.Hash] && !kept[pack.Key+"/"+c.Hash] {
+				kept[pack.Key+"/"+c.Hash] = true
+				keep = append(keep, c)
+				keepBytes += c.Length
+			}
+		}
+		switch {
+		case len(keep) == 0:
+			res.DeletedPacks++
+			res.FreedBytes += pack.Size
+			if !res.DryRun {
+				if err := deletePack(repo, pack); err != nil {
+					return err
+				}
+			}
+		case keepBytes*2 <= pack.Size:
+			res.RepackedPacks++
+			if res.DryRun {
+				res.FreedBytes += pack.Size - keepBytes
+				names[pack.Name] = true
+				continue
+			}
+			written, err := repack(repo, pack, keep, names)
+			if err != nil {
+				return err
+			}
+			res.FreedBytes += pack.Size - written
+		default:
+			names[pack.Name] = true
+		}
+	}
+
+	// Packs of runs that failed before recording them
+	dirs, err := dest.List(repo.object("packs"))
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir {
+			continue
+		}
+		objects, err := dest.List(dir.Name)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if obj.IsDir || names[path.Base(obj.Name)] {
+				continue
+			}
+			var recorded int64
+			db.DB.Model(&db.RepoPack{}).Where("server_id = ? AND repo = ? AND name = ?", serverID, root, path.Base(obj.Name)).Count(&recorded)
+			if recorded > 0 {
+				// Deleted above, or stored by a run since
+				continue
+			}
+			res.OrphanedPacks++
+			res.FreedBytes += obj.Size
+			if !res.DryRun {
+				if err := dest.Delete(obj.Name); err != nil && !isNotExist(err) {
+					return fmt.Errorf("failed to delete %s: %v", obj.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deletePack forgets a pack and deletes its file. The rows go first: a file
+// left behind is swept up as an orphan by the next collection.
+func deletePack(repo *repository, pack db.RepoPack) error {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pack_id = ?", pack.ID).Delete(&db.RepoChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&pack).Error
+	})
+	if err != nil {
+		return err
+	}
+	if err := repo.dest.Delete(repo.packObject(pack.Name)); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete pack %s: %v", pack.Name, err)
+	}
+	return nil
+}
+
+// repack copies the chunks to keep of a pack into a new pack and deletes the
+// old one. The chunks are copied sealed, so no key is needed. It returns the
+// size of the new packs, whose names are added to names.
+func repack(repo *repository, pack db.RepoPack, keep []db.RepoChunk, names map[string]bool) (int64, error) {
+	data, err := readObject(repo.dest, repo.packObject(pack.Name))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pack %s: %w", pack.Name, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != pack.Name {
+		return 0, fmt.Errorf("pack %s is damaged", pack.Name)
+	}
+	header, err := parsePack(data)
+	if err != nil {
+		return 0, fmt.Errorf("pack %s: %v", pack.Name, err)
+	}
+	key, err := repo.recipientKey(pack.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	packer := &packWriter{repo: repo, key: key, codec: header.Compression}
+	for _, c := range keep {
+		if c.Offset < 0 || c.Offset+c.Length > int64(len(data)) {
+			return 0, fmt.Errorf("chunk %s lies outside of pack %s", c.Hash, pack.Name)
+		}
+		if err := packer.addBlob(c.Hash, data[c.Offset:c.Offset+c.Length], c.RawLength); err != nil {
+			return 0, err
+		}
+	}
+	if err := packer.flush(); err != nil {
+		return 0, err
+	}
+	for _, name := range packer.packs {
+		names[name] = true
+	}
+	return packer.written, deletePack(repo, pack)
+}
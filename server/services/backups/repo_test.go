@@ -0,0 +1,149 @@
+package backups
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func testRepoKey(t *testing.T) *repoKey {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &repoKey{name: "test", recipient: identity.Recipient(), identity: identity}
+}
+
+func TestSealBlob(t *testing.T) {
+	key := testRepoKey(t)
+	data := append(randomData(5, 64<<10), make([]byte, 64<<10)...)
+	tests := []struct {
+		codec string
+		level int
+		key   *repoKey
+	}{
+		{"none", 0, nil},
+		{"gzip", 0, nil},
+		{"gzip", 9, nil},
+		{"zstd", 0, nil},
+		{"xz", 0, nil},
+		{"zstd", 3, key},
+		{"none", 0, key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec+"/"+keyName(tt.key), func(t *testing.T) {
+			blob, err := sealBlob(data, tt.codec, tt.level, tt.key)
+			if err != nil {
+				t.Fatalf("sealBlob: %v", err)
+			}
+			got, err := openBlob(blob, tt.codec, tt.key)
+			if err != nil {
+				t.Fatalf("openBlob: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("openBlob returned other data")
+			}
+		})
+	}
+}
+
+func TestOpenBlobWrongKey(t *testing.T) {
+	blob, err := sealBlob([]byte("data"), "zstd", 0, testRepoKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openBlob(blob, "zstd", testRepoKey(t)); err == nil {
+		t.Fatal("openBlob with another key succeeded")
+	}
+}
+
+func TestParsePack(t *testing.T) {
+	header := blobHeader{Version: repoVersion, Key: "k", Compression: "zstd", IndexOffset: 10, IndexLength: 20}
+	encoded, _ := json.Marshal(header)
+	pack := func(body, header []byte, n int) []byte {
+		out := append(append([]byte(nil), body...), header...)
+		return binary.BigEndian.AppendUint32(out, uint32(n))
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    blobHeader
+		wantErr bool
+	}{
+		{"valid", pack([]byte("chunks"), encoded, len(encoded)), header, false},
+		{"no body", pack(nil, encoded, len(encoded)), header, false},
+		{"short", []byte{0, 1}, blobHeader{}, true},
+		{"header too long", pack(nil, encoded, len(encoded)+1), blobHeader{}, true},
+		{"bad header", pack(nil, []byte("{x"), 2), blobHeader{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePack(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePack error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parsePack = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSealSnapshot(t *testing.T) {
+	snapshot := repoSnapshot{
+		Version: repoVersion,
+		Backup:  "home",
+		RunID:   7,
+		Files:   []snapshotEntry{{Path: "a.txt", Type: "file", Size: 3, Chunks: []string{"abc"}}},
+	}
+	for _, key := range []*repoKey{nil, testRepoKey(t)} {
+		data, err := sealSnapshot(snapshot, "zstd", 0, key)
+		if err != nil {
+			t.Fatalf("sealSnapshot: %v", err)
+		}
+		header, sealed, err := snapshotHeader(data)
+		if err != nil {
+			t.Fatalf("snapshotHeader: %v", err)
+		}
+		if header.Key != keyName(key) || header.Compression != "zstd" {
+			t.Errorf("header = %+v", header)
+		}
+		list, err := openBlob(sealed, header.Compression, key)
+		if err != nil {
+			t.Fatalf("openBlob: %v", err)
+		}
+		var got repoSnapshot
+		if err := json.Unmarshal(list, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Backup != snapshot.Backup || got.RunID != snapshot.RunID || len(got.Files) != 1 || got.Files[0].Path != "a.txt" {
+			t.Errorf("snapshot = %+v", got)
+		}
+	}
+	if _, _, err := snapshotHeader([]byte("no newline")); err == nil {
+		t.Error("snapshotHeader accepted data without a header")
+	}
+}
+
+func TestSnapshotRepo(t *testing.T) {
+	tests := []struct {
+		archive string
+		root    string
+		ok      bool
+	}{
+		{"/srv/repo/snapshots/abc.json", "/srv/repo", true},
+		{"bucket/repo/snapshots/abc", "bucket/repo", true},
+		{"snapshots/abc", "", true},
+		{"/srv/backups/home.tar.gz", "", false},
+	}
+	for _, tt := range tests {
+		root, ok := snapshotRepo(tt.archive)
+		if root != tt.root || ok != tt.ok {
+			t.Errorf("snapshotRepo(%q) = %q, %v, want %q, %v", tt.archive, root, ok, tt.root, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RestoreOptions describes what to restore and where to put it.
+type RestoreOptions struct {
+	RunID      uint     `json:"run_id"`            // defaults to the latest completed run
+	ServerID   uint     `json:"server_id"`         // server to restore onto
+	TargetPath string   `json:"target_path"`       // directory the files are written to
+	Overwrite  string   `json:"overwrite"`         // overwrite / skip / newer
+	Paths      []string `json:"paths"`             // restore only these files or directories
+	Secret     string   `json:"encryption_secret"` // passphrase or age identity when the stored key cannot decrypt the run
+
+	RecreateVolumes bool `json:"recreate_volumes"` // docker sources: recreate the volumes on the server instead of writing files to target_path
+}
+
+var (
+	ErrNoRun         = errors.New("no completed run to restore")
+	ErrInvalidOption = errors.New("invalid restore options")
+)
+
+// StartRestore validates the options and restores the selected run in the
+// background. Progress is reported like a backup, with operation "restore".
+func (bs *BackupService) StartRestore(backup db.Backup, opts RestoreOptions, executedBy string) (*db.BackupProgress, error) {
+	if opts.RecreateVolumes && backup.SourceType != SourceDocker {
+		return nil, fmt.Errorf("%w: recreate_volumes needs a docker source", ErrInvalidOption)
+	}
+	if strings.TrimSpace(opts.TargetPath) == "" && !opts.RecreateVolumes {
+		return nil, fmt.Errorf("%w: target_path is required", ErrInvalidOption)
+	}
+	switch opts.Overwrite {
+	case "":
+		opts.Overwrite = "overwrite"
+	case "overwrite", "skip", "newer":
+	default:
+		return nil, fmt.Errorf("%w: unsupported overwrite policy %q", ErrInvalidOption, opts.Overwrite)
+	}
+
+	var target db.Server
+	if err := db.DB.First(&target, opts.ServerID).Error; err != nil {
+		return nil, fmt.Errorf("%w: server %d not found", ErrInvalidOption, opts.ServerID)
+	}
+	if target.Type != "local" && target.Type != "remote" {
+		return nil, fmt.Errorf("%w: cannot restore to %s server %s", ErrInvalidOption, target.Type, target.Name)
+	}
+
+	var run db.BackupRun
+	query := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed")
+	if opts.RunID != 0 {
+		query = query.Where("id = ?", opts.RunID)
+	}
+	if err := query.Order("started_at DESC").First(&run).Error; err != nil {
+		return nil, ErrNoRun
+	}
+	if err := checkRawMirror(backup, run); err != nil {
+		return nil, err
+	}
+	if _, err := decryptionIdentities(backup, run, opts.Secret); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+
+	progress := &db.BackupProgress{
+		BackupID:  backup.ID,
+		RunID:     &run.ID,
+		Operation: "restore",
+		Status:    "running",
+		Message:   "Starting restore...",
+	}
+	db.DB.Create(progress)
+	bs.BroadcastProgress(progress)
+	job := bs.startJob(progress)
+
+	go func() {
+		defer bs.endJob(job)
+		ls := logs.NewLogService(db.DB)
+		meta := map[string]interface{}{
+			"run_id":      run.ID,
+			"server_id":   target.ID,
+			"target_path": opts.TargetPath,
+			"executed_by": executedBy,
+		}
+		var err error
+		if opts.RecreateVolumes {
+			meta["recreate_volumes"] = true
+			err = bs.restoreVolumes(backup, run, target, opts, progress)
+		} else {
+			err = bs.restoreRun(backup, run, target, opts, progress)
+		}
+		if err != nil && job.cancelled() {
+			bs.updateProgress(progress, progress.Progress, "cancelled", "Restore cancelled")
+			ls.Warning(fmt.Sprintf("Restore of backup %s was cancelled", backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+			return
+		}
+		if err != nil {
+			bs.updateProgress(progress, progress.Progress, "failed", fmt.Sprintf("Restore failed: %v", err))
+			meta["error"] = err.Error()
+			ls.Error(fmt.Sprintf("Restore of backup %s failed", backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+			return
+		}
+		bs.updateProgress(progress, 100, "completed", "Restore completed successfully")
+		ls.Info("Backup restored", logs.PtrString("backup"), &backup.ID, meta)
+	}()
+
+	return progress, nil
+}
+
+// checkRawMirror rejects runs of a raw backup that a later run on the same
+// server replaced: the mirror they share only holds the newest run.
+func checkRawMirror(backup db.Backup, run db.BackupRun) error {
+	if backup.FileType != "raw" {
+		return nil
+	}
+	var newer int64
+	db.DB.Model(&db.BackupRun{}).Where("backup_id = ? AND server_id = ? AND status = ? AND started_at > ?",
+		backup.ID, run.ServerID, "completed", run.StartedAt).Count(&newer)
+	if newer > 0 {
+		return fmt.Errorf("%w: run %d was replaced by a later run of this raw backup", ErrNoRun, run.ID)
+	}
+	return nil
+}
+
+// restoreRun rebuilds the state of a run. With a file index, every file is
+// taken from the run whose archive stores it, so an incremental run is
+// restored by reading each archive of its chain once.
+func (bs *BackupService) restoreRun(backup db.Backup, run db.BackupRun, target db.Server, opts RestoreOptions, progress *db.BackupProgress) error {
+	want := pathFilter(opts.Paths)
+
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false).Find(&files).Error; err != nil {
+		return err
+	}
+	groups := make(map[uint]map[string]bool)
+	var total int64
+	for _, f := range files {
+		if !want(f.Path) {
+			continue
+		}
+		if groups[f.StoredRunID] == nil {
+			groups[f.StoredRunID] = make(map[string]bool)
+		}
+		groups[f.StoredRunID][f.Path] = true
+		total += f.Size
+	}
+	if len(files) == 0 {
+		// Runs without an index are restored from their own archive
+		groups[run.ID] = nil
+		total = run.SizeBytes
+	} else if groups[run.ID] == nil {
+		// Directories and symlinks are only taken from the run's own archive
+		groups[run.ID] = make(map[string]bool)
+	}
+	progress.TotalBytes = &total
+	progress.BytesProcessed = 0
+
+	dest := filepath.Clean(opts.TargetPath)
+	policy := opts.Overwrite
+	if target.Type == "remote" {
+		tempDir, err := os.MkdirTemp("", "restore-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tempDir)
+		dest = tempDir
+		policy = "overwrite"
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory: %v", err)
+	}
+
+	storedIDs := make([]uint, 0, len(groups))
+	for id := range groups {
+		storedIDs = append(storedIDs, id)
+	}
+	sort.Slice(storedIDs, func(i, j int) bool { return storedIDs[i] < storedIDs[j] })
+
+	tracker := bs.newProgressTracker(progress)
+	for _, storedID := range storedIDs {
+		paths := groups[storedID]
+		own := storedID == run.ID
+		selected := func(rel string, regular bool) bool {
+			if paths == nil {
+				return want(rel)
+			}
+			if !regular {
+				return own && want(rel)
+			}
+			return paths[rel]
+		}
+
+		var stored db.BackupRun
+		if err := db.DB.First(&stored, storedID).Error; err != nil {
+			return fmt.Errorf("run %d holding restored files not found: %v", storedID, err)
+		}
+		bs.updateProgress(progress, progress.Progress, "running", fmt.Sprintf("Reading data of run %d...", stored.ID))
+		ids, err := decryptionIdentities(backup, stored, opts.Secret)
+		if err != nil {
+			return err
+		}
+		if backup.FileType == "repo" {
+			// Chunks are read from the repository as they are needed
+			if err := bs.extractRepo(stored, ids, dest, selected, policy, tracker); err != nil {
+				return err
+			}
+			continue
+		}
+		archive, cleanup, err := bs.fetchArchive(backup, stored, tracker.job)
+		if err != nil {
+			return err
+		}
+
+		switch backup.FileType {
+		case "tar":
+			var r io.ReadCloser
+			if r, err = openArchive(archive, stored, ids); err == nil {
+				err = extractTar(r, stored.Compression, dest, selected, policy, tracker)
+				r.Close()
+			}
+		case "zip":
+			var plain string
+			var done func()
+			if plain, done, err = plainArchivePath(archive, stored, ids); err == nil {
+				err = extractZip(plain, dest, selected, policy, tracker)
+				done()
+			}
+		case "raw":
+			err = copyTree(archive, dest, selected, policy, tracker)
+		default:
+			err = fmt.Errorf("unsupported file type: %s", backup.FileType)
+		}
+		cleanup()
+		if err != nil {
+			return err
+		}
+	}
+
+	if target.Type == "remote" {
+		// The transfer is reported as a progress of its own
+		var pushed int64
+		filepath.Walk(dest, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				pushed += info.Size()
+			}
+			return nil
+		})
+		progress.TotalBytes = &pushed
+		progress.BytesProcessed = 0
+		bs.updateProgress(progress, 0, "running", fmt.Sprintf("Transferring restored files to %s...", target.Name))
+		rc, err := openRemote(target, tracker.job)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		rc.tracker = bs.newProgressTracker(progress)
+		if err := rc.pushTree(dest, opts.TargetPath, opts.Overwrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchArchive makes the data of a run available on this host. Data kept on
+// other servers is pulled from their destination into a temporary directory
+// that cleanup removes.
+func (bs *BackupService) fetchArchive(backup db.Backup, run db.BackupRun, job *jobControl) (string, func(), error) {
+	noop := func() {}
+	if run.ArchivePath == nil {
+		return "", noop, fmt.Errorf("run %d has no archive path", run.ID)
+	}
+
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, run.ServerID).Error; err != nil {
+		return "", noop, fmt.Errorf("server %d of run %d not found: %v", run.ServerID, run.ID, err)
+	}
+	if server.Type == "local" {
+		return *run.ArchivePath, noop, nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "restore-fetch-*")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	dest, err := openDestination(server, job, nil)
+	if err != nil {
+		cleanup()
+		return "", noop, err
+	}
+	defer dest.Close()
+
+	remote := *run.ArchivePath
+	local := filepath.Join(tempDir, path.Base(remote))
+	if backup.FileType == "raw" {
+		local = filepath.Join(tempDir, "raw")
+		err = fetchTree(dest, remote, local)
+	} else {
+		err = fetchObject(dest, remote, local)
+	}
+	if err != nil {
+		cleanup()
+		if errors.Is(err, ErrCancelled) {
+			return "", noop, err
+		}
+		return "", noop, fmt.Errorf("failed to fetch archive from %s: %w", server.Name, err)
+	}
+	return local, cleanup, nil
+}
+
+// fetchObject copies an object of a destination to the local file path.
+func fetchObject(dest Destination, name, local string) error {
+	in, err := dest.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// fetchTree copies the directory dir of a destination to local, keeping
+// modification times. Symlinks are not fetched.
+func fetchTree(dest Destination, dir, local string) error {
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	entries, err := dest.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		target := filepath.Join(local, path.Base(e.Name))
+		if e.IsDir {
+			err = fetchTree(dest, e.Name, target)
+		} else {
+			err = fetchObject(dest, e.Name, target)
+		}
+		if err != nil {
+			return err
+		}
+		if !e.ModTime.IsZero() {
+			os.Chtimes(target, e.ModTime, e.ModTime)
+		}
+	}
+	return nil
+}
+
+// entryFilter selects archive entries by path and whether they are regular files.
+type entryFilter func(rel string, regular bool) bool
+
+// pathFilter matches archive paths against the requested subset; an empty
+// subset selects everything.
+func pathFilter(paths []string) func(string) bool {
+	var prefixes []string
+	for _, p := range paths {
+		p = strings.Trim(filepath.Clean(p), "/")
+		if p != "" && p != "." {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return func(rel string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, p := range prefixes {
+			if rel == p || strings.HasPrefix(rel, p+"/") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// safeJoin resolves an archive path below root, rejecting entries that would
+// escape it.
+func safeJoin(root, rel string) (string, error) {
+	p := filepath.Join(root, rel)
+	if p != root && !strings.HasPrefix(p, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry %q escapes the target directory", rel)
+	}
+	return p, nil
+}
+
+// shouldWrite applies the overwrite policy to an existing target file.
+func shouldWrite(path string, modTime time.Time, policy string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return true
+	}
+	switch policy {
+	case "skip":
+		return false
+	case "newer":
+		return modTime.After(info.ModTime())
+	}
+	return true
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode, modTime time.Time, tracker *progressTracker) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, tracker.reader(r)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+func extractTar(archive io.Reader, codec, dest string, want entryFilter, policy string, tracker *progressTracker) error {
+	cr, err := decompressReader(archive, codec)
+	if err != nil {
+		return fmt.Errorf("failed to open %s stream: %v", codec, err)
+	}
+	defer cr.Close()
+
+	tr := tar.NewReader(cr)
+	for {
+		if err := tracker.job.wait(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := filepath.Clean(hdr.Name)
+		if rel == "." || !want(rel, hdr.Typeflag == tar.TypeReg) {
+			continue
+		}
+		target, err := safeJoin(dest, rel)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if !shouldWrite(target, hdr.ModTime, policy) {
+				tracker.add(hdr.Size)
+				continue
+			}
+			if err := writeFile(target, tr, os.FileMode(hdr.Mode), hdr.ModTime, tracker); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !shouldWrite(target, hdr.ModTime, policy) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractZip(archive, dest string, want entryFilter, policy string, tracker *progressTracker) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	registerZipDecompressors(&zr.Reader)
+
+	for _, zf := range zr.File {
+		if err := tracker.job.wait(); err != nil {
+			return err
+		}
+		rel := filepath.Clean(filepath.FromSlash(zf.Name))
+		info := zf.FileInfo()
+		if rel == "." || !want(rel, info.Mode().IsRegular()) {
+			continue
+		}
+		target, err := safeJoin(dest, rel)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !shouldWrite(target, zf.Modified, policy) {
+			tracker.add(int64(zf.UncompressedSize64))
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		if mode.Perm() == 0 {
+			mode = 0644
+		}
+		err = writeFile(target, r, mode, zf.Modified, tracker)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree restores files from a raw (mirrored) backup directory.
+func copyTree(source, dest string, want entryFilter, policy string, tracker *progressTracker) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := tracker.job.wait(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || !info.Mode().IsRegular() || !want(rel, true) {
+			return nil
+		}
+		target, err := safeJoin(dest, rel)
+		if err != nil {
+			return err
+		}
+		if !shouldWrite(target, info.ModTime(), policy) {
+			tracker.add(info.Size())
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return writeFile(target, in, info.Mode(), info.ModTime(), tracker)
+	})
+}
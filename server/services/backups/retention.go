@@ -0,0 +1,337 @@
+package backups
+
+import (
+	"fmt"
+	"log"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"time"
+)
+
+// pruneInterval is how often the retention worker applies all policies.
+const pruneInterval = time.Hour
+
+// PruneDecision explains why a run is kept or deleted.
+type PruneDecision struct {
+	RunID       uint      `json:"run_id"`
+	ServerID    uint      `json:"server_id"`
+	StartedAt   time.Time `json:"started_at"`
+	ArchivePath *string   `json:"archive_path"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Reasons     []string  `json:"reasons"`
+	Error       *string   `json:"error,omitempty"`
+}
+
+// PrunePlan is the outcome of applying a retention policy to a backup.
+type PrunePlan struct {
+	BackupID   uint            `json:"backup_id"`
+	DryRun     bool            `json:"dry_run"`
+	Keep       []PruneDecision `json:"keep"`
+	Delete     []PruneDecision `json:"delete"`
+	FreedBytes int64           `json:"freed_bytes"`
+
+	// Repositories reports the garbage collection that follows pruning a
+	// repo backup; only then is the space of its runs freed.
+	Repositories []RepoGCResult `json:"repositories,omitempty"`
+}
+
+func retentionEnabled(p db.RetentionPolicy) bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 ||
+		p.KeepMonthly > 0 || p.KeepYearly > 0 || p.MaxAgeDays > 0
+}
+
+// ValidateRetention rejects negative rule values.
+func ValidateRetention(p db.RetentionPolicy) error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 || p.KeepYearly < 0 || p.MaxAgeDays < 0 {
+		return fmt.Errorf("retention values must not be negative")
+	}
+	return nil
+}
+
+// PlanRetention decides which completed runs of the backup are kept, per
+// target server, using grandfather-father-son buckets: the newest run of each
+// of the last N days, weeks, months and years is kept, plus the last N runs.
+// Runs older than max_age_days are dropped even if a bucket would keep them.
+// The newest run and every run whose archive still holds files of a kept
+// incremental run are always kept, and so are suspicious runs and all runs
+// before them on their server, which may be the last clean copies. Locked
+// runs are never pruned.
+func (bs *BackupService) PlanRetention(backup db.Backup) (*PrunePlan, error) {
+	plan := &PrunePlan{BackupID: backup.ID, DryRun: true}
+	policy := backup.Retention
+
+	var runs []db.BackupRun
+	err := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed").
+		Order("started_at DESC").Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	reasons := make(map[uint][]string)
+	keep := func(run db.BackupRun, reason string) {
+		reasons[run.ID] = append(reasons[run.ID], reason)
+	}
+
+	// Raw backups mirror into one directory shared by all runs, so there is
+	// nothing per run to delete.
+	if !retentionEnabled(policy) || backup.FileType == "raw" {
+		for _, run := range runs {
+			keep(run, "no retention policy")
+		}
+	} else {
+		reasons = keepReasons(policy, runs, time.Now())
+
+		// Incremental runs read unchanged files from older archives
+		var keptIDs []uint
+		for id := range reasons {
+			keptIDs = append(keptIDs, id)
+		}
+		var required []uint
+		if len(keptIDs) > 0 {
+			db.DB.Model(&db.RunFile{}).Where("run_id IN ? AND stored_run_id NOT IN ?", keptIDs, keptIDs).
+				Distinct().Pluck("stored_run_id", &required)
+		}
+		for _, id := range required {
+			reasons[id] = append(reasons[id], "required by incremental chain")
+		}
+	}
+
+	for _, run := range runs {
+		d := PruneDecision{
+			RunID:       run.ID,
+			ServerID:    run.ServerID,
+			StartedAt:   run.StartedAt,
+			ArchivePath: run.ArchivePath,
+			SizeBytes:   run.SizeBytes,
+			Reasons:     reasons[run.ID],
+		}
+		if len(d.Reasons) > 0 {
+			plan.Keep = append(plan.Keep, d)
+			continue
+		}
+		d.Reasons = []string{"not matched by retention policy"}
+		plan.Delete = append(plan.Delete, d)
+		plan.FreedBytes += run.SizeBytes
+	}
+	return plan, nil
+}
+
+// keepReasons returns why the policy keeps each run; runs are the completed
+// runs of a backup, newest first, and now is the time max_age_days counts
+// back from. Runs without a reason expire unless an incremental run still
+// reads from them.
+func keepReasons(policy db.RetentionPolicy, runs []db.BackupRun, now time.Time) map[uint][]string {
+	reasons := make(map[uint][]string)
+	keep := func(run db.BackupRun, reason string) {
+		reasons[run.ID] = append(reasons[run.ID], reason)
+	}
+
+	byServer := make(map[uint][]db.BackupRun)
+	var serverOrder []uint
+	for _, run := range runs {
+		if _, ok := byServer[run.ServerID]; !ok {
+			serverOrder = append(serverOrder, run.ServerID)
+		}
+		byServer[run.ServerID] = append(byServer[run.ServerID], run)
+	}
+
+	cutoff := time.Time{}
+	if policy.MaxAgeDays > 0 {
+		cutoff = now.AddDate(0, 0, -policy.MaxAgeDays)
+	}
+	onlyMaxAge := policy.KeepLast == 0 && policy.KeepDaily == 0 && policy.KeepWeekly == 0 &&
+		policy.KeepMonthly == 0 && policy.KeepYearly == 0
+
+	for _, serverID := range serverOrder {
+		list := byServer[serverID]
+		keep(list[0], "newest run")
+
+		buckets := []struct {
+			n      int
+			reason string
+			key    func(time.Time) string
+		}{
+			{policy.KeepDaily, "daily", func(t time.Time) string { return t.Format("2006-01-02") }},
+			{policy.KeepWeekly, "weekly", func(t time.Time) string {
+				y, w := t.ISOWeek()
+				return fmt.Sprintf("%d-%02d", y, w)
+			}},
+			{policy.KeepMonthly, "monthly", func(t time.Time) string { return t.Format("2006-01") }},
+			{policy.KeepYearly, "yearly", func(t time.Time) string { return t.Format("2006") }},
+		}
+
+		for i, run := range list {
+			if !cutoff.IsZero() && run.StartedAt.Before(cutoff) {
+				continue
+			}
+			if onlyMaxAge {
+				keep(run, "within max age")
+			} else if i < policy.KeepLast {
+				keep(run, "last")
+			}
+		}
+		for _, b := range buckets {
+			if b.n == 0 {
+				continue
+			}
+			seen := make(map[string]bool)
+			for _, run := range list {
+				if len(seen) >= b.n {
+					break
+				}
+				if !cutoff.IsZero() && run.StartedAt.Before(cutoff) {
+					break
+				}
+				k := b.key(run.StartedAt.Local())
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				keep(run, b.reason)
+			}
+		}
+	}
+
+	// Runs before the newest suspicious run may hold the last copies of
+	// the files from before the source was damaged
+	for _, serverID := range serverOrder {
+		var flagged *db.BackupRun
+		for i, run := range byServer[serverID] {
+			if run.Suspicious {
+				flagged = &byServer[serverID][i]
+				break
+			}
+		}
+		if flagged == nil {
+			continue
+		}
+		for _, run := range byServer[serverID] {
+			if run.Suspicious {
+				keep(run, "suspicious")
+			} else if run.StartedAt.Before(flagged.StartedAt) {
+				keep(run, fmt.Sprintf("before suspicious run %d", flagged.ID))
+			}
+		}
+	}
+
+	for _, run := range runs {
+		if lockError(run) == nil {
+			continue
+		}
+		if run.LockReason != nil {
+			keep(run, "locked: "+*run.LockReason)
+		} else {
+			keep(run, "locked")
+		}
+	}
+	return reasons
+}
+
+// Prune applies the retention policy of the backup. With dryRun the plan is
+// only computed; otherwise the archives of expired runs are deleted from
+// their servers and the runs are marked as pruned.
+func (bs *BackupService) Prune(backup db.Backup, dryRun bool) (*PrunePlan, error) {
+	plan, err := bs.PlanRetention(backup)
+	if err != nil || dryRun {
+		return plan, err
+	}
+	plan.DryRun = false
+	plan.FreedBytes = 0
+
+	ls := logs.NewLogService(db.DB)
+	for i := range plan.Delete {
+		d := &plan.Delete[i]
+		var run db.BackupRun
+		if err := db.DB.First(&run, d.RunID).Error; err != nil {
+			continue
+		}
+		meta := map[string]interface{}{
+			"run_id":       run.ID,
+			"server_id":    run.ServerID,
+			"archive_path": run.ArchivePath,
+			"size_bytes":   run.SizeBytes,
+		}
+		if err := bs.deleteArchive(run); err != nil {
+			msg := err.Error()
+			d.Error = &msg
+			meta["error"] = msg
+			ls.Error(fmt.Sprintf("Failed to prune run %d of backup %s", run.ID, backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+			continue
+		}
+
+		now := time.Now()
+		run.Status = "pruned"
+		run.PrunedAt = &now
+		db.DB.Save(&run)
+		plan.FreedBytes += run.SizeBytes
+		ls.Info(fmt.Sprintf("Pruned run %d of backup %s", run.ID, backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+	}
+
+	if backup.FileType == "repo" && len(plan.Delete) > 0 {
+		results, err := bs.CollectGarbage(backup, false)
+		if err != nil {
+			return plan, err
+		}
+		plan.Repositories = results
+		plan.FreedBytes = 0
+		for _, res := range results {
+			plan.FreedBytes += res.FreedBytes
+		}
+	}
+	return plan, nil
+}
+
+// deleteArchive removes the archive of a run from the server that stores it.
+// Locked runs are refused.
+func (bs *BackupService) deleteArchive(run db.BackupRun) error {
+	if err := lockError(run); err != nil {
+		return err
+	}
+	if run.ArchivePath == nil || *run.ArchivePath == "" {
+		return nil
+	}
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, run.ServerID).Error; err != nil {
+		return fmt.Errorf("server %d not found: %v", run.ServerID, err)
+	}
+
+	dest, err := openDestination(server, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if err := dest.Delete(*run.ArchivePath); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete %s on %s: %v", *run.ArchivePath, server.Name, err)
+	}
+	return nil
+}
+
+// StartPruner applies the retention policies of all backups periodically.
+func (bs *BackupService) StartPruner() {
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			bs.pruneAll()
+			<-ticker.C
+		}
+	}()
+}
+
+func (bs *BackupService) pruneAll() {
+	var list []db.Backup
+	if err := db.DB.Find(&list).Error; err != nil {
+		log.Printf("[retention] failed to load backups: %v", err)
+		return
+	}
+	for _, backup := range list {
+		// A queued job may be about to write an incremental run on top of
+		// a run the prune would delete
+		if !retentionEnabled(backup.Retention) || backup.Status == "running" || backup.Status == "queued" {
+			continue
+		}
+		if _, err := bs.Prune(backup, false); err != nil {
+			log.Printf("[retention] backup %d (%s): %v", backup.ID, backup.Name, err)
+		}
+	}
+}
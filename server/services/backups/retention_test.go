@@ -0,0 +1,125 @@
+package backups
+
+import (
+	"reflect"
+	"slices"
+	"snaptrack/db"
+	"testing"
+	"time"
+)
+
+func TestKeepReasons(t *testing.T) {
+	// A Friday; runs start at noon so local day boundaries do not matter.
+	now := time.Date(2026, 3, 20, 12, 0, 0, 0, time.Local)
+	run := func(id uint, server uint, daysAgo int) db.BackupRun {
+		return db.BackupRun{ID: id, ServerID: server, StartedAt: now.AddDate(0, 0, -daysAgo)}
+	}
+	suspicious := func(r db.BackupRun) db.BackupRun { r.Suspicious = true; return r }
+	held := func(r db.BackupRun) db.BackupRun { r.LegalHold = true; return r }
+	expired := func(r db.BackupRun) db.BackupRun {
+		until := time.Now().Add(-time.Hour)
+		r.LockedUntil = &until
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		policy db.RetentionPolicy
+		runs   []db.BackupRun
+		want   []uint
+	}{
+		{
+			name:   "keep last",
+			policy: db.RetentionPolicy{KeepLast: 2},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 1, 1), run(3, 1, 2), run(4, 1, 3), run(5, 1, 4)},
+			want:   []uint{1, 2},
+		},
+		{
+			name:   "daily keeps the newest run of a day",
+			policy: db.RetentionPolicy{KeepDaily: 2},
+			runs: []db.BackupRun{
+				{ID: 1, ServerID: 1, StartedAt: now.Add(6 * time.Hour)},
+				{ID: 2, ServerID: 1, StartedAt: now.Add(-3 * time.Hour)},
+				run(3, 1, 1), run(4, 1, 2),
+			},
+			want: []uint{1, 3},
+		},
+		{
+			name:   "weekly uses ISO weeks",
+			policy: db.RetentionPolicy{KeepWeekly: 2},
+			// Fri and Tue of week 12, Fri and Thu of week 11, week 10.
+			runs: []db.BackupRun{run(1, 1, 0), run(2, 1, 3), run(3, 1, 7), run(4, 1, 8), run(5, 1, 14)},
+			want: []uint{1, 3},
+		},
+		{
+			name:   "monthly",
+			policy: db.RetentionPolicy{KeepMonthly: 2},
+			// March, March, February, February, January.
+			runs: []db.BackupRun{run(1, 1, 0), run(2, 1, 10), run(3, 1, 25), run(4, 1, 40), run(5, 1, 60)},
+			want: []uint{1, 3},
+		},
+		{
+			name:   "yearly",
+			policy: db.RetentionPolicy{KeepYearly: 2},
+			// 2026, 2025, 2025, 2024.
+			runs: []db.BackupRun{run(1, 1, 0), run(2, 1, 100), run(3, 1, 200), run(4, 1, 500)},
+			want: []uint{1, 2},
+		},
+		{
+			name:   "max age only",
+			policy: db.RetentionPolicy{MaxAgeDays: 10},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 1, 5), run(3, 1, 9), run(4, 1, 11), run(5, 1, 20)},
+			want:   []uint{1, 2, 3},
+		},
+		{
+			name:   "max age cuts buckets",
+			policy: db.RetentionPolicy{KeepDaily: 5, MaxAgeDays: 3},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 1, 1), run(3, 1, 2), run(4, 1, 4), run(5, 1, 5)},
+			want:   []uint{1, 2, 3},
+		},
+		{
+			name:   "runs before a suspicious run are kept",
+			policy: db.RetentionPolicy{KeepLast: 1},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 1, 1), suspicious(run(3, 1, 2)), run(4, 1, 3), run(5, 2, 4)},
+			want:   []uint{1, 3, 4, 5},
+		},
+		{
+			name:   "locked runs are kept",
+			policy: db.RetentionPolicy{KeepLast: 1},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 1, 1), held(run(3, 1, 2)), expired(run(4, 1, 3))},
+			want:   []uint{1, 3},
+		},
+		{
+			name:   "per server",
+			policy: db.RetentionPolicy{KeepLast: 1},
+			runs:   []db.BackupRun{run(1, 1, 0), run(2, 2, 1), run(3, 1, 2), run(4, 2, 3)},
+			want:   []uint{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := keepReasons(tt.policy, tt.runs, now)
+			var got []uint
+			for id := range reasons {
+				got = append(got, id)
+			}
+			slices.Sort(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v (reasons %v)", got, tt.want, reasons)
+			}
+		})
+	}
+}
+
+func TestKeepReasonsExplains(t *testing.T) {
+	now := time.Date(2026, 3, 20, 12, 0, 0, 0, time.Local)
+	runs := []db.BackupRun{
+		{ID: 1, ServerID: 1, StartedAt: now},
+		{ID: 2, ServerID: 1, StartedAt: now.AddDate(0, 0, -1)},
+	}
+	reasons := keepReasons(db.RetentionPolicy{KeepLast: 1, KeepDaily: 2}, runs, now)
+	want := map[uint][]string{1: {"newest run", "last", "daily"}, 2: {"daily"}}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("reasons = %v, want %v", reasons, want)
+	}
+}
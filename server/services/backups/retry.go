@@ -0,0 +1,146 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"snaptrack/db"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Error classes a retry policy can select.
+const (
+	ErrorClassConnection = "connection" // SSH, S3 or network failures
+	ErrorClassTransfer   = "transfer"   // partial transfers, files vanishing mid-copy
+	ErrorClassStorage    = "storage"    // destination full or not writable
+	ErrorClassSource     = "source"     // source missing or unreadable
+	ErrorClassOther      = "other"
+)
+
+// defaultRetryOn is used when a backup does not list retryable classes.
+var defaultRetryOn = []string{ErrorClassConnection, ErrorClassTransfer}
+
+// Retry settings of backups created without them.
+const (
+	DefaultMaxAttempts     = 1
+	DefaultRetryBackoffSec = 60
+)
+
+// maxRetryDelay caps the exponential backoff.
+const maxRetryDelay = 6 * time.Hour
+
+// ErrSourceMissing is returned when the source path of a backup is gone.
+var ErrSourceMissing = errors.New("source path does not exist")
+
+// ValidateRetry checks the retry policy of a backup. A max_attempts of 0
+// makes a single attempt, like 1.
+func ValidateRetry(backup db.Backup) error {
+	if backup.MaxAttempts < 0 || backup.MaxAttempts > 20 {
+		return fmt.Errorf("max_attempts must be between 0 and 20, 0 and 1 disable retries")
+	}
+	if backup.RetryBackoffSec < 0 {
+		return fmt.Errorf("retry_backoff_sec must not be negative")
+	}
+	for _, class := range backup.RetryOn {
+		switch class {
+		case ErrorClassConnection, ErrorClassTransfer, ErrorClassStorage, ErrorClassSource, ErrorClassOther:
+		default:
+			return fmt.Errorf("unknown error class %q", class)
+		}
+	}
+	return nil
+}
+
+// ClassifyError sorts an error of a backup attempt into one of the error
+// classes, looking at SSH, SFTP and S3 errors, errno values and well-known
+// messages.
+func ClassifyError(err error) string {
+	if errors.Is(err, ErrSourceMissing) {
+		return ErrorClassSource
+	}
+
+	// Errno values implement net.Error too; local ones are classified below.
+	var netErr net.Error
+	var exitMissing *ssh.ExitMissingError
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection) ||
+		errors.As(err, &exitMissing) {
+		return ErrorClassConnection
+	}
+	if errors.As(err, &netErr) {
+		if _, ok := netErr.(syscall.Errno); !ok {
+			return ErrorClassConnection
+		}
+	}
+	if isStorageFull(err) {
+		return ErrorClassStorage
+	}
+	var s3Err minio.ErrorResponse
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout":
+			return ErrorClassConnection
+		case "XMinioStorageFull", "QuotaExceeded", "EntityTooLarge":
+			return ErrorClassStorage
+		}
+	}
+	// A source file removed while it was read
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && errors.Is(err, fs.ErrNotExist) {
+		return ErrorClassTransfer
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.EROFS) {
+		return ErrorClassStorage
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"cannot connect", "connection refused", "connection reset", "connection timed out",
+		"i/o timeout", "no route to host", "network is unreachable", "broken pipe", "handshake failed", "connection lost"} {
+		if strings.Contains(msg, s) {
+			return ErrorClassConnection
+		}
+	}
+	if strings.Contains(msg, "no space left") || strings.Contains(msg, "disk quota exceeded") {
+		return ErrorClassStorage
+	}
+	if strings.Contains(msg, "checksum mismatch") || strings.Contains(msg, "changed during transfer") {
+		return ErrorClassTransfer
+	}
+	return ErrorClassOther
+}
+
+// shouldRetry reports whether a failed attempt of the backup is tried again.
+func shouldRetry(backup db.Backup, attempt int, class string) bool {
+	if attempt >= backup.MaxAttempts {
+		return false
+	}
+	retryOn := []string(backup.RetryOn)
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, c := range retryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay is the backoff after the given failed attempt: the base delay,
+// doubled for every further attempt.
+func retryDelay(backup db.Backup, attempt int) time.Duration {
+	delay := time.Duration(backup.RetryBackoffSec) * time.Second
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
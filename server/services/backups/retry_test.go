@@ -0,0 +1,130 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"snaptrack/db"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"source missing", fmt.Errorf("backup home: %w", ErrSourceMissing), ErrorClassSource},
+		{"sftp connection lost", fmt.Errorf("upload: %w", sftp.ErrSSHFxConnectionLost), ErrorClassConnection},
+		{"sftp no connection", sftp.ErrSSHFxNoConnection, ErrorClassConnection},
+		{"net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")}, ErrorClassConnection},
+		{"dial refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrorClassConnection},
+		{"errno refused", syscall.ECONNREFUSED, ErrorClassConnection},
+		{"ssh exit missing", fmt.Errorf("run: %w", &ssh.ExitMissingError{}), ErrorClassConnection},
+		{"sftp no space", fmt.Errorf("write: %w", &sftp.StatusError{Code: sftpNoSpace}), ErrorClassStorage},
+		{"sftp quota", &sftp.StatusError{Code: sftpQuotaExceeded}, ErrorClassStorage},
+		{"sftp other status", &sftp.StatusError{Code: 3}, ErrorClassOther},
+		{"s3 slow down", minio.ErrorResponse{Code: "SlowDown"}, ErrorClassConnection},
+		{"s3 unavailable", fmt.Errorf("put: %w", minio.ErrorResponse{Code: "ServiceUnavailable"}), ErrorClassConnection},
+		{"s3 quota", minio.ErrorResponse{Code: "QuotaExceeded"}, ErrorClassStorage},
+		{"s3 too large", minio.ErrorResponse{Code: "EntityTooLarge"}, ErrorClassStorage},
+		{"s3 access denied", minio.ErrorResponse{Code: "AccessDenied", Message: "Access Denied."}, ErrorClassOther},
+		{"file vanished", &fs.PathError{Op: "open", Path: "/srv/a", Err: syscall.ENOENT}, ErrorClassTransfer},
+		{"permission denied", &fs.PathError{Op: "open", Path: "/srv/a", Err: syscall.EACCES}, ErrorClassOther},
+		{"enospc", &fs.PathError{Op: "write", Path: "/backups/a", Err: syscall.ENOSPC}, ErrorClassStorage},
+		{"edquot", fmt.Errorf("write: %w", syscall.EDQUOT), ErrorClassStorage},
+		{"erofs", syscall.EROFS, ErrorClassStorage},
+		{"refused message", errors.New("dial tcp 10.0.0.1:22: Connection Refused"), ErrorClassConnection},
+		{"handshake message", errors.New("ssh: handshake failed: EOF"), ErrorClassConnection},
+		{"broken pipe message", errors.New("write: broken pipe"), ErrorClassConnection},
+		{"no space message", errors.New("remote: No space left on device"), ErrorClassStorage},
+		{"quota message", errors.New("Disk quota exceeded"), ErrorClassStorage},
+		{"checksum message", errors.New("checksum mismatch for a.tar.gz"), ErrorClassTransfer},
+		{"changed message", errors.New("file changed during transfer"), ErrorClassTransfer},
+		{"other", errors.New("tar: invalid header"), ErrorClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  db.Backup
+		attempt int
+		class   string
+		want    bool
+	}{
+		{"single attempt", db.Backup{MaxAttempts: 1}, 1, ErrorClassConnection, false},
+		{"zero attempts", db.Backup{MaxAttempts: 0}, 1, ErrorClassConnection, false},
+		{"default classes", db.Backup{MaxAttempts: 3}, 1, ErrorClassConnection, true},
+		{"default skips storage", db.Backup{MaxAttempts: 3}, 1, ErrorClassStorage, false},
+		{"last attempt", db.Backup{MaxAttempts: 3}, 3, ErrorClassTransfer, false},
+		{"listed class", db.Backup{MaxAttempts: 3, RetryOn: []string{ErrorClassStorage}}, 2, ErrorClassStorage, true},
+		{"unlisted class", db.Backup{MaxAttempts: 3, RetryOn: []string{ErrorClassStorage}}, 1, ErrorClassConnection, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldRetry(tt.backup, tt.attempt, tt.class); got != tt.want {
+				t.Errorf("shouldRetry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff int
+		attempt int
+		want    time.Duration
+	}{
+		{60, 1, time.Minute},
+		{60, 2, 2 * time.Minute},
+		{60, 4, 8 * time.Minute},
+		{0, 5, 0},
+		{3600, 10, maxRetryDelay},
+		{86400, 1, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		got := retryDelay(db.Backup{RetryBackoffSec: tt.backoff}, tt.attempt)
+		if got != tt.want {
+			t.Errorf("retryDelay(%ds, attempt %d) = %v, want %v", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  db.Backup
+		wantErr bool
+	}{
+		{"defaults", db.Backup{MaxAttempts: DefaultMaxAttempts, RetryBackoffSec: DefaultRetryBackoffSec}, false},
+		{"zero", db.Backup{}, false},
+		{"max", db.Backup{MaxAttempts: 20}, false},
+		{"too many", db.Backup{MaxAttempts: 21}, true},
+		{"negative attempts", db.Backup{MaxAttempts: -1}, true},
+		{"negative backoff", db.Backup{RetryBackoffSec: -1}, true},
+		{"known classes", db.Backup{RetryOn: []string{ErrorClassSource, ErrorClassOther}}, false},
+		{"unknown class", db.Backup{RetryOn: []string{"timeout"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRetry(tt.backup); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRetry error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"snaptrack/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultArchiveName is used when a backup has no naming template.
+const DefaultArchiveName = "{job}-{server}-{timestamp}"
+
+var archivePlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// knownArchiveExts are stripped from rendered names so the extension always
+// reflects how the archive is actually encoded.
+var knownArchiveExts = []string{".tar.gz", ".tar.zst", ".tar.xz", ".tgz", ".tzst", ".txz", ".tar", ".gz", ".zst", ".xz", ".zip"}
+
+// archiveExt returns the file extension matching the archive encoding.
+// Encrypted archives get an additional .age suffix.
+func archiveExt(backup db.Backup) string {
+	ext := ""
+	switch backup.FileType {
+	case "tar":
+		ext = tarExt(compressionOf(backup))
+	case "zip":
+		ext = ".zip"
+	}
+	if ext != "" && encrypted(backup.Encryption) {
+		ext += ".age"
+	}
+	return ext
+}
+
+// ValidateArchiveName checks a naming template for unknown placeholders and
+// path separators. Every run needs a name of its own, so the template has to
+// contain {timestamp} or {run}; otherwise a run would overwrite the archive of
+// the previous one.
+func ValidateArchiveName(template string) error {
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("archive name must not contain path separators")
+	}
+	for _, m := range archivePlaceholder.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "job", "server", "timestamp", "date", "run", "type":
+		default:
+			return fmt.Errorf("unknown archive name placeholder {%s}", m[1])
+		}
+	}
+	if strings.TrimSpace(template) != "" && !uniqueArchiveName(template) {
+		return fmt.Errorf("archive name must contain {timestamp} or {run}")
+	}
+	return nil
+}
+
+func uniqueArchiveName(template string) bool {
+	return strings.Contains(template, "{timestamp}") || strings.Contains(template, "{run}")
+}
+
+// renderArchiveName expands the backup's naming template for a run.
+func renderArchiveName(backup db.Backup, server db.Server, run *db.BackupRun) string {
+	template := DefaultArchiveName
+	if backup.ArchiveName != nil && strings.TrimSpace(*backup.ArchiveName) != "" {
+		template = strings.TrimSpace(*backup.ArchiveName)
+	}
+	if !uniqueArchiveName(template) {
+		// Templates stored before they were validated
+		template += "-{run}"
+	}
+	started := run.StartedAt.UTC()
+	values := map[string]string{
+		"job":       sanitizeName(backup.Name),
+		"server":    sanitizeName(server.Name),
+		"timestamp": started.Format("20060102-150405"),
+		"date":      started.Format("2006-01-02"),
+		"run":       strconv.FormatUint(uint64(run.ID), 10),
+		"type":      run.Type,
+	}
+	name := archivePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		return values[m[1:len(m)-1]]
+	})
+	if strings.HasSuffix(strings.ToLower(name), ".age") {
+		name = name[:len(name)-len(".age")]
+	}
+	for _, ext := range knownArchiveExts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	return name + archiveExt(backup)
+}
+
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// archivePath returns where a run stores its data on the target: a new
+// archive file per run for tar/zip, the destination directory for raw, or
+// the snapshot of the run in the repository for repo. On S3 servers it is
+// the object key of the archive.
+func archivePath(backup db.Backup, server db.Server, run *db.BackupRun) string {
+	if backup.FileType == "raw" {
+		return backup.Destination
+	}
+	if backup.FileType == "repo" {
+		return repoObject(server, repoRoot(backup, server), "snapshots", renderArchiveName(backup, server, run))
+	}
+	if server.Type == "s3" {
+		return s3Key(backup.Destination, renderArchiveName(backup, server, run))
+	}
+	return filepath.Join(backup.Destination, renderArchiveName(backup, server, run))
+}
+
+// startRun records a new running BackupRun for the given target server.
+// Incremental backups are based on the last completed run of the same job on
+// the same server; without one the run falls back to a full backup. attempt
+// counts the tries of the queued job the run belongs to.
+func (bs *BackupService) startRun(backup db.Backup, server db.Server, executedBy string, attempt int) *db.BackupRun {
+	run := &db.BackupRun{
+		BackupID:    backup.ID,
+		ServerID:    server.ID,
+		Type:        "full",
+		Compression: "none",
+		Encryption:  "none",
+		Attempt:     attempt,
+		Status:      "running",
+		StartedAt:   time.Now(),
+		ExecutedBy:  executedBy,
+	}
+	if backup.FileType != "raw" {
+		run.Compression = compressionOf(backup)
+		if encrypted(backup.Encryption) {
+			run.Encryption = backup.Encryption
+		}
+	}
+	if backup.Type == "incremental" {
+		var parent db.BackupRun
+		err := db.DB.Where("backup_id = ? AND server_id = ? AND status = ?", backup.ID, server.ID, "completed").
+			Order("started_at DESC").First(&parent).Error
+		if err == nil {
+			run.Type = "incremental"
+			run.ParentRunID = &parent.ID
+		}
+	}
+	db.DB.Create(run)
+
+	path := archivePath(backup, server, run)
+	run.ArchivePath = &path
+	db.DB.Save(run)
+	return run
+}
+
+// finishRun stores the outcome of a run.
+func (bs *BackupService) finishRun(run *db.BackupRun, size int64, checksum string, runErr error) {
+	now := time.Now()
+	run.CompletedAt = &now
+	run.DurationSec = int64(now.Sub(run.StartedAt).Seconds())
+	if errors.Is(runErr, ErrCancelled) {
+		run.Status = "cancelled"
+	} else if runErr != nil {
+		msg := runErr.Error()
+		class := ClassifyError(runErr)
+		run.Status = "failed"
+		run.Error = &msg
+		run.ErrorClass = &class
+	} else {
+		run.Status = "completed"
+		run.SizeBytes = size
+		run.Checksum = &checksum
+	}
+	db.DB.Save(run)
+}
+
+// ListRuns returns the run history of a backup, newest first.
+func (bs *BackupService) ListRuns(backupID uint) ([]db.BackupRun, error) {
+	var runs []db.BackupRun
+	err := db.DB.Where("backup_id = ?", backupID).Order("started_at DESC").Find(&runs).Error
+	return runs, err
+}
+
+// GetRun loads a single run of a backup.
+func (bs *BackupService) GetRun(backupID, runID uint) (*db.BackupRun, error) {
+	var run db.BackupRun
+	if err := db.DB.Where("backup_id = ?", backupID).First(&run, runID).Error; err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
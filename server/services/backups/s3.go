@@ -0,0 +1,294 @@
+package backups
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"snaptrack/db"
+	"snaptrack/services/secrets"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 servers store archives as objects in a bucket of an S3-compatible
+// service (AWS, MinIO, Ceph RGW). The host of the server is the endpoint, the
+// destination of a backup the key prefix its archives are stored under.
+
+// s3PartSize is the size of the parts archives are uploaded in. One part is
+// buffered in memory while the archive is streamed. The size is not known up
+// front, so the part size has to cover the largest archive: S3 allows at most
+// 10,000 parts, which caps objects at s3MaxObjectSize (1.25 TiB).
+const (
+	s3PartSize      = 128 << 20
+	s3MaxParts      = 10000
+	s3MaxObjectSize = int64(s3PartSize) * s3MaxParts
+)
+
+// configureS3 checks the settings of an S3 server and seals a new secret
+// access key into it. A nil or empty secret keeps the sealed one.
+func configureS3(server *db.Server, secret *string) error {
+	if _, _, err := s3Endpoint(server.Host); err != nil {
+		return err
+	}
+	if server.Bucket == nil || strings.TrimSpace(*server.Bucket) == "" {
+		return errors.New("a bucket is required for S3 servers")
+	}
+	if server.AccessKeyID == nil || strings.TrimSpace(*server.AccessKeyID) == "" {
+		return errors.New("an access key ID is required for S3 servers")
+	}
+	if secret != nil && strings.TrimSpace(*secret) != "" {
+		sealed, err := secrets.Seal(*secret)
+		if err != nil {
+			return fmt.Errorf("failed to store secret access key: %v", err)
+		}
+		server.SealedSecretKey = &sealed
+	}
+	if server.SealedSecretKey == nil {
+		return errors.New("a secret access key is required for S3 servers")
+	}
+	return nil
+}
+
+// s3Endpoint splits the host of an S3 server into the endpoint address and
+// whether it is reached over TLS. Hosts without a scheme use https.
+func s3Endpoint(host string) (string, bool, error) {
+	host = strings.TrimSpace(host)
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" {
+		return "", false, fmt.Errorf("invalid S3 endpoint %q", host)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false, fmt.Errorf("unsupported S3 endpoint scheme %q", u.Scheme)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return "", false, errors.New("the S3 endpoint must not contain a path; use the bucket and destination instead")
+	}
+	return u.Host, u.Scheme == "https", nil
+}
+
+// newS3Client connects to the endpoint of an S3 server with its credentials.
+func newS3Client(server db.Server) (*minio.Client, error) {
+	endpoint, secure, err := s3Endpoint(server.Host)
+	if err != nil {
+		return nil, err
+	}
+	if server.AccessKeyID == nil || server.SealedSecretKey == nil {
+		return nil, fmt.Errorf("S3 server %s has no credentials", server.Name)
+	}
+	secret, err := secrets.Open(*server.SealedSecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret access key of %s: %v", server.Name, err)
+	}
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(*server.AccessKeyID, secret, ""),
+		Secure: secure,
+		// Required for the checksums sent with streamed uploads
+		TrailingHeaders: true,
+	}
+	if server.Region != nil {
+		opts.Region = *server.Region
+	}
+	return minio.New(endpoint, opts)
+}
+
+// checkS3Server checks that the bucket of an S3 server can be reached with
+// its credentials.
+func checkS3Server(server db.Server) error {
+	client, err := newS3Client(server)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, *server.Bucket)
+	if err != nil {
+		return fmt.Errorf("failed to reach bucket %s: %w", *server.Bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", *server.Bucket)
+	}
+	return nil
+}
+
+// s3Key returns the object key of an archive under the destination of a
+// backup.
+func s3Key(destination, name string) string {
+	return path.Join(strings.Trim(destination, "/"), name)
+}
+
+// s3Destination stores runs as objects in the bucket of an S3 server.
+type s3Destination struct {
+	server db.Server
+	client *minio.Client
+	bucket string
+	job    *jobControl
+}
+
+func openS3(server db.Server, job *jobControl) (*s3Destination, error) {
+	client, err := newS3Client(server)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Destination{server: server, client: client, bucket: *server.Bucket, job: job}, nil
+}
+
+// s3Error maps the missing objects of S3 errors to fs.ErrNotExist.
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+// Create streams the object in a multipart upload, without a local copy.
+// The CRC32C of the object is sent along and compared with the checksum the
+// server reports once the upload is complete.
+func (d *s3Destination) Create(name string) (ObjectWriter, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{d: d, key: name, pw: pw, crc: crc32.New(crc32.MakeTable(crc32.Castagnoli)), done: make(chan error, 1)}
+	opts := minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+		Checksum:    minio.ChecksumFullObjectCRC32C,
+	}
+	if d.server.StorageClass != nil {
+		opts.StorageClass = *d.server.StorageClass
+	}
+	go func() {
+		_, err := d.client.PutObject(d.job.context(), d.bucket, name, pr, -1, opts)
+		// A failed upload stops the writer with its error
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type s3Writer struct {
+	d    *s3Destination
+	key  string
+	pw   *io.PipeWriter
+	crc  hash.Hash32
+	size int64
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > s3MaxObjectSize {
+		return 0, fmt.Errorf("archive %s is larger than %d GiB, the most an S3 upload of %d parts of %d MiB holds",
+			w.key, s3MaxObjectSize>>30, s3MaxParts, s3PartSize>>20)
+	}
+	n, err := w.pw.Write(p)
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Commit() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		w.removeIncomplete()
+		if w.d.job.cancelled() {
+			return ErrCancelled
+		}
+		return fmt.Errorf("upload to %s failed: %w", w.d.server.Name, err)
+	}
+	info, err := w.d.client.StatObject(w.d.job.context(), w.d.bucket, w.key, minio.StatObjectOptions{Checksum: true})
+	if err != nil {
+		return fmt.Errorf("failed to verify %s on %s: %w", w.key, w.d.server.Name, err)
+	}
+	// Services that do not keep checksums are only checked by size
+	crc := base64.StdEncoding.EncodeToString(w.crc.Sum(nil))
+	if info.Size != w.size || (info.ChecksumCRC32C != "" && info.ChecksumCRC32C != crc) {
+		w.d.Delete(w.key)
+		return fmt.Errorf("checksum mismatch for %s on %s", w.key, w.d.server.Name)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() {
+	w.pw.CloseWithError(errors.New("upload aborted"))
+	<-w.done
+	w.removeIncomplete()
+}
+
+// removeIncomplete aborts what is left of a failed multipart upload; the
+// client cannot do so itself once the job context is cancelled.
+func (w *s3Writer) removeIncomplete() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	w.d.client.RemoveIncompleteUpload(ctx, w.d.bucket, w.key)
+}
+
+func (d *s3Destination) Open(name string) (io.ReadCloser, error) {
+	obj, err := d.client.GetObject(d.job.context(), d.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject does not fail for missing objects until the first read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return s3Reader{Reader: jobReader{r: obj, job: d.job}, obj: obj}, nil
+}
+
+type s3Reader struct {
+	io.Reader
+	obj *minio.Object
+}
+
+func (r s3Reader) Close() error {
+	return r.obj.Close()
+}
+
+func (d *s3Destination) Stat(name string) (ObjectInfo, error) {
+	info, err := d.client.StatObject(d.job.context(), d.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// List returns the objects and common prefixes directly below dir.
+func (d *s3Destination) List(dir string) ([]ObjectInfo, error) {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var list []ObjectInfo
+	for obj := range d.client.ListObjects(d.job.context(), d.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, s3Error(obj.Err)
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			list = append(list, ObjectInfo{Name: strings.TrimSuffix(obj.Key, "/"), IsDir: true})
+			continue
+		}
+		list = append(list, ObjectInfo{Name: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return list, nil
+}
+
+func (d *s3Destination) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return d.client.RemoveObject(ctx, d.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (d *s3Destination) Close() error {
+	return nil
+}
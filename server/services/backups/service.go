@@ -2,9 +2,9 @@ package backups
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"snaptrack/db"
 	"sync"
 	"time"
@@ -15,15 +15,44 @@ import (
 type BackupService struct {
     clients   map[*websocket.Conn]bool
     clientsMu sync.RWMutex
+    jobs      map[uint]*jobControl // running jobs by progress ID
+    jobsMu    sync.Mutex
+
+    queueWake         chan struct{}
+    maxConcurrent     int
+    serverConcurrency int
 }
 
 
 func timePtr(t time.Time) *time.Time { return &t }
 
+// saveBackupState writes the status of a run to its backup. Only the status
+// columns are written: the backup may have been edited or rescheduled since
+// it was loaded.
+func saveBackupState(backup db.Backup) error {
+	return db.DB.Model(&db.Backup{}).Where("id = ?", backup.ID).UpdateColumns(map[string]interface{}{
+		"status":       backup.Status,
+		"started_at":   backup.StartedAt,
+		"completed_at": backup.CompletedAt,
+		"duration_sec": backup.DurationSec,
+		"size_bytes":   backup.SizeBytes,
+		"checksum":     backup.Checksum,
+	}).Error
+}
+
+// ErrAlreadyRunning is returned by StartBackup when the backup is already
+// queued or running.
+var ErrAlreadyRunning = errors.New("backup is already running")
+
 
 func NewBackupService() *BackupService {
     return &BackupService{
         clients: make(map[*websocket.Conn]bool),
+        jobs:    make(map[uint]*jobControl),
+
+        queueWake:         make(chan struct{}, 1),
+        maxConcurrent:     defaultMaxConcurrent,
+        serverConcurrency: defaultServerConcurrency,
     }
 }
 
@@ -39,87 +68,139 @@ func (bs *BackupService) RemoveClient(c *websocket.Conn) {
     bs.clientsMu.Unlock()
 }
 
-func (bs *BackupService) ExecuteBackupAsync(backup db.Backup) {
+// StartBackup queues the backup for the worker pool. A backup that is
+// already queued or running returns ErrAlreadyRunning.
+func (bs *BackupService) StartBackup(backup db.Backup, executedBy string) error {
+	_, err := bs.Enqueue(backup, executedBy)
+	return err
+}
+
+// ExecuteBackupAsync runs the backup against each of its servers, recording a
+// BackupRun per server. executedBy names the user or component that started it.
+func (bs *BackupService) ExecuteBackupAsync(backup db.Backup, executedBy string) {
+	bs.executeAttempt(backup, executedBy, 1)
+}
+
+// executeAttempt is one attempt at running a backup. It returns why the
+// attempt failed, so the queue can decide whether to retry it.
+func (bs *BackupService) executeAttempt(backup db.Backup, executedBy string, attempt int) error {
 	startTime := time.Now()
 	progress := &db.BackupProgress{
-		BackupID: backup.ID,
-		Status:   "running",
-		Progress: 0,
-		Message:  "Starting backup...",
+		BackupID:  backup.ID,
+		Operation: "backup",
+		Status:    "running",
+		Progress:  0,
+		Message:   startMessage(backup, attempt),
 	}
 	db.DB.Create(progress)
 	bs.BroadcastProgress(progress)
+	job := bs.startJob(progress)
+	defer func() { bs.endJob(job) }()
 
 	var serverIDs []uint
 	if len(backup.ServerIDs) > 0 {
 		if err := json.Unmarshal(backup.ServerIDs, &serverIDs); err != nil {
-			bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Invalid server_ids format: %v", err))
-			return
+			return bs.failAttempt(progress, fmt.Errorf("Invalid server_ids format: %v", err))
 		}
 	}
 
-	hasRemote := false
+	var servers []db.Server
 	for _, serverID := range serverIDs {
 		var server db.Server
 		if err := db.DB.First(&server, serverID).Error; err != nil {
-			bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Server %d not found: %v", serverID, err))
-			return
+			return bs.failAttempt(progress, fmt.Errorf("Server %d not found: %v", serverID, err))
 		}
+		servers = append(servers, server)
 
 		if server.Type == "remote" {
-			hasRemote = true
-			if err := validateRemoteServer(server.Host, server.SSHUser, server.SSHKeyPath, server.SSHPort, server.TransferType); err != nil {
-				bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Remote server validation failed: %v", err))
-				return
+			if err := validateRemoteServer(server); err != nil {
+				return bs.failRuns(progress, backup, []db.Server{server}, executedBy, attempt, fmt.Errorf("Remote server validation failed: %w", err))
+			}
+		}
+		if server.Type != "local" && server.Type != "remote" {
+			if err := CheckDestination(server); err != nil {
+				return bs.failRuns(progress, backup, []db.Server{server}, executedBy, attempt, fmt.Errorf("Server %s validation failed: %w", server.Name, err))
 			}
 		}
 	}
 
-	if hasRemote {
-		if _, err := exec.LookPath("rsync"); err != nil {
-			bs.updateProgress(progress, 0, "failed", "rsync command not found in PATH")
-			return
+	// data is the backup as the runs read it: a source on a remote server is
+	// pulled into a staging directory once and archived from there
+	data := backup
+	// Databases and docker volumes are dumped by each run, on the source
+	// server if any
+	if !isDumpSource(backup) && backup.SourceServerID != nil {
+		var source db.Server
+		if err := db.DB.First(&source, *backup.SourceServerID).Error; err != nil {
+			return bs.failAttempt(progress, fmt.Errorf("Source server %d not found: %v", *backup.SourceServerID, err))
+		}
+		staged, err := bs.pullSource(backup, source, progress)
+		if errors.Is(err, ErrCancelled) || job.cancelled() {
+			bs.updateProgress(progress, progress.Progress, "cancelled", "Backup cancelled")
+			return ErrCancelled
+		}
+		if err != nil {
+			return bs.failRuns(progress, backup, servers, executedBy, attempt, fmt.Errorf("Failed to pull source from %s: %w", source.Name, err))
 		}
+		data.Source = staged
+	} else if _, err := os.Stat(backup.Source); os.IsNotExist(err) && !isDumpSource(backup) {
+		// Validate source path
+		return bs.failRuns(progress, backup, servers, executedBy, attempt, fmt.Errorf("%w: %s", ErrSourceMissing, backup.Source))
 	}
 
-	// Validate source path
-	if _, err := os.Stat(backup.Source); os.IsNotExist(err) {
-		bs.updateProgress(progress, 0, "failed", fmt.Sprintf("Source path does not exist: %s", backup.Source))
-		return
-	}
+	// Handle each server separately; every server gets its own run
+	for i, server := range servers {
+		run := bs.startRun(backup, server, executedBy, attempt)
+		if i > 0 {
+			progress = &db.BackupProgress{
+				BackupID:  backup.ID,
+				Operation: "backup",
+				Status:    "running",
+				Message:   startMessage(backup, attempt),
+			}
+		}
+		progress.RunID = &run.ID
+		bs.saveProgress(progress)
+		job.attach(progress)
 
-	// Handle each server separately
-	for _, serverID := range serverIDs {
-		var server db.Server
-		db.DB.First(&server, serverID)
-
-        if server.Type == "local" {
-            totalSize, checksum, err := bs.runLocalBackup(backup, progress)
-            if err != nil {
-                bs.updateProgress(progress, progress.Progress, "failed", fmt.Sprintf("Local backup failed: %v", err))
-                // Persist backup failed status
-                backup.Status = "failed"
-                backup.CompletedAt = timePtr(time.Now())
-                backup.DurationSec = int64(time.Since(startTime).Seconds())
-                db.DB.Save(&backup)
-                db.DB.Create(&db.Log{Level: "error", Message: fmt.Sprintf("Backup %s failed: %v", backup.Name, err)})
-                return
-            }
-			backup.SizeBytes = totalSize
-			backup.Checksum = &checksum
-
-		} else if server.Type == "remote" {
-            err := bs.runRemoteBackup(backup, server, progress)
-            if err != nil {
-                bs.updateProgress(progress, progress.Progress, "failed", fmt.Sprintf("Remote backup failed: %v", err))
-                // Persist backup failed status
-                backup.Status = "failed"
-                backup.CompletedAt = timePtr(time.Now())
-                backup.DurationSec = int64(time.Since(startTime).Seconds())
-                db.DB.Save(&backup)
-                db.DB.Create(&db.Log{Level: "error", Message: fmt.Sprintf("Backup %s failed: %v", backup.Name, err)})
-                return
-            }
+		var totalSize int64
+		var checksum string
+		dest, err := openDestination(server, job, bs.newProgressTracker(progress))
+		if err == nil {
+			totalSize, checksum, err = bs.runBackup(data, server, dest, run, progress)
+			dest.Close()
+		}
+		if err != nil && job.cancelled() {
+			err = ErrCancelled
+		}
+		if err != nil && !errors.Is(err, ErrCancelled) {
+			err = fmt.Errorf("Backup to %s failed: %w", server.Name, err)
+		}
+		bs.finishRun(run, totalSize, checksum, err)
+
+		if errors.Is(err, ErrCancelled) {
+			bs.updateProgress(progress, progress.Progress, "cancelled", "Backup cancelled")
+			backup.Status = "cancelled"
+			backup.CompletedAt = timePtr(time.Now())
+			backup.DurationSec = int64(time.Since(startTime).Seconds())
+			saveBackupState(backup)
+			db.DB.Create(&db.Log{Level: "warning", Message: fmt.Sprintf("Backup %s was cancelled", backup.Name)})
+			return err
+		}
+		if err != nil {
+			bs.updateProgress(progress, progress.Progress, "failed", err.Error())
+			// Persist backup failed status
+			backup.Status = "failed"
+			backup.CompletedAt = timePtr(time.Now())
+			backup.DurationSec = int64(time.Since(startTime).Seconds())
+			saveBackupState(backup)
+			db.DB.Create(&db.Log{Level: "error", Message: fmt.Sprintf("Backup %s failed: %v", backup.Name, err)})
+			return err
+		}
+		backup.SizeBytes = totalSize
+		backup.Checksum = &checksum
+		if i < len(servers)-1 {
+			bs.updateProgress(progress, 100, "completed", "Backup completed successfully")
 		}
 	}
 
@@ -128,13 +209,41 @@ func (bs *BackupService) ExecuteBackupAsync(backup db.Backup) {
         backup.Status = "completed"
         backup.CompletedAt = &now
         backup.DurationSec = int64(now.Sub(startTime).Seconds())
-        db.DB.Save(&backup)
+        saveBackupState(backup)
         db.DB.Create(&db.Log{
             Level:   "info",
             Message: fmt.Sprintf("Backup %s completed successfully", backup.Name),
         })
         bs.updateProgress(progress, 100, "completed", "Backup completed successfully")
     }
+    return nil
+}
+
+// failAttempt reports an attempt that failed before any run was started.
+func (bs *BackupService) failAttempt(progress *db.BackupProgress, err error) error {
+	bs.updateProgress(progress, 0, "failed", err.Error())
+	return err
+}
+
+// failRuns reports an attempt whose servers or source failed their checks,
+// recording a failed run per affected server so that every attempt, and the
+// class of its error, shows in the run history.
+func (bs *BackupService) failRuns(progress *db.BackupProgress, backup db.Backup, servers []db.Server, executedBy string, attempt int, err error) error {
+	for _, server := range servers {
+		run := bs.startRun(backup, server, executedBy, attempt)
+		bs.finishRun(run, 0, "", err)
+		if progress.RunID == nil {
+			progress.RunID = &run.ID
+		}
+	}
+	return bs.failAttempt(progress, err)
+}
+
+func startMessage(backup db.Backup, attempt int) string {
+	if attempt > 1 {
+		return fmt.Sprintf("Starting backup (attempt %d of %d)...", attempt, backup.MaxAttempts)
+	}
+	return "Starting backup..."
 }
 
 func (bs *BackupService) BroadcastProgress(progress *db.BackupProgress) {
@@ -159,6 +268,8 @@ func (bs *BackupService) BroadcastProgress(progress *db.BackupProgress) {
 	response := BackupProgressResponse{
 		ID:             progress.ID,
 		BackupID:       progress.BackupID,
+		RunID:          progress.RunID,
+		Operation:      progress.Operation,
 		Backup:         backup,
 		Servers:        servers,
 		Status:         progress.Status,
@@ -188,6 +299,6 @@ func (bs *BackupService) updateProgress(progress *db.BackupProgress, percentage
 	progress.Status = status
 	progress.Message = message
 	progress.UpdatedAt = time.Now()
-	db.DB.Save(progress)
+	bs.saveProgress(progress)
 	bs.BroadcastProgress(progress)
 }
\ No newline at end of file
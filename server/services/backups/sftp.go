@@ -0,0 +1,583 @@
+package backups
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer types of a remote server. Both run over SFTP; "rsync" skips files
+// the server already holds with the same size and modification time, "scp"
+// always copies everything.
+const (
+	TransferSync = "rsync"
+	TransferCopy = "scp"
+)
+
+// SFTP status codes for a full destination, see draft-ietf-secsh-filexfer.
+const (
+	sftpNoSpace       = 14
+	sftpQuotaExceeded = 15
+)
+
+// remoteConn is an SSH connection to a server with an SFTP session on top.
+// Transfers report their bytes to tracker, if set, and follow the pauses of
+// job; cancelling the job closes the connection so blocked transfers return.
+type remoteConn struct {
+	server  db.Server
+	ssh     *ssh.Client
+	sftp    *sftp.Client
+	job     *jobControl
+	tracker *progressTracker
+	stop    func() bool
+}
+
+// openRemote connects to a remote server for the job.
+func openRemote(server db.Server, job *jobControl) (*remoteConn, error) {
+	client, err := dialServer(server)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+	rc := &remoteConn{server: server, ssh: client, sftp: sc, job: job}
+	rc.stop = context.AfterFunc(job.context(), func() { client.Close() })
+	return rc, nil
+}
+
+func (rc *remoteConn) Close() {
+	rc.stop()
+	rc.sftp.Close()
+	rc.ssh.Close()
+}
+
+// err turns the error of a transfer into ErrCancelled when the job was
+// cancelled while it ran.
+func (rc *remoteConn) err(err error) error {
+	if err != nil && rc.job.cancelled() {
+		return ErrCancelled
+	}
+	return err
+}
+
+func (rc *remoteConn) reader(r io.Reader) io.Reader {
+	if rc.tracker != nil {
+		return rc.tracker.reader(r)
+	}
+	return jobReader{r: r, job: rc.job}
+}
+
+// run executes a shell command on the server, feeding it stdin.
+func (rc *remoteConn) run(cmd string, stdin io.Reader) (string, error) {
+	session, err := rc.ssh.NewSession()
+	if err != nil {
+		return "", rc.err(fmt.Errorf("failed to create SSH session: %w", err))
+	}
+	defer session.Close()
+	var out, stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &out
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return out.String(), rc.err(fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String())))
+	}
+	return out.String(), nil
+}
+
+// sha256 hashes files on the server with sha256sum, or shasum where
+// coreutils are missing. It returns the digests by path.
+func (rc *remoteConn) sha256(paths ...string) (map[string]string, error) {
+	sums := make(map[string]string, len(paths))
+	if len(paths) == 0 {
+		return sums, nil
+	}
+	var list bytes.Buffer
+	for _, p := range paths {
+		list.WriteString(p)
+		list.WriteByte(0)
+	}
+	out, err := rc.run("if command -v sha256sum >/dev/null 2>&1; then xargs -0 sha256sum --; else xargs -0 shasum -a 256 --; fi", &list)
+	if err != nil {
+		return nil, fmt.Errorf("remote checksum failed: %w", err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Names with a backslash or newline are escaped and the line starts
+		// with a backslash
+		escaped := strings.HasPrefix(line, `\`)
+		line = strings.TrimPrefix(line, `\`)
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		if escaped {
+			name = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(name)
+		}
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+// verify compares the digests of uploaded files with the server's. Files that
+// do not match are removed, so the next run transfers them again.
+func (rc *remoteConn) verify(want map[string]string) error {
+	paths := make([]string, 0, len(want))
+	for p := range want {
+		paths = append(paths, p)
+	}
+	got, err := rc.sha256(paths...)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for p, sum := range want {
+		if got[p] != sum {
+			rc.sftp.Remove(p)
+			bad = append(bad, p)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("checksum mismatch on %s for %s", rc.server.Name, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// partialPath names the partial upload of remote. key tells uploads of
+// different local data apart.
+func partialPath(remote, key string) string {
+	return path.Join(path.Dir(remote), "."+path.Base(remote)+"."+key+".part")
+}
+
+// archivePartial names the partial upload of an archive after its content.
+// Every attempt of a backup stages its archive under a new name, so the
+// partial upload of a backup job is named after the backup and the checksum
+// of the staged bytes: a retry continues it only when it stages the same
+// bytes. Encrypted archives get a new file key on every attempt, so their
+// uploads always start over.
+func (rc *remoteConn) archivePartial(name, checksum string) string {
+	if rc.job == nil {
+		return partialPath(name, checksum[:16])
+	}
+	return path.Join(path.Dir(name), fmt.Sprintf(".backup-%d-%s.part", rc.job.backupID, checksum[:16]))
+}
+
+// removePartials removes the partial uploads earlier attempts of the backup
+// job left next to name, once an archive of it is in place.
+func (rc *remoteConn) removePartials(name string) {
+	if rc.job == nil {
+		return
+	}
+	stale, _ := rc.sftp.Glob(path.Join(path.Dir(name), fmt.Sprintf(".backup-%d-*.part", rc.job.backupID)))
+	for _, p := range stale {
+		rc.sftp.Remove(p)
+	}
+}
+
+// upload copies a local file to remote and returns the SHA-256 of its
+// content. Data goes to the partial file part first, which is renamed into
+// place once complete; a partial file left by an interrupted upload is
+// continued rather than sent again if it holds the start of the file.
+func (rc *remoteConn) upload(local, remote, part string) (string, error) {
+	in, err := os.Open(local)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var offset int64
+	if st, err := rc.sftp.Stat(part); err == nil && st.Size() <= info.Size() {
+		offset = st.Size()
+	}
+	out, err := rc.sftp.OpenFile(part, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return "", rc.err(fmt.Errorf("failed to create %s on %s: %w", part, rc.server.Name, err))
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if offset > 0 {
+		// The part already sent still has to be hashed; it counts as
+		// transferred for the progress
+		if _, err := io.CopyN(hash, in, offset); err != nil {
+			return "", err
+		}
+		sums, err := rc.sha256(part)
+		if err == nil && sums[part] == hex.EncodeToString(hash.Sum(nil)) {
+			if rc.tracker != nil {
+				rc.tracker.add(offset)
+			}
+		} else {
+			// Left by an upload of other data: start over
+			offset = 0
+			hash.Reset()
+			if _, err := in.Seek(0, io.SeekStart); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := out.Truncate(offset); err != nil {
+		return "", rc.err(err)
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return "", rc.err(err)
+	}
+	if _, err := out.ReadFrom(io.TeeReader(rc.reader(in), hash)); err != nil {
+		return "", rc.err(err)
+	}
+	if err := out.Close(); err != nil {
+		return "", rc.err(err)
+	}
+
+	rc.sftp.Chmod(part, info.Mode().Perm())
+	rc.sftp.Chtimes(part, info.ModTime(), info.ModTime())
+	if err := rc.sftp.PosixRename(part, remote); err != nil {
+		// Servers without the posix-rename extension cannot replace files
+		rc.sftp.Remove(remote)
+		if err := rc.sftp.Rename(part, remote); err != nil {
+			return "", rc.err(fmt.Errorf("failed to move %s into place: %w", remote, err))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sftpDestination stores runs on an SSH server.
+type sftpDestination struct {
+	rc *remoteConn
+}
+
+// Create stages the archive in a local temporary file. Commit uploads it,
+// resuming a partial upload of the same archive left by an earlier attempt.
+func (d *sftpDestination) Create(name string) (ObjectWriter, error) {
+	dir, err := os.MkdirTemp("", "backup-*")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, path.Base(name)))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &sftpWriter{rc: d.rc, name: name, dir: dir, f: f, hash: sha256.New()}, nil
+}
+
+type sftpWriter struct {
+	rc   *remoteConn
+	name string
+	dir  string
+	f    *os.File
+	hash hash.Hash
+	size int64
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *sftpWriter) Commit() error {
+	defer os.RemoveAll(w.dir)
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	rc := w.rc
+	if t := rc.tracker; t != nil {
+		// The transfer continues the progress of archiving
+		p := t.progress
+		total := p.BytesProcessed + w.size
+		p.TotalBytes = &total
+		if total > 0 {
+			p.Progress = int(p.BytesProcessed * 100 / total)
+		}
+		t.bs.updateProgress(p, p.Progress, "running", fmt.Sprintf("Transferring to %s...", rc.server.Name))
+	}
+	if err := rc.sftp.MkdirAll(path.Dir(w.name)); err != nil {
+		return rc.err(fmt.Errorf("failed to create %s on %s: %w", path.Dir(w.name), rc.server.Name, err))
+	}
+	checksum := hex.EncodeToString(w.hash.Sum(nil))
+	sum, err := rc.upload(w.f.Name(), w.name, rc.archivePartial(w.name, checksum))
+	if err != nil {
+		return err
+	}
+	rc.removePartials(w.name)
+	if sum != checksum {
+		return fmt.Errorf("archive changed during transfer")
+	}
+	return nil
+}
+
+func (w *sftpWriter) Abort() {
+	w.f.Close()
+	os.RemoveAll(w.dir)
+}
+
+func (d *sftpDestination) Open(name string) (io.ReadCloser, error) {
+	f, err := d.rc.sftp.Open(name)
+	if err != nil {
+		return nil, d.rc.err(err)
+	}
+	return remoteReader{Reader: d.rc.reader(f), f: f}, nil
+}
+
+// remoteReader reads a remote file through the job and progress of its
+// connection.
+type remoteReader struct {
+	io.Reader
+	f *sftp.File
+}
+
+func (r remoteReader) Close() error {
+	return r.f.Close()
+}
+
+func (d *sftpDestination) Stat(name string) (ObjectInfo, error) {
+	info, err := d.rc.sftp.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, d.rc.err(err)
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (d *sftpDestination) List(dir string) ([]ObjectInfo, error) {
+	infos, err := d.rc.sftp.ReadDir(dir)
+	if err != nil {
+		return nil, d.rc.err(err)
+	}
+	list := make([]ObjectInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		list = append(list, ObjectInfo{Name: path.Join(dir, info.Name()), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()})
+	}
+	return list, nil
+}
+
+func (d *sftpDestination) Delete(name string) error {
+	return d.rc.err(d.rc.sftp.Remove(name))
+}
+
+func (d *sftpDestination) Close() error {
+	d.rc.Close()
+	return nil
+}
+
+// Checksum hashes an object on the server.
+func (d *sftpDestination) Checksum(name string) (string, error) {
+	sums, err := d.rc.sha256(name)
+	if err != nil {
+		return "", err
+	}
+	return sums[name], nil
+}
+
+// Mirror syncs the source into dir over SFTP, following the transfer type of
+// the server.
+func (d *sftpDestination) Mirror(source, dir string, filter *fileFilter, ix *fileIndex) error {
+	transfer := TransferSync
+	if d.rc.server.TransferType != nil && *d.rc.server.TransferType == TransferCopy {
+		transfer = TransferCopy
+	}
+	return d.rc.syncTree(source, dir, transfer, filter, ix)
+}
+
+// remoteDir caches the listing of a remote directory.
+type remoteDir map[string]os.FileInfo
+
+func (rc *remoteConn) listDir(dir string) remoteDir {
+	entries := make(remoteDir)
+	infos, err := rc.sftp.ReadDir(dir)
+	if err != nil {
+		return entries
+	}
+	for _, info := range infos {
+		entries[info.Name()] = info
+	}
+	return entries
+}
+
+// syncTree mirrors the entries of source the filter keeps into dir on the
+// server. With TransferSync, files the server already holds with the same
+// size and modification time are skipped; their size still counts towards
+// the progress. The index of the run is built on the way.
+func (rc *remoteConn) syncTree(source, dir, transfer string, filter *fileFilter, ix *fileIndex) error {
+	listings := make(map[string]remoteDir)
+	uploaded := make(map[string]string)
+	err := filter.walk(source, func(p, rel string, info os.FileInfo) error {
+		remote := path.Join(dir, filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			if err := rc.sftp.MkdirAll(remote); err != nil {
+				return rc.err(fmt.Errorf("failed to create %s on %s: %w", remote, rc.server.Name, err))
+			}
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if rc.tracker != nil {
+				rc.tracker.add(info.Size())
+			}
+			rc.sftp.Remove(remote)
+			return rc.err(rc.sftp.Symlink(target, remote))
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		parent := path.Dir(remote)
+		if listings[parent] == nil {
+			listings[parent] = rc.listDir(parent)
+		}
+		existing := listings[parent][path.Base(remote)]
+		same := existing != nil && existing.Mode().IsRegular() && existing.Size() == info.Size() &&
+			existing.ModTime().Unix() == info.ModTime().Unix()
+
+		var sum string
+		if transfer == TransferCopy || !same {
+			var err error
+			key := fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+			if sum, err = rc.upload(p, remote, partialPath(remote, key)); err != nil {
+				return err
+			}
+			uploaded[remote] = sum
+		} else if rc.tracker != nil {
+			rc.tracker.add(info.Size())
+		}
+
+		if ix == nil || ix.unchanged(rel, info) {
+			return nil
+		}
+		if sum == "" {
+			var err error
+			if sum, err = hashFile(p); err != nil {
+				return err
+			}
+		}
+		ix.add(rel, info, sum)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files removed from the source since the parent run, as the local
+	// mirror does
+	if ix != nil {
+		for _, rel := range ix.deleted() {
+			remote := path.Join(dir, filepath.ToSlash(rel))
+			if err := rc.sftp.Remove(remote); err != nil && !isNotExist(err) {
+				return rc.err(fmt.Errorf("failed to remove deleted file %s on %s: %w", remote, rc.server.Name, err))
+			}
+		}
+	}
+	return rc.verify(uploaded)
+}
+
+// download copies a remote file to local and returns the SHA-256 of its
+// content.
+func (rc *remoteConn) download(remote, local string) (string, error) {
+	in, err := rc.sftp.Open(remote)
+	if err != nil {
+		return "", rc.err(fmt.Errorf("failed to open %s on %s: %w", remote, rc.server.Name, err))
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", rc.err(err)
+	}
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), rc.reader(in)); err != nil {
+		out.Close()
+		return "", rc.err(err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), os.Chtimes(local, info.ModTime(), info.ModTime())
+}
+
+// pushTree copies the local directory source into dir on the server. policy
+// is the overwrite policy of a restore: "skip" keeps existing files and
+// "newer" keeps files that are at least as recent as the restored ones.
+func (rc *remoteConn) pushTree(source, dir, policy string) error {
+	listings := make(map[string]remoteDir)
+	return filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := rc.job.wait(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(dir, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return rc.err(rc.sftp.MkdirAll(remote))
+		}
+
+		parent := path.Dir(remote)
+		if listings[parent] == nil {
+			listings[parent] = rc.listDir(parent)
+		}
+		if existing := listings[parent][path.Base(remote)]; existing != nil {
+			if policy == "skip" || (policy == "newer" && !existing.ModTime().Before(info.ModTime())) {
+				if rc.tracker != nil {
+					rc.tracker.add(info.Size())
+				}
+				return nil
+			}
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			rc.sftp.Remove(remote)
+			return rc.err(rc.sftp.Symlink(target, remote))
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		key := fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+		_, err = rc.upload(p, remote, partialPath(remote, key))
+		return err
+	})
+}
+
+// isStorageFull reports whether the server refused a write for lack of space.
+func isStorageFull(err error) bool {
+	var status *sftp.StatusError
+	return errors.As(err, &status) && (status.Code == sftpNoSpace || status.Code == sftpQuotaExceeded)
+}
@@ -0,0 +1,232 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"strconv"
+	"strings"
+)
+
+// ValidateSource checks the source server of a backup. The source of a
+// backup read from a remote server is an absolute path on that server, except
+// for database dumps and docker sources, whose source names a database or a
+// container.
+func ValidateSource(backup db.Backup) error {
+	if backup.SourceServerID == nil {
+		return nil
+	}
+	var server db.Server
+	if err := db.DB.First(&server, *backup.SourceServerID).Error; err != nil {
+		return fmt.Errorf("source server %d not found", *backup.SourceServerID)
+	}
+	if server.Type != "remote" {
+		return fmt.Errorf("source server %s is not a remote server", server.Name)
+	}
+	if isDumpSource(backup) && backup.SourceType != SourceSQLite {
+		return nil
+	}
+	if !path.IsAbs(backup.Source) {
+		return fmt.Errorf("source must be an absolute path on %s", server.Name)
+	}
+	return nil
+}
+
+// stagingDir is where the source of a backup read from a remote server is
+// mirrored. It is kept between runs, so later pulls only fetch changes.
+func stagingDir(backup db.Backup) string {
+	base := os.Getenv("BACKUP_STAGING_DIR")
+	if base == "" {
+		base = filepath.Join(os.TempDir(), "snaptrack-staging")
+	}
+	return filepath.Join(base, strconv.FormatUint(uint64(backup.ID), 10))
+}
+
+// RemoveStaging deletes the staged source of a backup.
+func RemoveStaging(backupID uint) error {
+	return os.RemoveAll(stagingDir(db.Backup{ID: backupID}))
+}
+
+// remoteEntry is an entry of a source tree on a remote server.
+type remoteEntry struct {
+	path string
+	rel  string
+	info os.FileInfo
+}
+
+// walkRemote lists the entries of a source tree on a remote server that the
+// filter keeps, reading ignore files from the server.
+func (f *fileFilter) walkRemote(rc *remoteConn, source string) ([]remoteEntry, error) {
+	var entries []remoteEntry
+	walker := rc.sftp.Walk(source)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, rc.err(err)
+		}
+		if err := f.job.wait(); err != nil {
+			return nil, err
+		}
+		p, info := walker.Path(), walker.Stat()
+		rel := "."
+		if p != source {
+			rel = strings.TrimPrefix(p, strings.TrimSuffix(source, "/")+"/")
+		}
+		if f.skip(rel, info) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if info.IsDir() {
+			if file, err := rc.sftp.Open(path.Join(p, IgnoreFileName)); err == nil {
+				err = f.readIgnoreRules(file, rel)
+				file.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		entries = append(entries, remoteEntry{path: p, rel: rel, info: info})
+	}
+	return entries, nil
+}
+
+// pullSource mirrors the source of a backup from the server it lives on into
+// the staging directory and returns the directory. Files whose size and
+// modification time match the staged copy are not fetched again; staged
+// entries that are gone from the server are removed. Fetched files are
+// verified against checksums computed on the server.
+func (bs *BackupService) pullSource(backup db.Backup, server db.Server, progress *db.BackupProgress) (string, error) {
+	filter, err := newFileFilter(backup)
+	if err != nil {
+		return "", fmt.Errorf("invalid file filter: %v", err)
+	}
+	job := bs.jobFor(progress)
+	filter.job = job
+
+	rc, err := openRemote(server, job)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	source := path.Clean(backup.Source)
+	if _, err := rc.sftp.Stat(source); errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s on %s", ErrSourceMissing, source, server.Name)
+	} else if err != nil {
+		return "", rc.err(err)
+	}
+
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Scanning source on %s...", server.Name))
+	entries, err := filter.walkRemote(rc, source)
+	if err != nil {
+		return "", err
+	}
+	var total int64
+	for _, e := range entries {
+		if e.info.Mode().IsRegular() {
+			total += e.info.Size()
+		}
+	}
+	progress.TotalBytes = &total
+	progress.BytesProcessed = 0
+	bs.updateProgress(progress, 0, "running", fmt.Sprintf("Pulling source from %s...", server.Name))
+	rc.tracker = bs.newProgressTracker(progress)
+
+	staging := stagingDir(backup)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	keep := map[string]bool{".": true}
+	fetched := make(map[string]string)
+	locals := make(map[string]string)
+	for _, e := range entries {
+		keep[e.rel] = true
+		local := filepath.Join(staging, filepath.FromSlash(e.rel))
+		existing, statErr := os.Lstat(local)
+		if statErr == nil && existing.Mode().Type() != e.info.Mode().Type() {
+			os.RemoveAll(local)
+			statErr = os.ErrNotExist
+		}
+
+		switch {
+		case e.info.IsDir():
+			if err := os.MkdirAll(local, 0755); err != nil {
+				return "", err
+			}
+		case e.info.Mode()&os.ModeSymlink != 0:
+			target, err := rc.sftp.ReadLink(e.path)
+			if err != nil {
+				return "", rc.err(err)
+			}
+			if current, err := os.Readlink(local); err == nil && current == target {
+				continue
+			}
+			os.Remove(local)
+			if err := os.Symlink(target, local); err != nil {
+				return "", err
+			}
+		case e.info.Mode().IsRegular():
+			if statErr == nil && existing.Size() == e.info.Size() && existing.ModTime().Unix() == e.info.ModTime().Unix() {
+				rc.tracker.add(e.info.Size())
+				continue
+			}
+			sum, err := rc.download(e.path, local)
+			if err != nil {
+				return "", err
+			}
+			fetched[e.path] = sum
+			locals[e.path] = local
+		}
+	}
+
+	bs.updateProgress(progress, progress.Progress, "running", fmt.Sprintf("Verifying files pulled from %s...", server.Name))
+	remote, err := rc.sha256(keys(fetched)...)
+	if err != nil {
+		return "", err
+	}
+	for p, sum := range fetched {
+		if remote[p] != sum {
+			// Fetched again by the next pull
+			os.Remove(locals[p])
+			return "", fmt.Errorf("checksum mismatch for %s pulled from %s", p, server.Name)
+		}
+	}
+
+	// Drop staged entries that are no longer part of the source
+	err = filepath.Walk(staging, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, p)
+		if err != nil {
+			return err
+		}
+		if keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to clean staging directory: %v", err)
+	}
+	return staging, nil
+}
+
+func keys(m map[string]string) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
@@ -1,34 +0,0 @@
-package backups
-
-import (
-    "os"
-    "path/filepath"
-)
-
-func computeTotalSize(path string) (int64, error) {
-    var size int64
-    err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
-        if !info.IsDir() {
-            size += info.Size()
-        }
-        return nil
-    })
-    return size, err
-}
-
-func (bs *BackupService) calculateTotalBytes(source string) (int64, error) {
-	var total int64
-	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			total += info.Size()
-		}
-		return nil
-	})
-	return total, err
-}
@@ -0,0 +1,479 @@
+package backups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"snaptrack/db"
+	"snaptrack/services/logs"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Verification re-reads the data of completed runs from the servers that
+// store them. Archives are hashed and compared with the checksum recorded
+// for the run, and their entries are read back; raw mirrors are compared
+// file by file with the index of the run, and repo runs by the packs holding
+// their chunks.
+
+// Outcomes of verifying a run, recorded as its verify_status.
+const (
+	VerifyOK        = "ok"
+	VerifyCorrupted = "corrupted" // the stored data differs from what the run wrote
+	VerifyMissing   = "missing"   // the archive or mirror is gone
+	VerifyFailed    = "failed"    // the data could not be read, e.g. the server is down
+)
+
+var (
+	ErrNoVerifiableRun = errors.New("no completed run to verify")
+	ErrBackupRunning   = errors.New("backup is running")
+)
+
+// verifyError is a finding about the stored data, as opposed to a failure to
+// read it.
+type verifyError struct {
+	status string
+	msg    string
+}
+
+func (e *verifyError) Error() string { return e.msg }
+
+func corrupted(format string, args ...any) error {
+	return &verifyError{status: VerifyCorrupted, msg: fmt.Sprintf(format, args...)}
+}
+
+func missing(format string, args ...any) error {
+	return &verifyError{status: VerifyMissing, msg: fmt.Sprintf(format, args...)}
+}
+
+// sourceReader remembers the error of reading stored data, telling a failure
+// to read an archive apart from a damaged archive.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// verifiableRuns returns the completed runs of a backup to verify, newest
+// first; runID limits them to one run. A raw backup mirrors into the same
+// directory on every run, so only the newest run per server still matches
+// what is stored.
+func verifiableRuns(backup db.Backup, runID uint) ([]db.BackupRun, error) {
+	var runs []db.BackupRun
+	if err := db.DB.Where("backup_id = ? AND status = ?", backup.ID, "completed").Order("started_at DESC").Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[uint]bool)
+	list := runs[:0]
+	for _, run := range runs {
+		if backup.FileType == "raw" {
+			if seen[run.ServerID] {
+				if run.ID == runID {
+					return nil, fmt.Errorf("%w: run %d was replaced by a later run of this raw backup", ErrNoVerifiableRun, runID)
+				}
+				continue
+			}
+			seen[run.ServerID] = true
+		}
+		if runID == 0 || run.ID == runID {
+			list = append(list, run)
+		}
+	}
+	if len(list) == 0 {
+		return nil, ErrNoVerifiableRun
+	}
+	return list, nil
+}
+
+// StartVerify verifies the completed runs of a backup, or only the run with
+// runID, in the background. Progress is reported like a backup, with
+// operation "verify"; the outcome is recorded on each run.
+func (bs *BackupService) StartVerify(backup db.Backup, runID uint, executedBy string) (*db.BackupProgress, error) {
+	if backup.Status == "running" {
+		return nil, ErrBackupRunning
+	}
+	runs, err := verifiableRuns(backup, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, run := range runs {
+		if backup.FileType == "repo" {
+			// The packs a run uses were mostly written by earlier runs
+			total += repoVerifySize(run)
+			continue
+		}
+		total += run.SizeBytes
+	}
+	progress := &db.BackupProgress{
+		BackupID:   backup.ID,
+		Operation:  "verify",
+		Status:     "running",
+		Message:    "Starting verification...",
+		TotalBytes: &total,
+	}
+	if runID != 0 {
+		progress.RunID = &runs[0].ID
+	}
+	db.DB.Create(progress)
+	bs.BroadcastProgress(progress)
+	job := bs.startJob(progress)
+
+	go func() {
+		defer bs.endJob(job)
+		bs.verifyRuns(backup, runs, progress, executedBy)
+	}()
+	return progress, nil
+}
+
+func (bs *BackupService) verifyRuns(backup db.Backup, runs []db.BackupRun, progress *db.BackupProgress, executedBy string) {
+	ls := logs.NewLogService(db.DB)
+	tracker := bs.newProgressTracker(progress)
+	counts := make(map[string]int)
+	for i := range runs {
+		run := &runs[i]
+		bs.updateProgress(progress, progress.Progress, "running", fmt.Sprintf("Verifying run %d (%d of %d)...", run.ID, i+1, len(runs)))
+		err := bs.verifyRun(backup, *run, tracker)
+		if errors.Is(err, ErrCancelled) || tracker.job.cancelled() {
+			bs.updateProgress(progress, progress.Progress, "cancelled", "Verification cancelled")
+			ls.Warning(fmt.Sprintf("Verification of backup %s was cancelled", backup.Name), logs.PtrString("backup"), &backup.ID, nil)
+			return
+		}
+
+		status := VerifyOK
+		var msg *string
+		var ve *verifyError
+		if errors.As(err, &ve) {
+			status = ve.status
+		} else if err != nil {
+			status = VerifyFailed
+		}
+		if err != nil {
+			m := err.Error()
+			msg = &m
+		}
+		db.DB.Model(run).UpdateColumns(map[string]any{
+			"verified_at":   time.Now(),
+			"verify_status": status,
+			"verify_error":  msg,
+		})
+		counts[status]++
+
+		meta := map[string]interface{}{
+			"run_id":       run.ID,
+			"server_id":    run.ServerID,
+			"archive_path": run.ArchivePath,
+			"executed_by":  executedBy,
+		}
+		switch status {
+		case VerifyCorrupted, VerifyMissing:
+			meta["error"] = *msg
+			ls.Error(fmt.Sprintf("Run %d of backup %s is %s", run.ID, backup.Name, status), logs.PtrString("backup"), &backup.ID, meta)
+		case VerifyFailed:
+			meta["error"] = *msg
+			ls.Warning(fmt.Sprintf("Run %d of backup %s could not be verified", run.ID, backup.Name), logs.PtrString("backup"), &backup.ID, meta)
+		}
+	}
+
+	summary := fmt.Sprintf("Verified %d runs: %d ok, %d corrupted, %d missing, %d failed",
+		len(runs), counts[VerifyOK], counts[VerifyCorrupted], counts[VerifyMissing], counts[VerifyFailed])
+	if counts[VerifyOK] < len(runs) {
+		bs.updateProgress(progress, 100, "failed", summary)
+		return
+	}
+	bs.updateProgress(progress, 100, "completed", summary)
+	ls.Info("Backup verified", logs.PtrString("backup"), &backup.ID, map[string]interface{}{
+		"runs":        len(runs),
+		"executed_by": executedBy,
+	})
+}
+
+// verifyRun checks the stored data of a run. Findings about the data are
+// returned as a verifyError; other errors mean it could not be read.
+func (bs *BackupService) verifyRun(backup db.Backup, run db.BackupRun, tracker *progressTracker) error {
+	if run.ArchivePath == nil {
+		return missing("run %d has no archive path", run.ID)
+	}
+	var server db.Server
+	if err := db.DB.Unscoped().First(&server, run.ServerID).Error; err != nil {
+		return fmt.Errorf("server %d of run %d not found: %v", run.ServerID, run.ID, err)
+	}
+	dest, err := openDestination(server, tracker.job, nil)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	switch backup.FileType {
+	case "raw":
+		return verifyTree(dest, run, tracker)
+	case "repo":
+		return verifyRepo(server, dest, run, tracker)
+	}
+	return verifyArchive(backup, server, dest, run, tracker)
+}
+
+// verifyArchive hashes a tar or zip archive and reads its entries back. The
+// entries of encrypted archives are only read when the key of the backup is
+// stored; otherwise only the checksum is compared.
+func verifyArchive(backup db.Backup, server db.Server, dest Destination, run db.BackupRun, tracker *progressTracker) error {
+	name := *run.ArchivePath
+	info, err := dest.Stat(name)
+	if isNotExist(err) {
+		return missing("archive %s is missing on %s", name, server.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size != run.SizeBytes {
+		return corrupted("archive %s has %d bytes, %d were written", name, info.Size, run.SizeBytes)
+	}
+
+	r, err := dest.Open(name)
+	if isNotExist(err) {
+		return missing("archive %s is missing on %s", name, server.Name)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	src := &sourceReader{r: tracker.reader(r)}
+	hash := sha256.New()
+	stream := io.TeeReader(src, hash)
+
+	ids, keyErr := decryptionIdentities(backup, run, "")
+	var names map[string]bool
+	var entryErr error
+	switch {
+	case keyErr != nil:
+	case backup.FileType == "tar":
+		names, entryErr = tarEntries(stream, run, ids)
+	case server.Type == "local" && !encrypted(run.Encryption):
+		// Local archives are read in place once hashed
+		if _, err := io.Copy(io.Discard, stream); err == nil {
+			names, entryErr = zipEntries(name, tracker.job)
+		}
+	default:
+		names, entryErr = zipStreamEntries(stream, run, ids, tracker.job)
+	}
+	// Hash what the entries did not consume
+	io.Copy(io.Discard, stream)
+	if src.err != nil {
+		return src.err
+	}
+
+	if run.Checksum != nil && hex.EncodeToString(hash.Sum(nil)) != *run.Checksum {
+		return corrupted("checksum mismatch for archive %s", name)
+	}
+	if entryErr != nil {
+		var ve *verifyError
+		if errors.As(entryErr, &ve) {
+			return entryErr
+		}
+		return corrupted("archive %s cannot be read: %v", name, entryErr)
+	}
+	if names == nil {
+		return nil
+	}
+
+	// Every file the index places in this run must be in its archive
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND stored_run_id = ? AND deleted = ?", run.ID, run.ID, false).Find(&files).Error; err != nil {
+		return err
+	}
+	var lacking []string
+	for _, f := range files {
+		if !names[path.Clean(filepath.ToSlash(f.Path))] {
+			lacking = append(lacking, f.Path)
+		}
+	}
+	if len(lacking) > 0 {
+		return corrupted("archive %s lacks %d indexed files: %s", name, len(lacking), examples(lacking))
+	}
+	return nil
+}
+
+// decryptStream decrypts an archive stream with the identities of its run.
+func decryptStream(r io.Reader, run db.BackupRun, ids []age.Identity) (io.Reader, error) {
+	if !encrypted(run.Encryption) {
+		return r, nil
+	}
+	dr, err := age.Decrypt(r, ids...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			// The key of the backup changed since the run; that says nothing
+			// about the archive
+			return nil, fmt.Errorf("the stored key cannot decrypt run %d: %v", run.ID, err)
+		}
+		return nil, corrupted("failed to decrypt archive of run %d: %v", run.ID, err)
+	}
+	return dr, nil
+}
+
+// tarEntries reads a tar archive stream to its end and returns the names of
+// its entries.
+func tarEntries(r io.Reader, run db.BackupRun, ids []age.Identity) (map[string]bool, error) {
+	plain, err := decryptStream(r, run, ids)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := decompressReader(plain, run.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s stream: %v", run.Compression, err)
+	}
+	defer cr.Close()
+
+	names := make(map[string]bool)
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names[path.Clean(hdr.Name)] = true
+	}
+}
+
+// zipStreamEntries copies a zip archive stream into a temporary file, which
+// zip readers need, and reads its entries.
+func zipStreamEntries(r io.Reader, run db.BackupRun, ids []age.Identity, job *jobControl) (map[string]bool, error) {
+	plain, err := decryptStream(r, run, ids)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "verify-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, plain)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return zipEntries(tmp.Name(), job)
+}
+
+// zipEntries reads every entry of a zip archive, which checks its CRC, and
+// returns the names of the entries.
+func zipEntries(archive string, job *jobControl) (map[string]bool, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	registerZipDecompressors(&zr.Reader)
+
+	names := make(map[string]bool)
+	for _, zf := range zr.File {
+		if err := job.wait(); err != nil {
+			return nil, err
+		}
+		names[path.Clean(zf.Name)] = true
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", zf.Name, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", zf.Name, err)
+		}
+	}
+	return names, nil
+}
+
+// verifyTree hashes every file of a raw mirror listed in the index of the run
+// and compares the directory hash with the one of the index.
+func verifyTree(dest Destination, run db.BackupRun, tracker *progressTracker) error {
+	dir := *run.ArchivePath
+	if _, err := dest.Stat(dir); isNotExist(err) {
+		return missing("directory %s is missing", dir)
+	} else if err != nil {
+		return err
+	}
+	var files []db.RunFile
+	if err := db.DB.Where("run_id = ? AND deleted = ?", run.ID, false).Find(&files).Error; err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("run %d has no file index to verify against", run.ID)
+	}
+
+	stored := make([]db.RunFile, 0, len(files))
+	var lost, changed []string
+	for _, f := range files {
+		sum, err := hashObject(dest, path.Join(dir, filepath.ToSlash(f.Path)), tracker)
+		if isNotExist(err) {
+			lost = append(lost, f.Path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sum != f.SHA256 {
+			changed = append(changed, f.Path)
+		}
+		stored = append(stored, db.RunFile{Path: f.Path, SHA256: sum})
+	}
+	if treeChecksum(stored) == treeChecksum(files) {
+		return nil
+	}
+	var problems []string
+	if len(lost) > 0 {
+		problems = append(problems, fmt.Sprintf("%d files missing: %s", len(lost), examples(lost)))
+	}
+	if len(changed) > 0 {
+		problems = append(problems, fmt.Sprintf("%d files changed: %s", len(changed), examples(changed)))
+	}
+	return corrupted("directory hash mismatch for %s; %s", dir, strings.Join(problems, "; "))
+}
+
+// hashObject returns the SHA-256 of an object of a destination.
+func hashObject(dest Destination, name string, tracker *progressTracker) (string, error) {
+	r, err := dest.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, tracker.reader(r)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// examples lists the first few of a list of paths.
+func examples(paths []string) string {
+	const max = 5
+	if len(paths) <= max {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:max], ", "), len(paths)-max)
+}
@@ -0,0 +1,288 @@
+package backups
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"snaptrack/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAV servers store runs below the collection their host URL points at,
+// e.g. https://cloud.example.com/remote.php/dav/files/backup.
+
+// webdavBase parses the host of a WebDAV server.
+func webdavBase(host string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(host))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid WebDAV URL %q: an http or https URL is required", host)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// webdavDestination talks to a WebDAV server over HTTP.
+type webdavDestination struct {
+	server   db.Server
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+	job      *jobControl
+}
+
+func openWebDAV(server db.Server, job *jobControl) (*webdavDestination, error) {
+	base, err := webdavBase(server.Host)
+	if err != nil {
+		return nil, err
+	}
+	user, password, err := openPassword(server)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavDestination{server: server, base: base, user: user, password: password, client: &http.Client{}, job: job}, nil
+}
+
+// url returns the URL of a name below the base collection.
+func (d *webdavDestination) url(name string) string {
+	u := *d.base
+	u.Path = d.base.Path + path.Join("/", name)
+	return u.String()
+}
+
+func (d *webdavDestination) do(ctx context.Context, method, name string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth(d.user, d.password)
+	resp, err := d.client.Do(req)
+	if err != nil && d.job.cancelled() {
+		return nil, ErrCancelled
+	}
+	return resp, err
+}
+
+// expect closes the response and turns an unexpected status into an error.
+func (d *webdavDestination) expect(resp *http.Response, name string, codes ...int) error {
+	defer resp.Body.Close()
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("%s %s on %s: %s", resp.Request.Method, name, d.server.Name, resp.Status)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", fs.ErrNotExist, msg)
+	case http.StatusInsufficientStorage:
+		return fmt.Errorf("no space left: %s", msg)
+	}
+	return errors.New(msg)
+}
+
+// mkdirAll creates the collections of dir that do not exist yet.
+func (d *webdavDestination) mkdirAll(dir string) error {
+	current := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current += "/" + part
+		resp, err := d.do(d.job.context(), "MKCOL", current, nil, nil)
+		if err != nil {
+			return err
+		}
+		// 405 is returned for existing collections
+		if err := d.expect(resp, current, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create uploads the object to a partial name in a streamed PUT; Commit
+// moves it into place.
+func (d *webdavDestination) Create(name string) (ObjectWriter, error) {
+	if err := d.mkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	part := partialPath(name, "upload")
+	pr, pw := io.Pipe()
+	w := &webdavWriter{d: d, name: name, part: part, pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := d.do(d.job.context(), http.MethodPut, part, pr, http.Header{"Content-Type": {"application/octet-stream"}})
+		if err == nil {
+			err = d.expect(resp, part, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+		}
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type webdavWriter struct {
+	d    *webdavDestination
+	name string
+	part string
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *webdavWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *webdavWriter) Commit() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		w.d.Delete(w.part)
+		return err
+	}
+	resp, err := w.d.do(w.d.job.context(), "MOVE", w.part, nil, http.Header{
+		"Destination": {w.d.url(w.name)},
+		"Overwrite":   {"T"},
+	})
+	if err != nil {
+		return err
+	}
+	return w.d.expect(resp, w.name, http.StatusCreated, http.StatusNoContent)
+}
+
+func (w *webdavWriter) Abort() {
+	w.pw.CloseWithError(errors.New("upload aborted"))
+	<-w.done
+	w.d.Delete(w.part)
+}
+
+func (d *webdavDestination) Open(name string) (io.ReadCloser, error) {
+	resp, err := d.do(d.job.context(), http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, d.expect(resp, name, http.StatusOK)
+	}
+	return webdavReader{Reader: jobReader{r: resp.Body, job: d.job}, body: resp.Body}, nil
+}
+
+type webdavReader struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (r webdavReader) Close() error {
+	return r.body.Close()
+}
+
+// multistatus is the response of a PROPFIND request.
+type multistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			Length       string `xml:"getcontentlength"`
+			LastModified string `xml:"getlastmodified"`
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`
+
+// propfind lists name, and with depth 1 its members, as names below the base
+// collection.
+func (d *webdavDestination) propfind(name, depth string) ([]ObjectInfo, error) {
+	resp, err := d.do(d.job.context(), "PROPFIND", name, strings.NewReader(propfindBody), http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, d.expect(resp, name, http.StatusMultiStatus)
+	}
+	defer resp.Body.Close()
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response from %s: %v", d.server.Name, err)
+	}
+	list := make([]ObjectInfo, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		p, err := url.PathUnescape(href.EscapedPath())
+		if err != nil {
+			continue
+		}
+		info := ObjectInfo{
+			Name:  strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(p, d.base.Path), "/"), "/"),
+			IsDir: r.Prop.ResourceType.Collection != nil,
+		}
+		info.Size, _ = strconv.ParseInt(r.Prop.Length, 10, 64)
+		info.ModTime, _ = http.ParseTime(r.Prop.LastModified)
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func (d *webdavDestination) Stat(name string) (ObjectInfo, error) {
+	list, err := d.propfind(name, "0")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if len(list) == 0 {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", fs.ErrNotExist, name)
+	}
+	list[0].Name = name
+	return list[0], nil
+}
+
+func (d *webdavDestination) List(dir string) ([]ObjectInfo, error) {
+	list, err := d.propfind(dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	self := strings.Trim(dir, "/")
+	entries := list[:0]
+	for _, info := range list {
+		if info.Name == self {
+			continue
+		}
+		if strings.HasPrefix(dir, "/") {
+			info.Name = "/" + info.Name
+		}
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+func (d *webdavDestination) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := d.do(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return d.expect(resp, name, http.StatusNoContent, http.StatusOK)
+}
+
+func (d *webdavDestination) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
@@ -43,5 +43,13 @@ func (ls *LogService) Info(message string, entityType *string, entityID *uint, m
 	ls.Insert("info", message, entityType, entityID, metadata)
 }
 
+func (ls *LogService) Warning(message string, entityType *string, entityID *uint, metadata map[string]interface{}) {
+	ls.Insert("warning", message, entityType, entityID, metadata)
+}
+
+func (ls *LogService) Error(message string, entityType *string, entityID *uint, metadata map[string]interface{}) {
+	ls.Insert("error", message, entityType, entityID, metadata)
+}
+
 func PtrString(s string) *string { return &s }
 func PtrUint(u uint) *uint       { return &u }
@@ -3,13 +3,18 @@ package monitor
 import (
 	"encoding/json"
 	"snaptrack/db"
+	"time"
 )
 
 // CollectServerMetrics collects metrics for a given server based on its type (local or remote).
+// S3, WebDAV and FTP servers only store backups and have no host metrics.
 func CollectServerMetrics(server db.Server) ServerMetrics {
 	if server.Type == "remote" {
 		return getRemoteMetrics(server)
 	}
+	if server.Type != "local" {
+		return ServerMetrics{Timestamp: time.Now(), ServerID: server.ID, Host: server.Host, Processes: []ProcessInfo{}}
+	}
 	return getLocalMetrics(server)
 }
 
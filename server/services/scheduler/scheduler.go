@@ -0,0 +1,362 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"snaptrack/db"
+	"snaptrack/services/backups"
+	"snaptrack/services/logs"
+
+	"github.com/robfig/cron/v3"
+)
+
+// pollInterval is how often due backups are looked up in the database.
+const pollInterval = 15 * time.Second
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Scheduler fires backups whose next_run_at has passed, and likewise
+// verifications by next_verify_at and restore drills by next_drill_at. All
+// state lives in the backups table, so a restart picks up where the previous
+// process left off.
+type Scheduler struct {
+	backups *backups.BackupService
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func New(bs *backups.BackupService) *Scheduler {
+	return &Scheduler{
+		backups: bs,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start computes missing next-run times and begins polling for due backups.
+func (s *Scheduler) Start() {
+	s.syncAll()
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		s.tick(time.Now())
+		for {
+			select {
+			case now := <-ticker.C:
+				s.tick(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+// Validate checks that the schedule fields of a backup can be evaluated.
+func Validate(backup db.Backup) error {
+	if _, err := NextRun(backup, time.Now()); err != nil {
+		return err
+	}
+	if _, err := NextVerify(backup, time.Now()); err != nil {
+		return err
+	}
+	_, err := NextDrill(backup, time.Now())
+	return err
+}
+
+// location returns the time zone the schedules of a backup are evaluated in.
+func location(backup db.Backup) (*time.Location, error) {
+	if backup.Timezone == nil || *backup.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(*backup.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", *backup.Timezone, err)
+	}
+	return loc, nil
+}
+
+// nextTime returns the first time the spec fires strictly after the given time.
+func nextTime(spec string, after time.Time, loc *time.Location) (*time.Time, error) {
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %v", spec, err)
+	}
+	t := schedule.Next(after.In(loc))
+	if t.IsZero() {
+		return nil, fmt.Errorf("schedule %q never fires", spec)
+	}
+	return &t, nil
+}
+
+// NextRun returns the first run time strictly after the given time, or nil
+// when the backup is not scheduled.
+func NextRun(backup db.Backup, after time.Time) (*time.Time, error) {
+	loc, err := location(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec string
+	switch backup.ScheduleType {
+	case "", "one_time":
+		return nil, nil
+	case "daily":
+		spec = "@daily"
+	case "weekly":
+		spec = "@weekly"
+	case "monthly":
+		spec = "@monthly"
+	case "cron":
+		if backup.CronExpr == nil || strings.TrimSpace(*backup.CronExpr) == "" {
+			return nil, errors.New("cron_expr is required for cron schedules")
+		}
+		spec = strings.TrimSpace(*backup.CronExpr)
+	default:
+		return nil, fmt.Errorf("unsupported schedule type: %s", backup.ScheduleType)
+	}
+	return nextTime(spec, after, loc)
+}
+
+// NextVerify returns the first verification time strictly after the given
+// time, or nil when the backup has no verify_schedule. The schedule is a
+// cron expression or descriptor such as @weekly.
+func NextVerify(backup db.Backup, after time.Time) (*time.Time, error) {
+	if backup.VerifySchedule == nil || strings.TrimSpace(*backup.VerifySchedule) == "" {
+		return nil, nil
+	}
+	loc, err := location(backup)
+	if err != nil {
+		return nil, err
+	}
+	t, err := nextTime(strings.TrimSpace(*backup.VerifySchedule), after, loc)
+	if err != nil {
+		return nil, fmt.Errorf("verify_schedule: %v", err)
+	}
+	return t, nil
+}
+
+// NextDrill returns the first restore drill time strictly after the given
+// time, or nil when the backup has no drill schedule.
+func NextDrill(backup db.Backup, after time.Time) (*time.Time, error) {
+	if backup.Drill.Schedule == nil || strings.TrimSpace(*backup.Drill.Schedule) == "" {
+		return nil, nil
+	}
+	loc, err := location(backup)
+	if err != nil {
+		return nil, err
+	}
+	t, err := nextTime(strings.TrimSpace(*backup.Drill.Schedule), after, loc)
+	if err != nil {
+		return nil, fmt.Errorf("drill schedule: %v", err)
+	}
+	return t, nil
+}
+
+// Reschedule recomputes next_run_at, next_verify_at and next_drill_at after a
+// backup's schedules were changed.
+func (s *Scheduler) Reschedule(backup *db.Backup) error {
+	nextRun, err := NextRun(*backup, time.Now())
+	if err != nil {
+		return err
+	}
+	nextVerify, err := NextVerify(*backup, time.Now())
+	if err != nil {
+		return err
+	}
+	nextDrill, err := NextDrill(*backup, time.Now())
+	if err != nil {
+		return err
+	}
+	backup.NextRunAt = nextRun
+	backup.NextVerifyAt = nextVerify
+	backup.NextDrillAt = nextDrill
+	return db.DB.Model(backup).UpdateColumns(map[string]any{
+		"next_run_at":    nextRun,
+		"next_verify_at": nextVerify,
+		"next_drill_at":  nextDrill,
+	}).Error
+}
+
+// syncAll fills in the next run, verification and drill times of scheduled
+// backups that lack them and clears them for backups that are no longer
+// scheduled. Backups whose times are already in the past keep them, so a run
+// missed during downtime fires once. Each schedule is synced on its own, so
+// an invalid one does not hold up the others.
+func (s *Scheduler) syncAll() {
+	var list []db.Backup
+	if err := db.DB.Find(&list).Error; err != nil {
+		log.Printf("[scheduler] failed to load backups: %v", err)
+		return
+	}
+	for i := range list {
+		b := &list[i]
+		if next, err := NextRun(*b, time.Now()); err != nil {
+			log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		} else if next == nil && b.NextRunAt != nil {
+			db.DB.Model(b).UpdateColumn("next_run_at", nil)
+		} else if next != nil && b.NextRunAt == nil {
+			db.DB.Model(b).UpdateColumn("next_run_at", next)
+		}
+
+		if verify, err := NextVerify(*b, time.Now()); err != nil {
+			log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		} else if verify == nil && b.NextVerifyAt != nil {
+			db.DB.Model(b).UpdateColumn("next_verify_at", nil)
+		} else if verify != nil && b.NextVerifyAt == nil {
+			db.DB.Model(b).UpdateColumn("next_verify_at", verify)
+		}
+
+		if drill, err := NextDrill(*b, time.Now()); err != nil {
+			log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		} else if drill == nil && b.NextDrillAt != nil {
+			db.DB.Model(b).UpdateColumn("next_drill_at", nil)
+		} else if drill != nil && b.NextDrillAt == nil {
+			db.DB.Model(b).UpdateColumn("next_drill_at", drill)
+		}
+	}
+}
+
+func (s *Scheduler) tick(now time.Time) {
+	var due []db.Backup
+	err := db.DB.Where("schedule_type <> ? AND next_run_at IS NOT NULL AND next_run_at <= ?", "one_time", now).
+		Order("next_run_at").Find(&due).Error
+	if err != nil {
+		log.Printf("[scheduler] failed to query due backups: %v", err)
+		return
+	}
+	for _, b := range due {
+		s.fire(b, now)
+	}
+
+	due = nil
+	err = db.DB.Where("next_verify_at IS NOT NULL AND next_verify_at <= ?", now).
+		Order("next_verify_at").Find(&due).Error
+	if err != nil {
+		log.Printf("[scheduler] failed to query due verifications: %v", err)
+		return
+	}
+	for _, b := range due {
+		s.verify(b, now)
+	}
+
+	due = nil
+	err = db.DB.Where("next_drill_at IS NOT NULL AND next_drill_at <= ?", now).
+		Order("next_drill_at").Find(&due).Error
+	if err != nil {
+		log.Printf("[scheduler] failed to query due restore drills: %v", err)
+		return
+	}
+	for _, b := range due {
+		s.drill(b, now)
+	}
+}
+
+// fire claims the due slot with a conditional update before starting the
+// backup, so the same next_run_at can never be executed twice.
+func (s *Scheduler) fire(b db.Backup, now time.Time) {
+	ls := logs.NewLogService(db.DB)
+
+	next, err := NextRun(b, now)
+	if err != nil {
+		log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		return
+	}
+	res := db.DB.Model(&db.Backup{}).
+		Where("id = ? AND next_run_at = ?", b.ID, *b.NextRunAt).
+		UpdateColumns(map[string]any{"next_run_at": next, "last_run_at": now})
+	if res.Error != nil {
+		log.Printf("[scheduler] failed to claim backup %d: %v", b.ID, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		return
+	}
+	b.NextRunAt = next
+	b.LastRunAt = &now
+
+	if err := s.backups.StartBackup(b, "scheduler"); err != nil {
+		msg := fmt.Sprintf("Scheduled run of backup %s skipped: %v", b.Name, err)
+		ls.Warning(msg, logs.PtrString("backup"), &b.ID, nil)
+		return
+	}
+	ls.Info("Scheduled backup queued", logs.PtrString("backup"), &b.ID, map[string]interface{}{
+		"backup_name": b.Name,
+		"next_run_at": next,
+	})
+}
+
+// claim moves a due slot of a backup to next with a conditional update, like
+// fire does for runs. It reports whether this scheduler won the slot.
+func claim(b db.Backup, column string, due time.Time, next *time.Time) bool {
+	res := db.DB.Model(&db.Backup{}).
+		Where("id = ? AND "+column+" = ?", b.ID, due).
+		UpdateColumn(column, next)
+	if res.Error != nil {
+		log.Printf("[scheduler] failed to claim %s of backup %d: %v", column, b.ID, res.Error)
+		return false
+	}
+	return res.RowsAffected > 0
+}
+
+// verify claims a due verification and starts it.
+func (s *Scheduler) verify(b db.Backup, now time.Time) {
+	ls := logs.NewLogService(db.DB)
+
+	next, err := NextVerify(b, now)
+	if err != nil {
+		log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		return
+	}
+	if !claim(b, "next_verify_at", *b.NextVerifyAt, next) {
+		return
+	}
+	b.NextVerifyAt = next
+
+	if _, err := s.backups.StartVerify(b, 0, "scheduler"); err != nil {
+		if errors.Is(err, backups.ErrNoVerifiableRun) {
+			return
+		}
+		msg := fmt.Sprintf("Scheduled verification of backup %s skipped: %v", b.Name, err)
+		ls.Warning(msg, logs.PtrString("backup"), &b.ID, nil)
+		return
+	}
+	ls.Info("Scheduled verification started", logs.PtrString("backup"), &b.ID, map[string]interface{}{
+		"backup_name":    b.Name,
+		"next_verify_at": next,
+	})
+}
+
+// drill claims a due restore drill and starts it.
+func (s *Scheduler) drill(b db.Backup, now time.Time) {
+	ls := logs.NewLogService(db.DB)
+
+	next, err := NextDrill(b, now)
+	if err != nil {
+		log.Printf("[scheduler] backup %d (%s): %v", b.ID, b.Name, err)
+		return
+	}
+	if !claim(b, "next_drill_at", *b.NextDrillAt, next) {
+		return
+	}
+	b.NextDrillAt = next
+
+	result, err := s.backups.StartDrill(b, "scheduler")
+	if err != nil {
+		msg := fmt.Sprintf("Scheduled restore drill of backup %s skipped: %v", b.Name, err)
+		ls.Warning(msg, logs.PtrString("backup"), &b.ID, nil)
+		return
+	}
+	ls.Info("Scheduled restore drill started", logs.PtrString("backup"), &b.ID, map[string]interface{}{
+		"backup_name":   b.Name,
+		"drill_id":      result.ID,
+		"next_drill_at": next,
+	})
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the zones below, on hosts without a zoneinfo database
+
+	"snaptrack/db"
+)
+
+func ptr(s string) *string { return &s }
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNextRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		cron     *string
+		timezone *string
+		after    string
+		want     string // RFC 3339 in UTC, "" for no run
+		wantErr  bool
+	}{
+		{name: "unscheduled", schedule: "", after: "2026-03-20T10:00:00Z"},
+		{name: "one time", schedule: "one_time", after: "2026-03-20T10:00:00Z"},
+		{name: "daily utc", schedule: "daily", timezone: ptr("UTC"), after: "2026-03-20T10:00:00Z", want: "2026-03-21T00:00:00Z"},
+		{name: "daily is strictly after", schedule: "daily", timezone: ptr("UTC"), after: "2026-03-21T00:00:00Z", want: "2026-03-22T00:00:00Z"},
+		{name: "daily berlin", schedule: "daily", timezone: ptr("Europe/Berlin"), after: "2026-03-20T10:00:00Z", want: "2026-03-20T23:00:00Z"},
+		{name: "daily berlin summer time", schedule: "daily", timezone: ptr("Europe/Berlin"), after: "2026-07-01T10:00:00Z", want: "2026-07-01T22:00:00Z"},
+		{name: "weekly", schedule: "weekly", timezone: ptr("UTC"), after: "2026-03-20T10:00:00Z", want: "2026-03-22T00:00:00Z"},
+		{name: "monthly tokyo", schedule: "monthly", timezone: ptr("Asia/Tokyo"), after: "2026-03-20T10:00:00Z", want: "2026-03-31T15:00:00Z"},
+		{name: "cron weekdays new york", schedule: "cron", cron: ptr("0 9 * * 1-5"), timezone: ptr("America/New_York"), after: "2026-03-20T15:00:00Z", want: "2026-03-23T13:00:00Z"},
+		{name: "cron across spring forward", schedule: "cron", cron: ptr("0 3 * * *"), timezone: ptr("Europe/Berlin"), after: "2026-03-28T12:00:00Z", want: "2026-03-29T01:00:00Z"},
+		{name: "cron across fall back", schedule: "cron", cron: ptr("0 12 * * *"), timezone: ptr("Europe/Berlin"), after: "2026-10-24T12:00:00Z", want: "2026-10-25T11:00:00Z"},
+		{name: "cron trims", schedule: "cron", cron: ptr(" @hourly "), timezone: ptr("UTC"), after: "2026-03-20T10:30:00Z", want: "2026-03-20T11:00:00Z"},
+		{name: "cron without expression", schedule: "cron", cron: ptr("  "), after: "2026-03-20T10:00:00Z", wantErr: true},
+		{name: "invalid cron", schedule: "cron", cron: ptr("61 * * * *"), after: "2026-03-20T10:00:00Z", wantErr: true},
+		{name: "seconds are not supported", schedule: "cron", cron: ptr("0 0 9 * * *"), after: "2026-03-20T10:00:00Z", wantErr: true},
+		{name: "never fires", schedule: "cron", cron: ptr("0 0 30 2 *"), after: "2026-03-20T10:00:00Z", wantErr: true},
+		{name: "invalid timezone", schedule: "daily", timezone: ptr("Mars/Olympus"), after: "2026-03-20T10:00:00Z", wantErr: true},
+		{name: "unsupported type", schedule: "hourly", after: "2026-03-20T10:00:00Z", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := db.Backup{ScheduleType: tt.schedule, CronExpr: tt.cron, Timezone: tt.timezone}
+			got, err := NextRun(backup, utc(tt.after))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextRun error = %v, want error %v", err, tt.wantErr)
+			}
+			switch {
+			case tt.want == "" && got != nil:
+				t.Errorf("NextRun = %v, want none", got)
+			case tt.want != "" && (got == nil || !got.Equal(utc(tt.want))):
+				t.Errorf("NextRun = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextVerifyAndDrill(t *testing.T) {
+	after := utc("2026-03-20T10:00:00Z")
+	backup := db.Backup{Timezone: ptr("Europe/Berlin")}
+	if got, err := NextVerify(backup, after); got != nil || err != nil {
+		t.Errorf("NextVerify without schedule = %v, %v", got, err)
+	}
+	if got, err := NextDrill(backup, after); got != nil || err != nil {
+		t.Errorf("NextDrill without schedule = %v, %v", got, err)
+	}
+
+	backup.VerifySchedule = ptr("@weekly")
+	backup.Drill.Schedule = ptr("0 4 1 * *")
+	if got, err := NextVerify(backup, after); err != nil || !got.Equal(utc("2026-03-21T23:00:00Z")) {
+		t.Errorf("NextVerify = %v, %v", got, err)
+	}
+	if got, err := NextDrill(backup, after); err != nil || !got.Equal(utc("2026-04-01T02:00:00Z")) {
+		t.Errorf("NextDrill = %v, %v", got, err)
+	}
+
+	backup.VerifySchedule = ptr("every day")
+	if _, err := NextVerify(backup, after); err == nil {
+		t.Error("NextVerify accepted an invalid schedule")
+	}
+	if err := Validate(backup); err == nil {
+		t.Error("Validate accepted an invalid verify schedule")
+	}
+}
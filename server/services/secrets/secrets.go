@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix versions the format of sealed values.
+const sealedPrefix = "v1:"
+
+var (
+	keyOnce   sync.Once
+	masterKey []byte
+	keyErr    error
+)
+
+// loadMasterKey reads the 32-byte master key from MASTER_KEY (hex or base64)
+// or from the file named by MASTER_KEY_FILE. A missing key file is created
+// with a random key, readable only by the current user.
+func loadMasterKey() ([]byte, error) {
+	keyOnce.Do(func() {
+		if v := strings.TrimSpace(os.Getenv("MASTER_KEY")); v != "" {
+			masterKey, keyErr = decodeKey(v)
+			return
+		}
+
+		path := os.Getenv("MASTER_KEY_FILE")
+		if path == "" {
+			path = "master.key"
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			masterKey, keyErr = decodeKey(strings.TrimSpace(string(data)))
+			return
+		}
+		if !os.IsNotExist(err) {
+			keyErr = fmt.Errorf("failed to read master key: %v", err)
+			return
+		}
+
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			keyErr = err
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			keyErr = fmt.Errorf("failed to create master key directory: %v", err)
+			return
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			keyErr = fmt.Errorf("failed to write master key: %v", err)
+			return
+		}
+		masterKey = key
+	})
+	return masterKey, keyErr
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes, hex or base64 encoded")
+}
+
+func newAEAD() (cipher.AEAD, error) {
+	key, err := loadMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts a secret with the master key using AES-256-GCM so it can be
+// stored in the database.
+func Seal(plaintext string) (string, error) {
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal.
+func Open(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", errors.New("unsupported sealed secret format")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed sealed secret: %v", err)
+	}
+	aead, err := newAEAD()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("malformed sealed secret")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt secret: wrong master key?")
+	}
+	return string(plaintext), nil
+}
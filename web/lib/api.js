@@ -147,7 +147,131 @@ export async function executeBackup(id) {
 
   if (!res.ok) {
     const error = await res.json().catch(() => ({}))
-    throw new Error(error.message || 'Failed to execute backup')
+    throw new Error(error.error || error.message || 'Failed to execute backup')
+  }
+
+  return res.json()
+}
+
+export async function verifyBackup(id, runId = null) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/verify`, {
+    method: 'POST',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    },
+    body: JSON.stringify(runId ? { run_id: runId } : {})
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || error.message || 'Failed to start verification')
+  }
+
+  return res.json()
+}
+
+export async function runDrill(id) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/drill`, {
+    method: 'POST',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || error.message || 'Failed to start restore drill')
+  }
+
+  return res.json()
+}
+
+export async function fetchDrills(id) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/drills`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    throw new Error('Failed to fetch restore drills')
+  }
+
+  return res.json()
+}
+
+export async function fetchBackupRuns(id) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/runs`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    throw new Error('Failed to fetch backup runs')
+  }
+
+  return res.json()
+}
+
+export async function dismissSuspiciousRun(id, runId) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/runs/${runId}/suspicious`, {
+    method: 'DELETE',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to dismiss suspicious run')
+  }
+
+  return res.json()
+}
+
+export async function lockRun(id, runId, lock) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/runs/${runId}/lock`, {
+    method: 'POST',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    },
+    body: JSON.stringify(lock)
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to lock run')
+  }
+
+  return res.json()
+}
+
+export async function unlockRun(id, runId) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/${id}/runs/${runId}/lock`, {
+    method: 'DELETE',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to release legal hold')
   }
 
   return res.json()
@@ -281,6 +405,23 @@ export async function testServerConnection(id) {
   return res.json()
 }
 
+export async function fetchDockerInventory(serverId) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/servers/${serverId}/docker`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to list docker containers')
+  }
+
+  return res.json()
+}
+
 export async function fetchDashboardStats() {
   const authData = getAuthData()
   const res = await fetch(`${API_BASE}/dashboard/stats`, {
@@ -437,7 +578,7 @@ export async function deleteAllProcesses() {
 
   if (!res.ok) {
     const error = await res.json().catch(() => ({}))
-    throw new Error(error.message || 'Failed to delete all processes')
+    throw new Error(error.error || error.message || 'Failed to delete all processes')
   }
 
   if (res.status === 204) {
@@ -459,7 +600,7 @@ export async function deleteProcess(id) {
 
   if (!res.ok) {
     const error = await res.json().catch(() => ({}))
-    throw new Error(error.message || 'Failed to delete process')
+    throw new Error(error.error || error.message || 'Failed to delete process')
   }
 
   if (res.status === 204) {
@@ -496,3 +637,120 @@ export function monitorBatchWsUrl() {
   const wsBase = httpBase.replace(/^http/, 'ws')
   return `${wsBase}/api/monitor/ws`
 }
+
+async function controlProcess(id, action) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/processes/${id}/${action}`, {
+    method: 'POST',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || `Failed to ${action} process`)
+  }
+
+  return res.json()
+}
+
+export async function cancelProcess(id) {
+  return controlProcess(id, 'cancel')
+}
+
+export async function pauseProcess(id) {
+  return controlProcess(id, 'pause')
+}
+
+export async function resumeProcess(id) {
+  return controlProcess(id, 'resume')
+}
+
+export async function fetchQueue() {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/queue`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    throw new Error('Failed to fetch backup queue')
+  }
+
+  return res.json()
+}
+
+export async function cancelQueuedJob(id) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/backups/queue/${id}`, {
+    method: 'DELETE',
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to cancel job')
+  }
+
+  return { success: true }
+}
+
+export async function fetchRunFiles(runId, path = '') {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/runs/${runId}/files?path=${encodeURIComponent(path)}`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to fetch run files')
+  }
+
+  return res.json()
+}
+
+export async function downloadRunFile(runId, path) {
+  const authData = getAuthData()
+  const res = await fetch(`${API_BASE}/runs/${runId}/files/download?path=${encodeURIComponent(path)}`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to download file')
+  }
+
+  return res.blob()
+}
+
+export async function fetchBackupDiff(backupId, from = null, to = null) {
+  const authData = getAuthData()
+  const params = new URLSearchParams()
+  if (from) params.set('from', from)
+  if (to) params.set('to', to)
+  const res = await fetch(`${API_BASE}/backups/${backupId}/diff?${params}`, {
+    headers: {
+      'Authorization': `Bearer ${authData.token}`,
+      'Content-Type': 'application/json'
+    }
+  })
+
+  if (!res.ok) {
+    const error = await res.json().catch(() => ({}))
+    throw new Error(error.error || 'Failed to compare runs')
+  }
+
+  return res.json()
+}